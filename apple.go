@@ -0,0 +1,30 @@
+package main
+
+import "strings"
+
+const (
+	FsHFSPlus FileSystemType = "hfsplus"
+	FsAPFS    FileSystemType = "apfs"
+
+	CAPFSFuse Caller_ = "apfs-fuse"
+)
+
+// appleFS tells the Mac file systems, which are only ever mounted read-only,
+// the kernel writes no journaled hfs+ and apfs-fuse reads only. Their uuid is
+// kept
+func appleFS(fs FileSystemType) bool {
+	return fs == FsHFSPlus || fs == FsAPFS
+}
+
+// appleFileType finds hfs+ or apfs in the output of `file -sL dev`, whose
+// names are no single words fileFSType could match
+func appleFileType(dev, fileOut string) FileSystemType {
+	out := strings.TrimPrefix(strings.ToLower(fileOut), strings.ToLower(dev)+":")
+	switch {
+	case strings.Contains(out, "hfs extended"), strings.Contains(out, "hfs plus"):
+		return FsHFSPlus
+	case strings.Contains(out, "apple file system"), strings.Contains(out, "apfs"):
+		return FsAPFS
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultAutoMountBase is where the command line mounts a device given
+// without a mount path
+const DefaultAutoMountBase = "/mnt"
+
+// autoDirUnsafe is whatever does not belong into a directory name
+var autoDirUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// autoDirName makes a label safe as a directory name, empty when nothing of
+// it is left, e.g. for a label of only dots or slashes
+func autoDirName(label string) string {
+	return strings.Trim(autoDirUnsafe.ReplaceAllString(label, "_"), "._")
+}
+
+// bindAutoPath names the missing mount path after the label of the device, or
+// its uuid from before the change, under AutoMountBase. The path is created
+// as with AutoMkdir
+func (m *DevMounter) bindAutoPath() (err error) {
+	if m.args_.path_ != "" || m.AutoMountBase == "" {
+		return nil
+	}
+
+	label, _ := m.env().QueryDeviceTag(m.args_.dev, "LABEL")
+	name := autoDirName(label)
+	if name == "" {
+		if name, err = m.env().QueryDeviceUUID(m.args_.dev); err != nil {
+			return fmt.Errorf("%w: %s has no label or uuid to name it after", ErrNoPath, m.args_.dev)
+		}
+	}
+	m.args_.path_ = filepath.Join(m.AutoMountBase, name)
+	m.autoPath_ = true
+	return m.checkPath()
+}
+
+// mkdir tells whether a missing mount path is created
+func (m *DevMounter) mkdir() bool {
+	return m.AutoMkdir || m.autoPath_
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// attachMu serialises taking a free loop or nbd device, two attaches at the
+// same time could pick the same one
+var attachMu sync.Mutex
+
+var (
+	devLocksMu sync.Mutex
+	devLocks   = map[string]*sync.Mutex{}
+)
+
+// lockDev keeps two mounters of the same device, by any of its paths, from
+// running at the same time
+func lockDev(dev string) (unlock func()) {
+	if real_, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = real_
+	}
+	dev = NormalizeDevPath(dev)
+
+	devLocksMu.Lock()
+	l, ok := devLocks[dev]
+	if !ok {
+		l = new(sync.Mutex)
+		devLocks[dev] = l
+	}
+	devLocksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// MountBatch starts the mounters of ms, parallel at a time, each on its own
+// device. The results are in the order of ms. A failure stops the batch
+// from starting more and unmounts what was mounted, unless the mounter is
+// NoFail, see MountVolumeGroup. With OnlyChangeIfConflict the uuids to
+// change are chosen for the whole batch first, see planUUIDChanges, and
+// FsckParallel bounds the checks of the batch
+func MountBatch(ms []*DevMounter, parallel int) (results []*MountResult, err error) {
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	planUUIDChanges(ms)
+	fsckLimit(ms)
+	defer func() {
+		for _, m := range ms {
+			m.fsckSem_ = nil
+		}
+	}()
+	results = make([]*MountResult, len(ms))
+	errs := make([]error, len(ms))
+	var mu sync.Mutex
+	abort := false
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, m := range ms {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := abort
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, m *DevMounter) {
+			defer func() { <-sem; wg.Done() }()
+			unlock := lockDev(m.args_.dev)
+			err := m.Start()
+			unlock()
+			r := m.Result()
+			results[i] = &r
+			if err != nil {
+				m.Close()
+				errs[i] = err
+				if !m.NoFail {
+					mu.Lock()
+					abort = true
+					mu.Unlock()
+				}
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	var failed BatchError
+	strict := false
+	for i, m := range ms {
+		if errs[i] == nil {
+			continue
+		}
+		if failed.nofail(m, results[i], errs[i]) {
+			strict = strict || m.StrictNoFail
+		} else if err == nil {
+			err = fmt.Errorf("%s: %w", results[i].Dev, errs[i])
+		}
+	}
+	if err == nil && strict {
+		err = failed.result()
+	}
+	if err != nil {
+		for i := len(ms) - 1; i >= 0; i-- {
+			if results[i] != nil && errs[i] == nil {
+				ms[i].Close()
+			}
+		}
+		return nil, err
+	}
+	return results, failed.result()
+}
+
+// fsckLimit has the checks of ms share FsckParallel slots, the smallest one
+// set among them
+func fsckLimit(ms []*DevMounter) {
+	n := 0
+	for _, m := range ms {
+		if m.FsckParallel > 0 && (n == 0 || m.FsckParallel < n) {
+			n = m.FsckParallel
+		}
+	}
+	if n == 0 {
+		return
+	}
+	sem := make(chan struct{}, n)
+	for _, m := range ms {
+		m.fsckSem_ = sem
+	}
+}
+
+// BatchError collects the failures of the NoFail devices of a batch such as
+// MountVolumeGroup, each one prefixed with its device
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of the batch failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// batchConf applies opts to a throwaway mounter, for the settings a batch
+// needs before there is a mounter per device
+func batchConf(opts []Option) (conf DevMounter) {
+	for _, o := range opts {
+		o(&conf)
+	}
+	return conf
+}
+
+// nofail records err of r when conf allows the device to fail, reporting
+// whether the batch goes on
+func (b *BatchError) nofail(conf *DevMounter, r *MountResult, err error) bool {
+	if !conf.NoFail {
+		return false
+	}
+	r.Error = err.Error()
+	b.Errs = append(b.Errs, fmt.Errorf("%s: %w", r.Dev, err))
+	return true
+}
+
+// result is nil when no device failed, so that it can be returned as error
+func (b *BatchError) result() error {
+	if len(b.Errs) == 0 {
+		return nil
+	}
+	return b
+}
+
+// clone copies the configuration of m for another device, with slices and
+// maps of its own so that one mounter changing them leaves the rest alone
+func (m *DevMounter) clone() *DevMounter {
+	c := *m
+	c.ExtraChangeArgs = append([]string(nil), m.ExtraChangeArgs...)
+	c.CommandPrefix = append([]string(nil), m.CommandPrefix...)
+	c.MountOptions = append([]string(nil), m.MountOptions...)
+	c.MDMembers = append([]string(nil), m.MDMembers...)
+	c.BindPaths = append([]string(nil), m.BindPaths...)
+	c.PostMountCmd = append([]string(nil), m.PostMountCmd...)
+	c.ChecksumExclude = append([]string(nil), m.ChecksumExclude...)
+	if m.MountDefaults != nil {
+		c.MountDefaults = make(map[FileSystemType]string, len(m.MountDefaults))
+		for fs, o := range m.MountDefaults {
+			c.MountDefaults[fs] = o
+		}
+	}
+	// what a Start of m left belongs to m
+	c.warnings_, c.cleanups_ = nil, nil
+	return &c
+}
+
+// mountArgs mounts every dev:path of args with the configuration of conf,
+// printing the results as json, or writing them to output when given
+func mountArgs(conf *DevMounter, args []string, parallel int, output string) (err error) {
+	var ms []*DevMounter
+	for _, a := range args {
+		i := strings.LastIndex(a, ":")
+		if i <= 0 || i == len(a)-1 {
+			fmt.Fprintf(os.Stderr, "%q is not dev:path\n", a)
+			os.Exit(2)
+		}
+		m := conf.clone()
+		m.Reset(a[:i], a[i+1:], conf.args_.ctx)
+		if err_ := m.Validate(); err_ != nil {
+			fmt.Fprintln(os.Stderr, err_)
+			os.Exit(2)
+		}
+		ms = append(ms, m)
+	}
+
+	results, err := MountBatch(ms, parallel)
+	if results == nil {
+		return err
+	}
+	if output != "" {
+		if err_ := WriteResult(output, results); err == nil {
+			err = err_
+		}
+		return err
+	}
+	b, _ := json.MarshalIndent(results, "", "  ")
+	fmt.Println(string(b))
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const StepBindPaths OpStep = "bind-paths"
+
+// bindPaths bind mounts the mounted path at each of BindPaths, unmounted by
+// Close before the mount itself. A bind of a read-only mount is read-only
+func (m *DevMounter) bindPaths() (err error) {
+	for _, p := range m.BindPaths {
+		if !m.AllowUnsafePath && IsUnsafeMountPath(p) {
+			return fmt.Errorf("%w: %s", ErrUnsafeMountPath, p)
+		}
+		args := "--bind"
+		if m.mkdir() {
+			args += " -o X-mount.mkdir"
+		}
+		r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s %s %s %s", CMount, args, m.args_.path_, p))
+		if r != 0 {
+			return mountExitError(ErrMount, CMount, r, out)
+		}
+		bind := p
+		m.pushCleanup(func() error {
+			if !IsMount(bind) {
+				return nil
+			}
+			return m.env().UMount(bind)
+		})
+	}
+	return nil
+}
+
+// pathList is a repeatable flag, -path a -path b
+type pathList []string
+
+func (l *pathList) String() string { return strings.Join(*l, ",") }
+
+func (l *pathList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type BlkIDFlavor string
+
+const (
+	BlkIDUtilLinux BlkIDFlavor = "util-linux"
+	BlkIDBusyBox   BlkIDFlavor = "busybox"
+
+	BlkIDZFSMember = "zfs_member"
+)
+
+// BlkID is the blkid found on this host, detected on first use when empty
+var BlkID BlkIDFlavor
+
+// blkidMu guards the detection of BlkID, mounters of a batch query at once
+var blkidMu sync.Mutex
+
+// blkidFlavor is BlkID, detected first when empty
+func (x cmdEnv) blkidFlavor() BlkIDFlavor {
+	blkidMu.Lock()
+	defer blkidMu.Unlock()
+	if BlkID == "" {
+		BlkID = x.DetectBlkID()
+	}
+	return BlkID
+}
+
+// DetectBlkID tells util-linux blkid, which knows `-s` and `-o`, from the
+// busybox one
+func DetectBlkID() BlkIDFlavor {
+	return cmdEnv{}.DetectBlkID()
+}
+
+func (x cmdEnv) DetectBlkID() BlkIDFlavor {
+	if _, out, _ := x.ExecCmd(fmt.Sprintf("%s -V", CBlkID)); strings.Contains(out, "util-linux") {
+		return BlkIDUtilLinux
+	}
+	return BlkIDBusyBox
+}
+
+// QueryDeviceUUID asks blkid for the uuid of dev, and reads the ext or xfs
+// superblock itself when blkid has no answer
+func QueryDeviceUUID(dev string) (uuid string, err error) {
+	return cmdEnv{}.QueryDeviceUUID(dev)
+}
+
+func (x cmdEnv) QueryDeviceUUID(dev string) (uuid string, err error) {
+	if uuid, err = x.QueryDeviceTag(dev, "UUID"); err == nil {
+		return strings.ToLower(uuid), nil
+	}
+
+	if uuid, err_ := SuperblockUUID(dev); err_ == nil {
+		return uuid, nil
+	}
+	return "", err
+}
+
+// QueryDeviceTag returns one blkid tag of dev, e.g. UUID, TYPE or LABEL
+func QueryDeviceTag(dev, tag string) (value string, err error) {
+	return cmdEnv{}.QueryDeviceTag(dev, tag)
+}
+
+func (x cmdEnv) QueryDeviceTag(dev, tag string) (value string, err error) {
+	if x.blkidFlavor() == BlkIDUtilLinux {
+		if value, err = x.blkidValue(dev, tag); err == nil {
+			return value, nil
+		}
+		// the cache may not know a device just formatted or changed yet
+		return x.blkidProbe(dev, tag)
+	}
+	return x.blkidParse(dev, tag)
+}
+
+// DevicesByUUID lists every device blkid finds with uuid, dev paths as blkid
+// prints them
+func DevicesByUUID(uuid string) (devs []string, err error) {
+	return cmdEnv{}.DevicesByUUID(uuid)
+}
+
+func (x cmdEnv) DevicesByUUID(uuid string) (devs []string, err error) {
+	if x.blkidFlavor() == BlkIDUtilLinux {
+		r, out, _ := x.ExecCmd(fmt.Sprintf("%s -o device -t UUID=%s", CBlkID, uuid))
+		// 2 is nothing found
+		if r == 2 {
+			return nil, nil
+		} else if r != 0 {
+			return nil, ErrDevUUID
+		}
+		return strings.Fields(out), nil
+	}
+
+	r, out, _ := x.ExecCmd(string(CBlkID))
+	if r != 0 {
+		return nil, ErrDevUUID
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, ":"); i > 0 && strings.Contains(strings.ToLower(line), ` uuid="`+strings.ToLower(uuid)+`"`) {
+			devs = append(devs, line[:i])
+		}
+	}
+	return devs, nil
+}
+
+func (x cmdEnv) blkidValue(dev, tag string) (value string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -s %s -o value %s", CBlkID, tag, dev))
+	if out = strings.TrimSpace(out); r != 0 || out == "" {
+		return "", ErrDevUUID
+	}
+	return out, nil
+}
+
+// blkidProbe asks the low-level probe of util-linux blkid, which reads the
+// device itself instead of the cache
+func (x cmdEnv) blkidProbe(dev, tag string) (value string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -p -o export %s", CBlkID, dev))
+	if r != 0 {
+		return "", ErrDevUUID
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if v := strings.TrimPrefix(strings.TrimSpace(line), tag+"="); v != strings.TrimSpace(line) && v != "" {
+			return v, nil
+		}
+	}
+	return "", ErrDevUUID
+}
+
+// blkidParse reads `dev: LABEL="x" UUID="y" TYPE="z"`, the only output of
+// busybox blkid
+func (x cmdEnv) blkidParse(dev, tag string) (value string, err error) {
+	if r, out, _ := x.ExecCmd(
+		fmt.Sprintf("%s %s", CBlkID, dev)); r != 0 {
+		return "", ErrDevUUID
+	} else {
+		us := regexp.MustCompile("(?:^|\\s)" + regexp.QuoteMeta(tag) + "=\"(.*?)\"").FindStringSubmatch(out)
+		if len(us) >= 2 {
+			return us[1], nil
+		}
+	}
+	return "", ErrDevUUID
+}
+
+const (
+	extMagicOffset = 0x438
+	extUUIDOffset  = 0x468
+	extMagic       = 0xef53
+	// s_last_mounted, 64 bytes padded with nul
+	extLastMountedOffset = 0x488
+
+	xfsUUIDOffset = 32
+	xfsMagic      = "XFSB"
+)
+
+// SuperblockUUID reads the uuid straight from an ext or xfs superblock
+func SuperblockUUID(dev string) (uuid string, err error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	b := make([]byte, extUUIDOffset+16)
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	return parseSuperblockUUID(b)
+}
+
+// LastMountedOn reads the directory an ext file system was last mounted on
+// from its superblock, empty when it was never mounted. xfs keeps none,
+// ErrUnsFs then
+func LastMountedOn(dev string) (path_ string, err error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	b := make([]byte, extLastMountedOffset+64)
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	if binary.LittleEndian.Uint16(b[extMagicOffset:]) != extMagic {
+		return "", ErrUnsFs
+	}
+	last := b[extLastMountedOffset:]
+	if i := bytes.IndexByte(last, 0); i >= 0 {
+		last = last[:i]
+	}
+	return string(last), nil
+}
+
+func parseSuperblockUUID(b []byte) (uuid string, err error) {
+	var u []byte
+	if len(b) >= xfsUUIDOffset+16 && string(b[:4]) == xfsMagic {
+		u = b[xfsUUIDOffset : xfsUUIDOffset+16]
+	} else if len(b) >= extUUIDOffset+16 && binary.LittleEndian.Uint16(b[extMagicOffset:]) == extMagic {
+		u = b[extUUIDOffset : extUUIDOffset+16]
+	} else {
+		return "", ErrDevUUID
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
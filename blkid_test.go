@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryDeviceUUIDBusyBox(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"blkid -V":         {1, "BusyBox v1.36.1 multi-call binary."},
+		"blkid /dev/fake0": {0, `/dev/fake0: LABEL="data" UUID="0F7E0BD2-3D57-4C4C-9FA8-2B48E4E2C9A4" PARTUUID="5d3c" TYPE="ext4"`},
+	}}
+	useRunner(t, f)
+	BlkID = ""
+
+	u, err := QueryDeviceUUID(fakeDev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4" {
+		t.Errorf("got %q", u)
+	}
+	if BlkID != BlkIDBusyBox {
+		t.Errorf("detected %q", BlkID)
+	}
+}
+
+func TestParseSuperblockUUID(t *testing.T) {
+	u := []byte{0x0f, 0x7e, 0x0b, 0xd2, 0x3d, 0x57, 0x4c, 0x4c, 0x9f, 0xa8, 0x2b, 0x48, 0xe4, 0xe2, 0xc9, 0xa4}
+	want := "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"
+
+	ext := make([]byte, extUUIDOffset+16)
+	ext[extMagicOffset], ext[extMagicOffset+1] = 0x53, 0xef
+	copy(ext[extUUIDOffset:], u)
+
+	xfs := make([]byte, extUUIDOffset+16)
+	copy(xfs, xfsMagic)
+	copy(xfs[xfsUUIDOffset:], u)
+
+	for name, b := range map[string][]byte{"ext": ext, "xfs": xfs} {
+		if got, err := parseSuperblockUUID(b); err != nil || got != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	if _, err := parseSuperblockUUID(make([]byte, extUUIDOffset+16)); err != ErrDevUUID {
+		t.Errorf("no magic: got %v", err)
+	}
+}
+
+func TestBlkIDProbe(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"blkid -s UUID -o value /dev/sdb1": {2, ""},
+		"blkid -p -o export /dev/sdb1":     {0, "DEVNAME=/dev/sdb1\nUUID=1B4E28BA-2FA1-11D2-883F-0016D3CCA427\nTYPE=ext4\n"},
+	}}
+	useRunner(t, f)
+
+	if uuid, err := QueryDeviceUUID("/dev/sdb1"); err != nil || uuid != "1b4e28ba-2fa1-11d2-883f-0016d3cca427" {
+		t.Errorf("got %q, %v", uuid, err)
+	}
+	if _, err := QueryDeviceTag("/dev/sdb1", "LABEL"); err != ErrDevUUID {
+		t.Errorf("got %v, want %v", err, ErrDevUUID)
+	}
+}
+
+func TestDetectDevice(t *testing.T) {
+	cases := []struct {
+		name     string
+		fileOut  string
+		blkid    map[string]string
+		wantKind DeviceKind
+		wantFS   FileSystemType
+	}{
+		{"ext4", "Linux rev 1.0 ext4 filesystem data", nil, DeviceFilesystem, FsExt4},
+		{"gpt", "DOS/MBR boot sector; partition 1 : ID=0xee, start-CHS (0x0,0,2)", map[string]string{"PTTYPE": "gpt"}, DevicePartitionTable, ""},
+		{"lvm", "LVM2 PV (Linux Logical Volume Manager), UUID: 3Jx1kE-...", nil, DeviceLVMMember, ""},
+		{"lvm by blkid", "data", map[string]string{"TYPE": BlkIDLVMMember}, DeviceLVMMember, ""},
+		// file sees the ext4 of a raid1 member with the superblock at the end
+		{"raid1", "Linux rev 1.0 ext4 filesystem data", map[string]string{"TYPE": BlkIDRAIDMember}, DeviceRAIDMember, ""},
+		{"luks", "LUKS encrypted file, ver 2", nil, DeviceLUKS, ""},
+		{"swap", "Linux swap file, 4k page size", nil, DeviceSwap, FsSwap},
+		{"zfs", "data", map[string]string{"TYPE": BlkIDZFSMember}, DeviceFilesystem, FsZFS},
+		{"empty", "data", nil, DeviceEmpty, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeRunner(c.fileOut)
+			for tag, v := range c.blkid {
+				f.replies["blkid -s "+tag+" -o value "+fakeDev] = fakeReply{0, v}
+			}
+			useRunner(t, f)
+
+			kind, fs, err := DetectDevice(fakeDev)
+			if err != nil || kind != c.wantKind || fs != c.wantFS {
+				t.Errorf("got %q %q %v, want %q %q", kind, fs, err, c.wantKind, c.wantFS)
+			}
+		})
+	}
+}
+
+func TestByteSwapped(t *testing.T) {
+	dir := t.TempDir()
+	img := func(name string, at int, magic ...byte) string {
+		b := make([]byte, 4096)
+		copy(b[at:], magic)
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	for _, c := range []struct {
+		img     string
+		swapped bool
+	}{
+		{img("ext", extMagicOffset, 0x53, 0xef), false},
+		{img("ext-swapped", extMagicOffset, 0xef, 0x53), true},
+		{img("xfs", 0, 'X', 'F', 'S', 'B'), false},
+		{img("xfs-swapped", 0, 'B', 'S', 'F', 'X'), true},
+	} {
+		if got := ByteSwapped(c.img); got != c.swapped {
+			t.Errorf("%s: got %v, want %v", filepath.Base(c.img), got, c.swapped)
+		}
+	}
+
+	f := newFakeRunner("")
+	f.replies["mount"] = fakeReply{32, "mount: wrong fs type, bad option, bad superblock"}
+	f.replies["blkid"] = fakeReply{0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"}
+	useRunner(t, f)
+	m := NewMounterWithArgs(img("ext4", extMagicOffset, 0xef, 0x53), fakePath, "")
+	m.FS = FsExt4
+	if err := m.Start(); !errors.Is(err, ErrWrongEndian) || !errors.Is(err, ErrMount) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBtrfsSubvol     = errors.New("set either a btrfs subvolume or a subvolume id, not both")
+	ErrBtrfsDegradedRW = errors.New("degraded btrfs mounted writable")
+	ErrBtrfsList       = errors.New("failed to list the btrfs subvolumes")
+)
+
+// BtrfsTopLevelID is the subvolume id of the top level, the root of every
+// other subvolume whatever the default subvolume is
+const BtrfsTopLevelID = 5
+
+// BtrfsSubvol is one subvolume of `btrfs subvolume list`, ParentUUID is set
+// for a snapshot, the uuid of the subvolume it was taken of
+type BtrfsSubvol struct {
+	ID         int    `json:"id"`
+	Parent     int    `json:"parent"`
+	Path       string `json:"path"`
+	UUID       string `json:"uuid"`
+	ParentUUID string `json:"parent_uuid,omitempty"`
+}
+
+func (s BtrfsSubvol) Snapshot() bool { return s.ParentUUID != "" }
+
+// ListBtrfsSubvolumes lists the subvolumes of the btrfs on dev, with paths
+// relative to the top level, as mounted with subvol=. The top level is
+// mounted read-only on a temporary directory for it, and unmounted again
+func ListBtrfsSubvolumes(dev string) (subvols []BtrfsSubvol, err error) {
+	return cmdEnv{}.ListBtrfsSubvolumes(dev)
+}
+
+func (x cmdEnv) ListBtrfsSubvolumes(dev string) (subvols []BtrfsSubvol, err error) {
+	dir, err := ioutil.TempDir("", "newid-btrfs-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	if err = x.Mount(FsBtrfs, dev, dir, fmt.Sprintf("-o ro,subvolid=%d", BtrfsTopLevelID)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err_ := x.UMount(dir); err == nil {
+			err = err_
+		}
+	}()
+
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s subvolume list -p -q -u %s", CBtrfs, dir))
+	if r != 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBtrfsList, strings.TrimSpace(out))
+	}
+	return parseBtrfsSubvolumes(out)
+}
+
+// parseBtrfsSubvolumes reads lines such as
+// ID 258 gen 12 parent 5 top level 5 parent_uuid 6d2c... uuid 9f1e... path snap/1
+func parseBtrfsSubvolumes(out string) (subvols []BtrfsSubvol, err error) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, " path ")
+		if line == "" || i < 0 {
+			continue
+		}
+		s := BtrfsSubvol{Path: line[i+len(" path "):]}
+		f := strings.Fields(line[:i])
+		for j := 0; j+1 < len(f); j += 2 {
+			switch f[j] {
+			case "ID":
+				s.ID, err = strconv.Atoi(f[j+1])
+			case "parent":
+				s.Parent, err = strconv.Atoi(f[j+1])
+			case "uuid":
+				s.UUID = f[j+1]
+			case "parent_uuid":
+				if f[j+1] != "-" {
+					s.ParentUUID = f[j+1]
+				}
+			case "top":
+				// top level <id>
+				j++
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrBtrfsList, line)
+			}
+		}
+		subvols = append(subvols, s)
+	}
+	return subvols, nil
+}
+
+// changeBtrfs rewrites the fsid of every block, btrfstune asks for
+// confirmation unless forced
+func (m *DevMounter) changeBtrfs() (err error) {
+
+	if m.clone_ != "" {
+		err = m.env().SetBtrfsDevUUID(m.clone_, m.args_.dev, m.ExtraChangeArgs...)
+	} else {
+		err = m.env().GenBtrfsDevUUID(m.args_.dev, m.ExtraChangeArgs...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.uuid_, err = m.env().QueryDeviceUUID(m.args_.dev); err != nil {
+		return ErrQueryUUID
+	}
+	return nil
+}
+
+func GenBtrfsDevUUID(dev string, extra ...string) (err error) {
+	return cmdEnv{}.GenBtrfsDevUUID(dev, extra...)
+}
+
+func (x cmdEnv) GenBtrfsDevUUID(dev string, extra ...string) (err error) {
+	if err = checkExtraArgs(extra, dev, ""); err != nil {
+		return err
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -f -u %s %s", CBtrfsTune, strings.Join(extra, " "), dev)); r != 0 {
+		return ErrGenUUID
+	}
+	return nil
+}
+
+// btrfsOpts appends the subvolume selection to opts, and ro,degraded for
+// BtrfsDegraded whatever ReadOnly says
+func (m *DevMounter) btrfsOpts(opts []string) ([]string, error) {
+	if m.BtrfsSubvol != "" && m.BtrfsSubvolID != 0 {
+		return nil, ErrBtrfsSubvol
+	}
+	if m.BtrfsDegraded {
+		m.warn("mounting %s degraded and read-only, devices of the file system are missing", m.args_.dev)
+		if !m.ReadOnly {
+			opts = append(opts, "ro")
+		}
+		opts = append(opts, "degraded")
+	}
+	if m.BtrfsSubvol != "" {
+		opts = append(opts, "subvol="+m.BtrfsSubvol)
+	} else if m.BtrfsSubvolID != 0 {
+		opts = append(opts, "subvolid="+strconv.Itoa(m.BtrfsSubvolID))
+	}
+	return opts, nil
+}
+
+// checkDegraded verifies a degraded btrfs really is mounted read-only, writing
+// to it would leave the missing devices behind for good
+func (m *DevMounter) checkDegraded() (err error) {
+	if m.fs != FsBtrfs || !m.BtrfsDegraded {
+		return nil
+	}
+	e, err := MountEntryAt(m.args_.path_)
+	if err != nil {
+		return err
+	}
+	if e != nil && !e.HasOption("ro") {
+		return ErrBtrfsDegradedRW
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// treeEntry is one path of the mounted tree, sum is filled in for a file
+type treeEntry struct {
+	rel  string
+	mode os.FileMode
+	link string
+	sum  string
+}
+
+// TreeChecksum hashes the mounted tree, every path in lexical order with its
+// type, permissions and the sha256 of its content or the target of a
+// symlink. Times and owners are left out, so that a restored tree compares
+// equal to its source. Other file systems mounted below the path are
+// skipped, as are ChecksumExclude, patterns of filepath.Match on the path
+// relative to the mount path, a directory with everything below it. Files
+// are read by ChecksumWorkers at a time. Start never calls it, it reads the
+// whole tree
+func (m *DevMounter) TreeChecksum() (sum string, err error) {
+	root := m.args_.path_
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	rootDev := fi.Sys().(*syscall.Stat_t).Dev
+
+	var entries []*treeEntry
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		if excluded(m.ChecksumExclude, rel) || fi.Sys().(*syscall.Stat_t).Dev != rootDev {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := &treeEntry{rel: filepath.ToSlash(rel), mode: fi.Mode()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if e.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if err = hashFiles(root, entries, m.ChecksumWorkers); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s %o %q %s%s\n", fileKind(e.mode), e.mode.Perm(), e.rel, e.sum, e.link)
+	}
+	m.checksum_ = hex.EncodeToString(h.Sum(nil))
+	return m.checksum_, nil
+}
+
+// excluded tells whether rel matches one of patterns
+func excluded(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		p = strings.Trim(filepath.ToSlash(p), "/")
+		if ok, _ := filepath.Match(p, rel); ok || rel == p {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFiles fills in the sum of every regular file of entries, workers at a
+// time, the first error is returned
+func hashFiles(root string, entries []*treeEntry, workers int) (err error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	files := make(chan *treeEntry)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range files {
+				if err := hashFile(filepath.Join(root, e.rel), e); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		if e.mode.IsRegular() {
+			files <- e
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func hashFile(p string, e *treeEntry) (err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	e.sum = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// fileKind is the letter ls -l shows for the type of mode
+func fileKind(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "d"
+	case mode&os.ModeSymlink != 0:
+		return "l"
+	case mode&os.ModeNamedPipe != 0:
+		return "p"
+	case mode&os.ModeSocket != 0:
+		return "s"
+	case mode&os.ModeCharDevice != 0:
+		return "c"
+	case mode&os.ModeDevice != 0:
+		return "b"
+	}
+	return "-"
+}
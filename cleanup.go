@@ -0,0 +1,57 @@
+package main
+
+import "strings"
+
+// CleanupError gathers every failure of Close
+type CleanupError []error
+
+func (e CleanupError) Error() string {
+	ss := make([]string, 0, len(e))
+	for _, err := range e {
+		ss = append(ss, err.Error())
+	}
+	return "cleanup failed: " + strings.Join(ss, "; ")
+}
+
+// pushCleanup registers the release of a resource Start just acquired,
+// so the newest resource is released first: unmount, luksClose, kpartx -d,
+// losetup -d, lvchange -an
+func (m *DevMounter) pushCleanup(fn func() error) {
+	m.cleanups_ = append(m.cleanups_, fn)
+}
+
+// Close releases everything acquired by Start, in reverse order. It may be
+// called after a failed Start as well. Failed releases are kept, so Close can
+// be retried once whatever held them is gone
+func (m *DevMounter) Close() (err error) {
+	var errs CleanupError
+	var left []func() error
+
+	for i := len(m.cleanups_) - 1; i >= 0; i-- {
+		if err = m.cleanups_[i](); err != nil {
+			errs = append(errs, err)
+			left = append([]func() error{m.cleanups_[i]}, left...)
+		}
+	}
+	m.cleanups_ = left
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// WithMount runs fn on the mounted path and always unmounts afterwards, even
+// when Start or fn fails or fn panics. The first error is returned
+func (m *DevMounter) WithMount(fn func(mountPath string) error) (err error) {
+	defer func() {
+		if err_ := m.Close(); err == nil {
+			err = err_
+		}
+	}()
+
+	if err = m.Start(); err != nil {
+		return err
+	}
+	return fn(m.args_.path_)
+}
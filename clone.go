@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrCloneUUID = errors.New("cannot clone the uuid")
+
+// readCloneUUID reads the uuid of CloneUUIDFrom, whose file system has to be
+// the one of the device
+func (m *DevMounter) readCloneUUID() (err error) {
+	if m.CloneUUIDFrom == "" {
+		return nil
+	}
+	if m.fs == FsZFS {
+		return fmt.Errorf("%w: zfs pools keep their guid", ErrCloneUUID)
+	}
+	a, err := os.Stat(m.CloneUUIDFrom)
+	if err != nil {
+		return err
+	}
+	if b, err := os.Stat(m.args_.dev); err == nil && os.SameFile(a, b) {
+		return fmt.Errorf("%w: %s is the device itself", ErrCloneUUID, m.CloneUUIDFrom)
+	}
+
+	t, err := m.env().QueryDeviceTag(m.CloneUUIDFrom, "TYPE")
+	if err != nil {
+		return fmt.Errorf("%w: no file system on %s", ErrCloneUUID, m.CloneUUIDFrom)
+	}
+	if FileSystemType(t) != m.fs {
+		return fmt.Errorf("%w: %s is %s, not %s", ErrCloneUUID, m.CloneUUIDFrom, t, m.fs)
+	}
+	if m.clone_, err = m.env().QueryDeviceUUID(m.CloneUUIDFrom); err != nil {
+		return ErrQueryUUID
+	}
+	if IsMount(m.CloneUUIDFrom) {
+		m.warn("%s is mounted, the device cloning its uuid cannot be mounted beside it", m.CloneUUIDFrom)
+	}
+	return nil
+}
+
+// checkClone verifies the device took the cloned uuid
+func (m *DevMounter) checkClone() error {
+	if m.clone_ != "" && !strings.EqualFold(m.uuid_, m.clone_) {
+		return fmt.Errorf("%w: %s has %s instead of %s", ErrCloneUUID, m.args_.dev, m.uuid_, m.clone_)
+	}
+	return nil
+}
+
+// SetNTFsDevSerial sets the volume serial, 16 hex digits as blkid shows it
+func SetNTFsDevSerial(serial, dev string) (err error) {
+	return cmdEnv{}.SetNTFsDevSerial(serial, dev)
+}
+
+func (x cmdEnv) SetNTFsDevSerial(serial, dev string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s --new-serial=%s %s", CNTFsLabel, serial, dev)); r != 0 {
+		return ErrGenUUID
+	}
+	return nil
+}
+
+func SetBtrfsDevUUID(uuid_, dev string, extra ...string) (err error) {
+	return cmdEnv{}.SetBtrfsDevUUID(uuid_, dev, extra...)
+}
+
+func (x cmdEnv) SetBtrfsDevUUID(uuid_, dev string, extra ...string) (err error) {
+	if err = checkExtraArgs(extra, dev, uuid_); err != nil {
+		return err
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -f -U %s %s %s", CBtrfsTune, uuid_, strings.Join(extra, " "), dev)); r != 0 {
+		return ErrGenUUID
+	}
+	return nil
+}
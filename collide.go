@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CollisionTags are the blkid tags compared by DevicesCollide, in order. The
+// uuid, which is the serial of ntfs, makes mount itself fail, the others
+// confuse mounts by label or the /dev/disk/by-* links
+var CollisionTags = []string{"UUID", "UUID_SUB", "PARTUUID", "LABEL"}
+
+// DevicesCollide reports whether two devices share an identifier that would
+// get in the way of mounting both, and which tag it is, so the one to change
+// can be chosen before either is mounted
+func DevicesCollide(dev1, dev2 string) (collide bool, tag string, err error) {
+	return cmdEnv{}.DevicesCollide(dev1, dev2)
+}
+
+func (x cmdEnv) DevicesCollide(dev1, dev2 string) (collide bool, tag string, err error) {
+	fi1, err := os.Stat(dev1)
+	if err != nil {
+		return false, "", err
+	}
+	fi2, err := os.Stat(dev2)
+	if err != nil {
+		return false, "", err
+	}
+	if os.SameFile(fi1, fi2) {
+		return false, "", fmt.Errorf("%s and %s are the same device", dev1, dev2)
+	}
+
+	for _, t := range CollisionTags {
+		v1, _ := x.QueryDeviceTag(dev1, t)
+		if v1 == "" {
+			continue
+		}
+		if v2, _ := x.QueryDeviceTag(dev2, t); strings.EqualFold(v1, v2) {
+			return true, t, nil
+		}
+	}
+	return false, "", nil
+}
+
+// UUIDConflicts returns the uuid of dev and the other devices blkid finds
+// with it, dev itself is left out by any of its paths
+func UUIDConflicts(dev string) (uuid string, others []string, err error) {
+	return cmdEnv{}.UUIDConflicts(dev)
+}
+
+func (x cmdEnv) UUIDConflicts(dev string) (uuid string, others []string, err error) {
+	if uuid, err = x.QueryDeviceUUID(dev); err != nil {
+		return "", nil, err
+	}
+	devs, err := x.DevicesByUUID(uuid)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, _ := os.Stat(dev)
+	for _, d := range devs {
+		if SameDevPath(d, dev) {
+			continue
+		}
+		if fi_, err := os.Stat(d); err == nil && fi != nil && os.SameFile(fi, fi_) {
+			continue
+		}
+		others = append(others, d)
+	}
+	return uuid, others, nil
+}
+
+// keepUniqueUUID, with OnlyChangeIfConflict, keeps a uuid no other device
+// has, so that running Start again does not churn it. When blkid cannot
+// tell, the uuid is changed
+func (m *DevMounter) keepUniqueUUID() (kept bool) {
+	if !m.OnlyChangeIfConflict || m.CloneUUIDFrom != "" || !UUIDChangeable(m.fs) {
+		return false
+	}
+	var uuid string
+	switch m.uuidPlan_ {
+	case planChange:
+		return false
+	case planKeep:
+		if uuid, _ = m.env().QueryDeviceUUID(m.args_.dev); uuid == "" {
+			return false
+		}
+	default:
+		var others []string
+		var err error
+		uuid, others, err = m.env().UUIDConflicts(m.args_.dev)
+		if err != nil || uuid == "" || len(others) != 0 {
+			return false
+		}
+	}
+	m.logger().Logf("the uuid %s of %s is unique, keeping it", uuid, m.args_.dev)
+	m.uuid_ = uuid
+	return true
+}
+
+type uuidPlan int
+
+const (
+	planNone uuidPlan = iota
+	planKeep
+	planChange
+)
+
+// planUUIDChanges decides for the mounters of a batch with
+// OnlyChangeIfConflict which keep their uuid, before any of them runs, so
+// that mounters running at the same time do not each see the other's uuid
+// and both change it. Of the devices of the batch sharing a uuid no device
+// outside of it has, the first keeps it. Where blkid cannot tell, the
+// mounter decides by itself
+func planUUIDChanges(ms []*DevMounter) {
+	inBatch := func(dev string) bool {
+		for _, m := range ms {
+			if SameDevPath(dev, m.args_.dev) {
+				return true
+			}
+		}
+		return false
+	}
+
+	taken := make(map[string]bool)
+	for _, m := range ms {
+		if !m.OnlyChangeIfConflict {
+			continue
+		}
+		uuid, others, err := m.env().UUIDConflicts(m.args_.dev)
+		if err != nil || uuid == "" {
+			continue
+		}
+		uuid = strings.ToLower(uuid)
+		outside := false
+		for _, o := range others {
+			outside = outside || !inBatch(o)
+		}
+		if outside || taken[uuid] {
+			m.uuidPlan_ = planChange
+		} else {
+			m.uuidPlan_ = planKeep
+		}
+		taken[uuid] = true
+	}
+}
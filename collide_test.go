@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDevicesCollide(t *testing.T) {
+	a, b := filepath.Join(t.TempDir(), "a.img"), filepath.Join(t.TempDir(), "b.img")
+	for _, p := range []string{a, b} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		replies map[string]fakeReply
+		want    string
+	}{
+		{map[string]fakeReply{
+			"blkid -s UUID -o value " + a: {0, "0F7E0BD2-3D57-4C4C-9FA8-2B48E4E2C9A4"},
+			"blkid -s UUID -o value " + b: {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+		}, "UUID"},
+		{map[string]fakeReply{
+			"blkid -s UUID -o value " + a:  {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+			"blkid -s UUID -o value " + b:  {0, "1b4e28ba-2fa1-11d2-883f-0016d3cca427"},
+			"blkid -s LABEL -o value " + a: {0, "data"},
+			"blkid -s LABEL -o value " + b: {0, "data"},
+		}, "LABEL"},
+		{map[string]fakeReply{
+			"blkid -s UUID -o value " + a: {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+		}, ""},
+	} {
+		useRunner(t, &fakeRunner{replies: c.replies})
+		collide, tag, err := DevicesCollide(a, b)
+		if err != nil || collide != (c.want != "") || tag != c.want {
+			t.Errorf("got %v %q %v, want %q", collide, tag, err, c.want)
+		}
+	}
+
+	if _, _, err := DevicesCollide(a, a); err == nil {
+		t.Error("same device collides")
+	}
+}
+
+func TestOnlyChangeIfConflict(t *testing.T) {
+	const uuid = "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["blkid -o device -t UUID="+uuid] = fakeReply{0, fakeDev + "\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.OnlyChangeIfConflict = true
+	m.Logger = LoggerFunc(func(string, ...interface{}) {})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") {
+			t.Errorf("unique uuid changed: %q", c)
+		}
+	}
+
+	f.replies["blkid -o device -t UUID="+uuid] = fakeReply{0, fakeDev + "\n/dev/sdb1\n"}
+	f.cmds = nil
+	m.Reset(fakeDev, fakePath, "")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	changed := false
+	for _, c := range f.cmds {
+		changed = changed || c == "tune2fs -U random "+fakeDev
+	}
+	if !changed {
+		t.Errorf("conflicting uuid kept: %q", f.cmds)
+	}
+}
+
+func TestPlanUUIDChanges(t *testing.T) {
+	const x, y = "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"blkid -s UUID -o value /dev/vg/a": {0, x},
+		"blkid -s UUID -o value /dev/vg/b": {0, x},
+		"blkid -s UUID -o value /dev/vg/c": {0, y},
+		"blkid -o device -t UUID=" + x:     {0, "/dev/mapper/vg-a\n/dev/mapper/vg-b\n"},
+		"blkid -o device -t UUID=" + y:     {0, "/dev/mapper/vg-c\n/dev/sdz1\n"},
+	}}
+	useRunner(t, f)
+	base := t.TempDir()
+	var ms []*DevMounter
+	for _, lv := range []string{"a", "b", "c"} {
+		ms = append(ms, NewMounter("/dev/vg/"+lv, filepath.Join(base, lv), WithFS(FsExt4), WithOnlyChangeIfConflict(),
+			func(m *DevMounter) { m.SkipCheck = true }, WithLogger(LoggerFunc(func(string, ...interface{}) {}))))
+	}
+
+	if _, err := MountBatch(ms, 3); err != nil {
+		t.Fatal(err)
+	}
+	changed := map[string]bool{}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") {
+			changed[c[strings.LastIndex(c, " ")+1:]] = true
+		}
+	}
+	if changed["/dev/vg/a"] || !changed["/dev/vg/b"] || !changed["/dev/vg/c"] {
+		t.Errorf("changed %v, want b and c", changed)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "strings"
+
+// DefaultMountOptions are merged into the options of every mount by
+// MountDevice, keyed by the type given to mount, so the ntfs entry only
+// reaches ntfs-3g and not the ntfs3 driver, which knows no windows_names
+var DefaultMountOptions = map[FileSystemType]string{
+	FsExt2:  "noatime",
+	FsExt3:  "noatime",
+	FsExt4:  "noatime",
+	FsXFS_:  "inode64",
+	FsNTFs:  "windows_names",
+	FsBtrfs: "noatime",
+}
+
+// mountDefaults is the comma separated default options for fs
+func (m *DevMounter) mountDefaults(fs FileSystemType) string {
+	if m.MountDefaults != nil {
+		return m.MountDefaults[fs]
+	}
+	return DefaultMountOptions[fs]
+}
+
+// mergeMountOptions appends opts to the defaults, leaving out the defaults
+// opts set themselves, e.g. atime=x replaces atime=y and relatime noatime
+func mergeMountOptions(defaults string, opts []string) []string {
+	set := make(map[string]bool)
+	for _, o := range opts {
+		set[optionKey(o)] = true
+	}
+	var merged []string
+	for _, d := range SplitMountOptions(defaults) {
+		if d != "" && !set[optionKey(d)] {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, opts...)
+}
+
+// SplitMountOptions splits an fstab style option string on the commas outside
+// double quotes, so that context="system_u:object_r:tmp_t:s0:c1,c2" stays one
+// option, quotes and all. An unterminated quote runs to the end
+func SplitMountOptions(s string) (opts []string) {
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				if i > start {
+					opts = append(opts, s[start:i])
+				}
+				start = i + 1
+			}
+		}
+	}
+	if start < len(s) {
+		opts = append(opts, s[start:])
+	}
+	return opts
+}
+
+func optionKey(o string) string {
+	if i := strings.Index(o, "="); i >= 0 {
+		o = o[:i]
+	}
+	switch o {
+	case "atime", "noatime", "relatime", "norelatime", "strictatime", "nostrictatime":
+		return "atime"
+	case "inode32", "inode64":
+		return "inode"
+	}
+	return o
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeMountOptions(t *testing.T) {
+	cases := []struct {
+		defaults string
+		opts     []string
+		want     []string
+	}{
+		{"noatime", nil, []string{"noatime"}},
+		{"noatime", []string{"ro"}, []string{"noatime", "ro"}},
+		{"noatime", []string{"relatime"}, []string{"relatime"}},
+		{"inode64,logbsize=256k", []string{"logbsize=64k", "inode32"}, []string{"logbsize=64k", "inode32"}},
+		{"", []string{"ro"}, []string{"ro"}},
+	}
+	for _, c := range cases {
+		if got := mergeMountOptions(c.defaults, c.opts); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("mergeMountOptions(%q, %q) = %q, want %q", c.defaults, c.opts, got, c.want)
+		}
+	}
+}
+
+func TestMountDefaults(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounter(fakeDev, fakePath, WithMountOptions("nodev", "strictatime"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o nodev,strictatime " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.MountOptions = nil
+	m.MountDefaults = map[FileSystemType]string{}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+}
+
+func TestSplitMountOptions(t *testing.T) {
+	for s, want := range map[string][]string{
+		"noatime,ro": {"noatime", "ro"},
+		`nodev,context="system_u:object_r:tmp_t:s0:c1,c2",ro`: {"nodev", `context="system_u:object_r:tmp_t:s0:c1,c2"`, "ro"},
+		`x-systemd.requires="a,b"`:                            {`x-systemd.requires="a,b"`},
+		",noatime,,ro,":                                       {"noatime", "ro"},
+		`context="unterminated,ro`:                            {`context="unterminated,ro`},
+		"":                                                    nil,
+	} {
+		if got := SplitMountOptions(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("SplitMountOptions(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestContextOption(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	ctx := `context="system_u:object_r:tmp_t:s0:c1,c2"`
+	m := NewMounterWithArgs(fakeDev, fakePath, "system_u:object_r:httpd_sys_content_t:s0")
+	m.MountOptions = SplitMountOptions("nodev," + ctx)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,nodev," + ctx + " " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DevMapperDir holds the device-mapper nodes, LVM names them vg-lv with every
+// dash inside vg or lv doubled, e.g. /dev/vg--test/lv is /dev/mapper/vg----test-lv
+const DevMapperDir = "/dev/mapper"
+
+// the /dev sub directories whose two level paths are not /dev/vg/lv
+var nonLVMDirs = map[string]bool{
+	"mapper": true, "md": true, "disk": true, "block": true, "char": true,
+	"bus": true, "cciss": true, "ida": true, "rd": true, "loop": true,
+	"pts": true, "shm": true, "input": true, "net": true, "snd": true, "zvol": true,
+}
+
+// MapperName is the device-mapper name of the logical volume lv in vg
+func MapperName(vg, lv string) string {
+	return strings.Replace(vg, "-", "--", -1) + "-" + strings.Replace(lv, "-", "--", -1)
+}
+
+// ParseMapperName splits a device-mapper name into vg and lv, ok is false for
+// a name that is not vg-lv, e.g. a luks or multipath map
+func ParseMapperName(name string) (vg, lv string, ok bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '-' {
+			i++
+			continue
+		}
+		vg, lv = name[:i], name[i+1:]
+		if vg == "" || lv == "" || strings.HasPrefix(lv, "-") {
+			return "", "", false
+		}
+		// a single dash left in lv is the suffix of an lvm internal
+		// volume, e.g. vg-lv-real, not a name of the form vg-lv
+		if strings.Contains(strings.Replace(lv, "--", "", -1), "-") {
+			return "", "", false
+		}
+		return strings.Replace(vg, "--", "-", -1), strings.Replace(lv, "--", "-", -1), true
+	}
+	return "", "", false
+}
+
+// NormalizeDevPath rewrites a /dev/vg/lv path to its /dev/mapper/vg-lv form,
+// the one the mount table lists, other paths are only cleaned
+func NormalizeDevPath(dev string) string {
+	dev = filepath.Clean(dev)
+	if !strings.HasPrefix(dev, "/dev/") {
+		return dev
+	}
+	parts := strings.Split(strings.TrimPrefix(dev, "/dev/"), "/")
+	if len(parts) != 2 || nonLVMDirs[parts[0]] {
+		return dev
+	}
+	return filepath.Join(DevMapperDir, MapperName(parts[0], parts[1]))
+}
+
+// SameDevPath reports whether a and b name the same device, either as
+// /dev/vg/lv or as /dev/mapper/vg-lv
+func SameDevPath(a, b string) bool {
+	return a == b || NormalizeDevPath(a) == NormalizeDevPath(b)
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestMapperName(t *testing.T) {
+	cases := []struct{ vg, lv, name string }{
+		{"vg_test", "xfs_lv", "vg_test-xfs_lv"},
+		{"vg-test", "lv", "vg--test-lv"},
+		{"vg", "xfs-lv", "vg-xfs--lv"},
+		{"a--b", "c-", "a----b-c--"},
+	}
+	for _, c := range cases {
+		if got := MapperName(c.vg, c.lv); got != c.name {
+			t.Errorf("MapperName(%q, %q) = %q, want %q", c.vg, c.lv, got, c.name)
+		}
+		vg, lv, ok := ParseMapperName(c.name)
+		if !ok || vg != c.vg || lv != c.lv {
+			t.Errorf("ParseMapperName(%q) = %q, %q, %v", c.name, vg, lv, ok)
+		}
+	}
+
+	for _, name := range []string{"luks", "-lv", "vg-", "vg-lv-real"} {
+		if vg, lv, ok := ParseMapperName(name); ok {
+			t.Errorf("ParseMapperName(%q) = %q, %q", name, vg, lv)
+		}
+	}
+}
+
+func TestNormalizeDevPath(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"/dev/vg_test/xfs_lv", "/dev/mapper/vg_test-xfs_lv"},
+		{"/dev/vg-test/lv", "/dev/mapper/vg--test-lv"},
+		{"/dev/vg-test/my-lv/", "/dev/mapper/vg--test-my--lv"},
+		{"/dev/mapper/vg--test-lv", "/dev/mapper/vg--test-lv"},
+		{"/dev/md/data", "/dev/md/data"},
+		{"/dev/disk/by-uuid/x", "/dev/disk/by-uuid/x"},
+		{"/dev/sda1", "/dev/sda1"},
+		{"/tmp/vg/lv", "/tmp/vg/lv"},
+	}
+	for _, c := range cases {
+		if got := NormalizeDevPath(c.in); got != c.want {
+			t.Errorf("NormalizeDevPath(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	if !SameDevPath("/dev/vg--x/lv", "/dev/mapper/vg----x-lv") || SameDevPath("/dev/vg/lv", "/dev/mapper/vg-lv2") {
+		t.Error("SameDevPath")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var ErrWrongEndian = errors.New("the superblock is byte swapped, this looks like an image of a host of the other byte order")
+
+// hostByteOrder names the byte order of the architectures this builds for
+func hostByteOrder() string {
+	switch runtime.GOARCH {
+	case "ppc64", "mips", "mips64", "s390x", "sparc64":
+		return "big-endian"
+	}
+	return "little-endian"
+}
+
+// ByteSwapped tells whether dev holds the magic of an ext or an xfs with
+// its bytes the other way round. Both keep one byte order on disk whatever
+// the host, ext little and xfs big endian, a swapped magic is an image
+// written or copied by something that got it wrong
+func ByteSwapped(dev string) bool {
+	f, err := os.Open(dev)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	b := make([]byte, extMagicOffset+2)
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint16(b[extMagicOffset:]) == extMagic ||
+		string([]byte{b[3], b[2], b[1], b[0]}) == xfsMagic
+}
+
+// endianError tells a mount of an ext or xfs that failed on a byte swapped
+// superblock, given as the Kind of the mount error
+func (m *DevMounter) endianError(err error) error {
+	var e *MountExitError
+	if !errors.As(err, &e) || (!strings.HasPrefix(string(m.fs), "ext") && m.fs != FsXFS_) || !ByteSwapped(m.args_.dev) {
+		return err
+	}
+	e.Kind = fmt.Errorf("%w, this host is %s", ErrWrongEndian, hostByteOrder())
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables read in place of flags, e.g.
+// NEWID_MOUNT_TIMEOUT for -mount-timeout
+const EnvPrefix = "NEWID_"
+
+// EnvName is the environment variable of the flag name
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets every flag of fs not given on the command line from
+// its environment variable, a flag given wins
+func setFlagsFromEnv(fs *flag.FlagSet) (err error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok && !given[f.Name] && err == nil {
+			if err_ := fs.Set(f.Name, v); err_ != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, EnvName(f.Name), err_)
+			}
+		}
+	})
+	return err
+}
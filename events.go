@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type EventKind string
+
+const (
+	EventStepStarted   EventKind = "step-started"
+	EventCommandRun    EventKind = "command-run"
+	EventStepCompleted EventKind = "step-completed"
+	EventError         EventKind = "error"
+	EventDone          EventKind = "done"
+)
+
+// EventBuffer is how many events StartWithEvents holds for a slow consumer,
+// progress events beyond it are dropped
+const EventBuffer = 64
+
+// Event is one thing StartWithEvents tells about. Step is set for the step
+// events, Command, Exit and Elapsed for a command run, Err for a failed step
+// and the error event, Result for done
+type Event struct {
+	Kind    EventKind
+	Step    OpStep
+	Command string
+	Exit    int
+	Elapsed time.Duration
+	Err     error
+	Result  *MountResult
+}
+
+// StartWithEvents runs Start in the background and tells about its progress
+// on the returned channel, closed once Start returned. Progress events are
+// dropped while the buffer is full, so that Start never waits for the
+// consumer, the final error and done events have room kept for them. Only
+// the commands of this Start are told about, not those other mounters run at
+// the same time, e.g. in a MountBatch. A configuration that Validate
+// rejects is returned right away with no channel
+func (m *DevMounter) StartWithEvents() (<-chan Event, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	// room for the error and done events. Progress is only sent while Start
+	// runs, mu keeps a command on another goroutine of it from taking that room
+	ch := make(chan Event, EventBuffer+2)
+	var mu sync.Mutex
+	emit := func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ch) < EventBuffer {
+			ch <- e
+		}
+	}
+	m.onStep_ = func(e StepEvent) {
+		if e.Done {
+			emit(Event{Kind: EventStepCompleted, Step: e.Step, Elapsed: e.Elapsed, Err: e.Err})
+		} else {
+			emit(Event{Kind: EventStepStarted, Step: e.Step})
+		}
+	}
+	m.onCmd_ = func(cmdStr string, r int, err error, d time.Duration) {
+		emit(Event{Kind: EventCommandRun, Command: cmdStr, Exit: r, Elapsed: d, Err: err})
+	}
+
+	go func() {
+		defer close(ch)
+		err := m.Start()
+		m.onStep_, m.onCmd_ = nil, nil
+		if err != nil {
+			ch <- Event{Kind: EventError, Err: err}
+		}
+		r := m.Result()
+		ch <- Event{Kind: EventDone, Err: err, Result: &r}
+	}()
+	return ch, nil
+}
+
+type cmdWatcher func(cmdStr string, r int, err error, d time.Duration)
+
+// cmdDone passes a finished command to DebugLogger and the hook of the
+// mounter running it
+func (x cmdEnv) cmdDone(cmdStr string, r int, err error, d time.Duration) {
+	if DebugLogger != nil {
+		debugCmd(cmdStr, r, err, d)
+	}
+	if x.onCmd != nil {
+		x.onCmd(cmdStr, r, err, d)
+	}
+}
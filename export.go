@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	CExportfs Caller_ = "exportfs"
+
+	StepExport OpStep = "nfs-export"
+)
+
+var ErrExport = errors.New("failed to export the mount over nfs")
+
+// ExportNFS exports path_ to client, e.g. 10.0.0.0/24 or *, with opts, the
+// defaults of exportfs when empty
+func ExportNFS(client, path_, opts string) (err error) {
+	return cmdEnv{}.ExportNFS(client, path_, opts)
+}
+
+func (x cmdEnv) ExportNFS(client, path_, opts string) (err error) {
+	args := ""
+	if opts != "" {
+		args = "-o " + opts + " "
+	}
+	if r, out, _ := x.ExecCmd(fmt.Sprintf("%s %s%s:%s", CExportfs, args, client, path_)); r != 0 {
+		return fmt.Errorf("%w: %s", ErrExport, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func UnexportNFS(client, path_ string) (err error) {
+	return cmdEnv{}.UnexportNFS(client, path_)
+}
+
+func (x cmdEnv) UnexportNFS(client, path_ string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -u %s:%s", CExportfs, client, path_)); r != 0 {
+		return fmt.Errorf("failed to unexport %s:%s", client, path_)
+	}
+	return nil
+}
+
+// exportNFS exports the mount to NFSExportClient when asked to, Close
+// unexports it before unmounting
+func (m *DevMounter) exportNFS() (err error) {
+	if m.NFSExportClient == "" {
+		return nil
+	}
+	client, path_ := m.NFSExportClient, m.args_.path_
+	if err = m.env().ExportNFS(client, path_, m.NFSExportOptions); err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().UnexportNFS(client, path_) })
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrExtJournal    = errors.New("the ext file system has an external journal, set its journal device")
+	ErrExtJournalDev = errors.New("the journal device does not belong to the ext file system")
+)
+
+var extJournalUUID = regexp.MustCompile(`(?m)^Journal UUID:\s+(\S+)`)
+
+// ExtJournalUUID returns the uuid of the external journal of dev, empty when
+// the journal is internal or missing
+func ExtJournalUUID(dev string) (uuid string, err error) {
+	return cmdEnv{}.ExtJournalUUID(dev)
+}
+
+func (x cmdEnv) ExtJournalUUID(dev string) (uuid string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -h %s", CDumpE2FS, dev))
+	if r != 0 {
+		return "", fmt.Errorf("%s failed on %s", CDumpE2FS, dev)
+	}
+	if u := extJournalUUID.FindStringSubmatch(out); u != nil && u[1] != "<none>" {
+		return strings.ToLower(u[1]), nil
+	}
+	return "", nil
+}
+
+// checkExtJournal requires ExtJournalDevice for an external journal, and
+// that it is the very journal recorded in the superblock
+func (m *DevMounter) checkExtJournal() (err error) {
+	ju, err := m.env().ExtJournalUUID(m.args_.dev)
+	if err != nil {
+		// nothing known, tune2fs and mount will tell
+		return nil
+	}
+	if ju == "" {
+		return nil
+	}
+	if m.ExtJournalDevice == "" {
+		return ErrExtJournal
+	}
+	if u, err := m.env().QueryDeviceUUID(m.ExtJournalDevice); err != nil || u != ju {
+		return ErrExtJournalDev
+	}
+	return nil
+}
+
+// extJournalOpt is the journal_dev mount option, the kernel wants the new
+// style encoded device number
+func (m *DevMounter) extJournalOpt() (string, error) {
+	major, minor, err := DeviceNumber(m.ExtJournalDevice)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("journal_dev=%d", (minor&0xff)|(major<<8)|((minor&^0xff)<<12)), nil
+}
+
+const CMke2fs Caller_ = "mke2fs"
+
+var ErrExtSuperblock = errors.New("neither the primary nor a backup ext superblock is readable")
+
+var (
+	extBackups      = regexp.MustCompile(`Superblock backups stored on blocks:\s*([\d,\s]+)`)
+	mke2fsBlockSize = regexp.MustCompile(`Block size=(\d+)`)
+	extFsUUID       = regexp.MustCompile(`(?m)^Filesystem UUID:\s+(\S+)`)
+)
+
+// ExtBackupSuperblocks lists where mke2fs puts the backup superblocks of dev,
+// in blocks of blockSize. mke2fs -n only prints the layout it would make, which
+// is that of the file system unless it was made with other than the defaults
+func ExtBackupSuperblocks(dev string) (blocks []int64, blockSize int, err error) {
+	return cmdEnv{}.ExtBackupSuperblocks(dev)
+}
+
+func (x cmdEnv) ExtBackupSuperblocks(dev string) (blocks []int64, blockSize int, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -n %s", CMke2fs, dev))
+	b, s := extBackups.FindStringSubmatch(out), mke2fsBlockSize.FindStringSubmatch(out)
+	if r != 0 || b == nil || s == nil {
+		return nil, 0, fmt.Errorf("%s found no backup superblocks of %s", CMke2fs, dev)
+	}
+	blockSize, _ = strconv.Atoi(s[1])
+	for _, f := range strings.FieldsFunc(b[1], func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		blocks = append(blocks, n)
+	}
+	return blocks, blockSize, nil
+}
+
+// extSuperblockUUID reads the uuid from the superblock at block, the primary
+// when 0, failing when that superblock is unreadable
+func (x cmdEnv) extSuperblockUUID(dev string, block int64, blockSize int) (uuid string, err error) {
+	c := fmt.Sprintf("%s -h %s", CDumpE2FS, dev)
+	if block != 0 {
+		c = fmt.Sprintf("%s -o superblock=%d -o blocksize=%d -h %s", CDumpE2FS, block, blockSize, dev)
+	}
+	r, out, _ := x.ExecCmd(c)
+	u := extFsUUID.FindStringSubmatch(out)
+	if r != 0 || u == nil {
+		return "", ErrExtSuperblock
+	}
+	return strings.ToLower(u[1]), nil
+}
+
+// findBackupSuperblock looks for a readable backup superblock, of the first
+// MaxBackupSuperblocks or all, when the primary one is damaged. The mount
+// then goes through the backup with sb=, and the uuid is kept as tune2fs
+// only writes through the primary
+func (m *DevMounter) findBackupSuperblock() (found bool, err error) {
+	if _, err = m.env().extSuperblockUUID(m.args_.dev, 0, 0); err == nil {
+		return false, nil
+	}
+	blocks, blockSize, err := m.env().ExtBackupSuperblocks(m.args_.dev)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrExtSuperblock, err)
+	}
+	if m.MaxBackupSuperblocks > 0 && len(blocks) > m.MaxBackupSuperblocks {
+		blocks = blocks[:m.MaxBackupSuperblocks]
+	}
+	for _, b := range blocks {
+		uuid, err := m.env().extSuperblockUUID(m.args_.dev, b, blockSize)
+		if err != nil {
+			continue
+		}
+		if m.RequireUUIDChange {
+			return false, fmt.Errorf("%w: the primary superblock of %s is damaged", ErrUUIDChangeUnsupported, m.args_.dev)
+		}
+		m.warn("the primary superblock of %s is damaged, mounting with the backup at block %d, the uuid is kept", m.args_.dev, b)
+		// sb= counts in 1k units whatever the block size
+		m.extSB_ = b * int64(blockSize) / 1024
+		m.uuid_ = uuid
+		return true, nil
+	}
+	return false, ErrExtSuperblock
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtJournal(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["dumpe2fs -h "+fakeDev] = fakeReply{0, "Filesystem UUID:          0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4\nJournal UUID:             9b1d3a0c-6f2e-4c1b-8a59-3e0f6d7c2b11\nJournal device:	          0x0811\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Start(); err != ErrExtJournal {
+		t.Errorf("got %v, want %v", err, ErrExtJournal)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.ExtJournalDevice = "/dev/fake2"
+	if err := m.Start(); err != ErrExtJournalDev {
+		t.Errorf("got %v, want %v", err, ErrExtJournalDev)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.ExtJournalDevice = ""
+	m.TryBackupSuperblock = true
+	if err := m.Start(); err != ErrExtJournal {
+		t.Errorf("got %v, want %v", err, ErrExtJournal)
+	}
+
+	// /dev/null is 1:3
+	f.replies["blkid -s UUID -o value /dev/null"] = fakeReply{0, "9b1d3a0c-6f2e-4c1b-8a59-3e0f6d7c2b11"}
+	m.Reset(fakeDev, fakePath, "")
+	m.ExtJournalDevice = "/dev/null"
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,journal_dev=259 " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+}
+
+func TestBackupSuperblock(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["dumpe2fs -h "+fakeDev] = fakeReply{1, "dumpe2fs: Bad magic number in super-block while trying to open " + fakeDev}
+	f.replies["mke2fs -n "+fakeDev] = fakeReply{0, "Block size=4096 (log=2)\nFragment size=4096 (log=2)\n" +
+		"Superblock backups stored on blocks: \n\t32768, 98304, 163840, 229376\n"}
+	f.replies["dumpe2fs -o superblock=32768 -o blocksize=4096 -h "+fakeDev] = fakeReply{1, ""}
+	f.replies["dumpe2fs -o superblock=98304 -o blocksize=4096 -h "+fakeDev] = fakeReply{0, "Filesystem UUID:          0F7E0BD2-3D57-4C4C-9FA8-2B48E4E2C9A4\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.TryBackupSuperblock = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") {
+			t.Errorf("uuid changed through a damaged superblock: %q", c)
+		}
+	}
+	if want := "mount -o noatime,sb=393216 " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+	if r := m.Result(); r.UUID != "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4" {
+		t.Errorf("got %+v", r)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.MaxBackupSuperblocks = 1
+	if err := m.Start(); err != ErrExtSuperblock {
+		t.Errorf("got %v, want %v", err, ErrExtSuperblock)
+	}
+}
+
+func TestFastRestore(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.FastRestore = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,data=writeback,nobarrier " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+
+	f.cmds = nil
+	m.Reset(fakeDev, fakePath, "")
+	m.FastRestoreNoJournal = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"tune2fs -O ^has_journal " + fakeDev,
+		"mount -o noatime,nobarrier " + fakeDev + " " + fakePath,
+		"umount " + fakePath,
+		"tune2fs -O has_journal " + fakeDev,
+	}
+	if got := f.cmds[len(f.cmds)-4:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
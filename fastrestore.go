@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrFastRestore = errors.New("failed to set up the fast restore")
+
+// fastRestoreFS tells the file systems FastRestore applies to, ext2 has no
+// journal to begin with
+func fastRestoreFS(fs FileSystemType) bool {
+	return fs == FsExt3 || fs == FsExt4
+}
+
+// fastRestoreOpts are the mount options of FastRestore. data=writeback
+// journals the metadata only, so after a crash a file may hold stale blocks,
+// and nobarrier lets the disk cache reorder writes. Neither is safe for a
+// file system in use, only for one that is restored again after a crash.
+// An ext without a journal takes no data=
+func (m *DevMounter) fastRestoreOpts() []string {
+	if !m.FastRestore || !fastRestoreFS(m.fs) {
+		return nil
+	}
+	if m.noJournal_ {
+		return []string{"nobarrier"}
+	}
+	return []string{"data=writeback", "nobarrier"}
+}
+
+// dropJournal removes the journal of the ext before it is mounted, when
+// asked to, and has Close add it back once it is unmounted. Until then a
+// crash may leave the file system for e2fsck to repair
+func (m *DevMounter) dropJournal() (err error) {
+	if !m.FastRestore || !m.FastRestoreNoJournal {
+		return nil
+	}
+	if !fastRestoreFS(m.fs) {
+		m.warn("%s is %s, fast restore only applies to ext3 and ext4", m.args_.dev, m.fs)
+		return nil
+	}
+
+	dev := m.args_.dev
+	if r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s -O ^has_journal %s", CTune2FS, dev)); r != 0 {
+		return fmt.Errorf("%w: %s", ErrFastRestore, strings.TrimSpace(out))
+	}
+	m.noJournal_ = true
+	m.pushCleanup(func() error {
+		if r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s -O has_journal %s", CTune2FS, dev)); r != 0 {
+			return fmt.Errorf("failed to add the journal of %s back: %s", dev, strings.TrimSpace(out))
+		}
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrFsck = errors.New("file system check failed")
+
+// FsckCmd is the read-only check of fs on dev
+func FsckCmd(fs FileSystemType, dev string) (string, error) {
+	c := fs.FsckTool()
+	if h, ok := lookupFS(fs); ok {
+		c = h.FsckTool()
+	}
+	switch c {
+	case CE2Fsck:
+		return fmt.Sprintf("%s -f -n %s", c, dev), nil
+	case CXFSRepair, CNTFsFix:
+		return fmt.Sprintf("%s -n %s", c, dev), nil
+	case CBtrfs:
+		return fmt.Sprintf("%s check --readonly %s", c, dev), nil
+	case "":
+	default:
+		return fmt.Sprintf("%s %s", c, dev), nil
+	}
+	return "", ErrUnsFs
+}
+
+// RunFsck checks the device when Fsck is set, nothing is repaired
+func (m *DevMounter) RunFsck() (err error) {
+	if !m.Fsck {
+		return nil
+	}
+	if m.fs == "" {
+		if err = m.BindArgs(); err != nil {
+			return err
+		}
+	}
+
+	c, err := FsckCmd(m.fs, m.args_.dev)
+	if err != nil {
+		return err
+	}
+	if m.fsckSem_ != nil {
+		m.fsckSem_ <- struct{}{}
+		defer func() { <-m.fsckSem_ }()
+	}
+	r, out, err := m.env().ExecCmdTimeout(c, m.FsckTimeout)
+	if err == ErrTimeout {
+		return fmt.Errorf("%w: %s timed out after %s", ErrFsck, m.args_.dev, m.FsckTimeout)
+	}
+	if r != 0 {
+		return fmt.Errorf("%w: %s: %s", ErrFsck, m.args_.dev, out)
+	}
+	return nil
+}
+
+// FsckBatch checks the devices of ms, parallel at a time like `fsck -A`.
+// The errors are in the order of ms
+func FsckBatch(ms []*DevMounter, parallel int) []error {
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	errs := make([]error, len(ms))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, m := range ms {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m *DevMounter) {
+			defer func() { <-sem; wg.Done() }()
+			fsck := m.Fsck
+			m.Fsck = true
+			errs[i] = m.RunFsck()
+			m.Fsck = fsck
+		}(i, m)
+	}
+	wg.Wait()
+	return errs
+}
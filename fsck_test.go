@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sleepRunner runs `sleep 5` whatever it is asked for
+type sleepRunner struct{}
+
+func (sleepRunner) Run(string) (int, string, error) { return execCmd("sleep 5", 0) }
+
+func (sleepRunner) RunTimeout(_ string, d time.Duration) (int, string, error) {
+	return execCmd("sleep 5", d)
+}
+
+func TestFsckTimeout(t *testing.T) {
+	useRunner(t, sleepRunner{})
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.fs = FsExt4
+	m.Fsck = true
+	m.FsckTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := m.RunFsck()
+	if !errors.Is(err, ErrFsck) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("fsck not stopped after %s", time.Since(start))
+	}
+}
+
+func TestFsckBatch(t *testing.T) {
+	f := newFakeRunner("")
+	f.replies["e2fsck -f -n /dev/bad"] = fakeReply{4, "/dev/bad: ********** WARNING: Filesystem still has errors **********"}
+	useRunner(t, f)
+
+	var ms []*DevMounter
+	for _, dev := range []string{"/dev/good", "/dev/bad"} {
+		m := NewMounterWithArgs(dev, "", "")
+		m.fs = FsExt4
+		ms = append(ms, m)
+	}
+	errs := FsckBatch(ms, 2)
+	if errs[0] != nil || !errors.Is(errs[1], ErrFsck) {
+		t.Errorf("got %v", errs)
+	}
+}
+
+func TestFSTools(t *testing.T) {
+	for _, c := range []struct {
+		fs           FileSystemType
+		change, fsck Caller_
+	}{
+		{FsExt4, CTune2FS, CE2Fsck},
+		{FsXFS_, CXFSAdmin, CXFSRepair},
+		{FsNTFs3, CNTFsLabel, CNTFsFix},
+		{FsBtrfs, CBtrfsTune, CBtrfs},
+		{FsSwap, "", ""},
+	} {
+		change, err := c.fs.ChangeUUIDTool()
+		if change != c.change || (c.change == "") != errors.Is(err, ErrUUIDChangeUnsupported) {
+			t.Errorf("%s: change tool %q, %v", c.fs, change, err)
+		}
+		if fsck := c.fs.FsckTool(); fsck != c.fsck {
+			t.Errorf("%s: fsck tool %q, want %q", c.fs, fsck, c.fsck)
+		}
+	}
+	if h := FsSwap.MountHelper(); h != CSwapOn {
+		t.Errorf("swap mounted by %q", h)
+	}
+	if h := FileSystemType("hfs").MountHelper(); h != "" {
+		t.Errorf("hfs mounted by %q", h)
+	}
+}
+
+// jfsHandler is a file system added from outside
+type jfsHandler struct{ changed *string }
+
+func (jfsHandler) Detect(_, fileOut string) bool { return strings.Contains(fileOut, "jfs2") }
+
+func (h jfsHandler) ChangeUUID(m *DevMounter) error {
+	*h.changed = m.Result().Dev
+	_, _, err := ExecCmd("jfs_tune -U random " + m.Result().Dev)
+	return err
+}
+
+func (jfsHandler) MountHelper() Caller_ { return CMount }
+
+func (jfsHandler) FsckTool() Caller_ { return "jfs_fsck" }
+
+func TestRegisterFilesystem(t *testing.T) {
+	const jfs FileSystemType = "jfs"
+	var changed string
+	RegisterFilesystem(jfs, jfsHandler{&changed})
+	defer func() {
+		fsHandlersMu.Lock()
+		delete(fsHandlers, jfs)
+		fsHandlerOrder = fsHandlerOrder[:len(fsHandlerOrder)-1]
+		fsHandlersMu.Unlock()
+	}()
+
+	f := newFakeRunner("/dev/fake0: JFS2 filesystem image")
+	useRunner(t, f)
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Fsck = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"file -sL /dev/fake0",
+		"jfs_fsck /dev/fake0",
+		"jfs_tune -U random /dev/fake0",
+		"blkid -s UUID -o value /dev/fake0",
+		"mount -t jfs /dev/fake0 /mnt/fake0",
+	}
+	if !reflect.DeepEqual(f.cmds, want) || changed != fakeDev {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+	if !UUIDChangeable(jfs) || !supportedFS(jfs) {
+		t.Errorf("jfs not supported")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import "sync"
+
+// FilesystemHandler adds a file system to Start without changing this
+// module, see RegisterFilesystem. ext, xfs, ntfs and btrfs are handlers too
+type FilesystemHandler interface {
+	// Detect tells the file system from the output of `file -sL dev`, in
+	// lower case
+	Detect(dev, fileOut string) bool
+	// ChangeUUID gives the device of m, m.Result().Dev, a new uuid. The
+	// uuid is read back with blkid afterwards
+	ChangeUUID(m *DevMounter) error
+	// MountHelper is what mounts the file system, CMount for mount -t <name>
+	MountHelper() Caller_
+	// FsckTool checks the file system without repairing it, run as
+	// `<tool> <dev>`. Empty when there is none
+	FsckTool() Caller_
+}
+
+var (
+	fsHandlersMu   sync.RWMutex
+	fsHandlers     = map[FileSystemType]FilesystemHandler{}
+	fsHandlerOrder []FileSystemType
+)
+
+// RegisterFilesystem adds the handler of the file system name, or replaces
+// the one there is. Detection asks the handlers in the order registered,
+// the built-in ones first
+func RegisterFilesystem(name FileSystemType, h FilesystemHandler) {
+	fsHandlersMu.Lock()
+	defer fsHandlersMu.Unlock()
+	if _, ok := fsHandlers[name]; !ok {
+		fsHandlerOrder = append(fsHandlerOrder, name)
+	}
+	fsHandlers[name] = h
+}
+
+func lookupFS(fs FileSystemType) (h FilesystemHandler, ok bool) {
+	fsHandlersMu.RLock()
+	defer fsHandlersMu.RUnlock()
+	h, ok = fsHandlers[fs]
+	return h, ok
+}
+
+// pluginFS tells a file system registered from outside of this module
+func pluginFS(fs FileSystemType) bool {
+	h, ok := lookupFS(fs)
+	if !ok {
+		return false
+	}
+	_, builtin := h.(builtinFS)
+	return !builtin
+}
+
+// pluginFSTypes are the file systems registered from outside of this module
+func pluginFSTypes() (fss []FileSystemType) {
+	fsHandlersMu.RLock()
+	order := append([]FileSystemType(nil), fsHandlerOrder...)
+	fsHandlersMu.RUnlock()
+	for _, fs := range order {
+		if pluginFS(fs) {
+			fss = append(fss, fs)
+		}
+	}
+	return fss
+}
+
+// detectFS asks the handlers which file system the output of `file` shows
+func detectFS(dev, fileOut string) FileSystemType {
+	fsHandlersMu.RLock()
+	defer fsHandlersMu.RUnlock()
+	for _, fs := range fsHandlerOrder {
+		if fsHandlers[fs].Detect(dev, fileOut) {
+			return fs
+		}
+	}
+	return ""
+}
+
+// builtinFS is the handler of a file system this module knows by itself
+type builtinFS struct {
+	fs     FileSystemType
+	change func(m *DevMounter) error
+}
+
+func (b builtinFS) Detect(dev, fileOut string) bool { return fileFSType(dev, fileOut) == b.fs }
+
+func (b builtinFS) ChangeUUID(m *DevMounter) error { return b.change(m) }
+
+func (b builtinFS) MountHelper() Caller_ { return b.fs.MountHelper() }
+
+func (b builtinFS) FsckTool() Caller_ { return b.fs.FsckTool() }
+
+func init() {
+	for _, fs := range []FileSystemType{FsExt2, FsExt3, FsExt4} {
+		RegisterFilesystem(fs, builtinFS{fs, (*DevMounter).changeEXT})
+	}
+	RegisterFilesystem(FsXFS_, builtinFS{FsXFS_, (*DevMounter).changeXFS})
+	RegisterFilesystem(FsNTFs, builtinFS{FsNTFs, (*DevMounter).changeNTFs})
+	RegisterFilesystem(FsBtrfs, builtinFS{FsBtrfs, (*DevMounter).changeBtrfs})
+}
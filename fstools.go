@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+// ChangeUUIDTool is what gives fs a new uuid, ErrUUIDChangeUnsupported for a
+// file system whose uuid is kept
+func (fs FileSystemType) ChangeUUIDTool() (Caller_, error) {
+	switch fs {
+	case FsExt2, FsExt3, FsExt4:
+		return CTune2FS, nil
+	case FsXFS_:
+		return CXFSAdmin, nil
+	case FsNTFs, FsNTFs3:
+		return CNTFsLabel, nil
+	case FsBtrfs:
+		return CBtrfsTune, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUUIDChangeUnsupported, fs)
+}
+
+// FsckTool checks fs, empty when there is none
+func (fs FileSystemType) FsckTool() Caller_ {
+	switch fs {
+	case FsExt2, FsExt3, FsExt4:
+		return CE2Fsck
+	case FsXFS_:
+		return CXFSRepair
+	case FsNTFs, FsNTFs3:
+		return CNTFsFix
+	case FsBtrfs:
+		return CBtrfs
+	}
+	return ""
+}
+
+// MountHelper is what mounts fs, mount itself unless ntfs goes through the
+// ntfs-3g helper or apfs through apfs-fuse, and swapon for swap. Empty for an
+// unknown file system
+func (fs FileSystemType) MountHelper() Caller_ {
+	switch fs {
+	case FsExt2, FsExt3, FsExt4, FsXFS_, FsBtrfs, FsNTFs3, FsZFS:
+		return CMount
+	case FsNTFs:
+		if h, ok := MountHelper("ntfs-3g", "ntfs"); ok {
+			return h
+		}
+		return CNTFs3g
+	case FsSwap:
+		return CSwapOn
+	case FsHFSPlus:
+		return CMount
+	case FsAPFS:
+		if h, ok := MountHelper("apfs"); ok {
+			return h
+		}
+		return CAPFSFuse
+	}
+	return ""
+}
@@ -3,7 +3,6 @@ module github.com/kisunSea/mount_with_new_uuid
 go 1.15
 
 require (
-	github.com/go-basic/uuid v1.0.0
 	github.com/go-cmd/cmd v1.3.1
 	github.com/kr/pretty v0.3.0
 )
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MountHelperDirs are searched for mount.<type> helpers, in the order used
+// by mount(8) followed by the usual sbin directories
+var MountHelperDirs = []string{"/sbin", "/sbin/fs.d", "/sbin/fs", "/usr/sbin", "/usr/local/sbin"}
+
+// MountHelper returns the first mount.<name> helper found, the way mount
+// dispatches `mount -t <name>`, e.g. mount.ntfs-3g, mount.exfat-fuse or mount.zfs
+func MountHelper(names ...string) (Caller_, bool) {
+	for _, name := range names {
+		for _, dir := range MountHelperDirs {
+			p := filepath.Join(dir, "mount."+name)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+				return Caller_(p), true
+			}
+		}
+	}
+	return "", false
+}
+
+func isMountHelper(c Caller_) bool {
+	return strings.HasPrefix(filepath.Base(string(c)), "mount.")
+}
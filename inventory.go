@@ -0,0 +1,93 @@
+package main
+
+import "fmt"
+
+// Inventory is what a whole disk image holds, found without mounting
+type Inventory struct {
+	Image string `json:"image"`
+	// of the disk, for a qcow2 or vmdk the virtual size
+	Size int64 `json:"size"`
+	// the blkid PTTYPE, e.g. dos or gpt, empty for a file system on the
+	// whole disk
+	PartitionTable string           `json:"partition_table,omitempty"`
+	Partitions     []InventoryEntry `json:"partitions"`
+	// what could not be found out
+	Errors []string `json:"errors,omitempty"`
+}
+
+// InventoryEntry is a partition of an Inventory, Number 0 for the whole disk
+type InventoryEntry struct {
+	Number int            `json:"number"`
+	Kind   DeviceKind     `json:"kind"`
+	FS     FileSystemType `json:"fs,omitempty"`
+	UUID   string         `json:"uuid,omitempty"`
+	Label  string         `json:"label,omitempty"`
+	Size   int64          `json:"size"`
+	FSSize int64          `json:"fs_size,omitempty"`
+	Errors []string       `json:"errors,omitempty"`
+}
+
+// TakeInventory attaches image read-only, tells what each of its partitions
+// holds, see DetectDevice, and detaches it again. Nothing is mounted and
+// nothing is written. The device paths are left out of the entries, they are
+// gone after the return
+func TakeInventory(image string) (inv *Inventory, err error) {
+	return cmdEnv{}.TakeInventory(image)
+}
+
+func (x cmdEnv) TakeInventory(image string) (inv *Inventory, err error) {
+	disk, detach, err := x.attachDisk(image, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err_ := detach(); err == nil {
+			err = err_
+		}
+	}()
+
+	inv = &Inventory{Image: image, Partitions: []InventoryEntry{}}
+	if inv.Size, err = x.DeviceSize(disk); err != nil {
+		inv.Errors = append(inv.Errors, fmt.Sprintf("size: %v", err))
+	}
+	inv.PartitionTable, _ = x.QueryDeviceTag(disk, "PTTYPE")
+	parts, err := x.Partitions(disk)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		inv.Partitions = append(inv.Partitions, x.inventoryEntry(0, disk))
+	}
+	for i, part := range parts {
+		inv.Partitions = append(inv.Partitions, x.inventoryEntry(i+1, part))
+	}
+	return inv, nil
+}
+
+func (x cmdEnv) inventoryEntry(n int, dev string) (e InventoryEntry) {
+	e.Number = n
+	fail := func(what string, err error) {
+		e.Errors = append(e.Errors, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	kind, fs, err := x.DetectDevice(dev)
+	if err != nil {
+		fail("kind", err)
+	}
+	e.Kind, e.FS = kind, fs
+	if e.Size, err = x.DeviceSize(dev); err != nil {
+		fail("size", err)
+	}
+	if kind == "" || kind == DeviceEmpty || kind == DevicePartitionTable {
+		return e
+	}
+	// a luks container and an lvm physical volume have a uuid too
+	e.UUID, _ = x.QueryDeviceUUID(dev)
+	e.Label, _ = x.QueryDeviceTag(dev, "LABEL")
+	if kind == DeviceFilesystem {
+		if e.FSSize, err = x.FSSize(fs, dev); err != nil && err != ErrUnsFs {
+			fail("file system size", err)
+		}
+	}
+	return e
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ReplayJournal mounts the device read-write and unmounts it right away, so
+// the kernel recovers the journal of an ext or the log of an xfs before
+// offline work such as tune2fs or xfs_repair. Nothing is left mounted, the
+// mount goes to a temporary directory. An xfs log that mounting cannot replay
+// gives ErrXFSDirtyLog
+func (m *DevMounter) ReplayJournal() (err error) {
+	if m.fs == "" {
+		if err = m.BindArgs(); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(string(m.fs), "ext") && m.fs != FsXFS_ {
+		return ErrUnsFs
+	}
+
+	dir, err := ioutil.TempDir("", "newid-replay-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	if _, err = m.replayJournal(dir); errors.Is(err, ErrMount) && m.fs == FsXFS_ && m.env().XFSLogDirty(m.args_.dev) {
+		return ErrXFSDirtyLog
+	}
+	return err
+}
+
+// replayJournal mounts dev at path_ to replay its journal and unmounts it
+// again, out is what mount printed. xfs is mounted nouuid as the uuid may be
+// in use by the original of a cloned disk
+func (m *DevMounter) replayJournal(path_ string) (out string, err error) {
+	opts := []string{"rw"}
+	if m.fs == FsXFS_ {
+		opts = append(opts, "nouuid")
+	}
+	if out, err = m.env().mountCmd(m.fs, m.args_.dev, path_, m.mountCtx(opts...), m.MountTimeout); err != nil {
+		return out, err
+	}
+	return out, m.env().UMount(path_)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeviceKind tells what a device holds, a file system to mount or one more
+// layer to descend first
+type DeviceKind string
+
+const (
+	DeviceFilesystem DeviceKind = "filesystem"
+	// partitions to mount one by one, see MountAllPartitions
+	DevicePartitionTable DeviceKind = "partition-table"
+	// a physical volume, activate its volume group, see MountVolumeGroup
+	DeviceLVMMember DeviceKind = "lvm-member"
+	// assemble the array, see DevMounter.MDMembers
+	DeviceRAIDMember DeviceKind = "raid-member"
+	// open it, see DevMounter.LUKSKeyFile
+	DeviceLUKS DeviceKind = "luks"
+	DeviceSwap DeviceKind = "swap"
+	// nothing file or blkid recognises, e.g. a wiped or unformatted device
+	DeviceEmpty DeviceKind = "empty"
+)
+
+const (
+	BlkIDLVMMember = "LVM2_member"
+	BlkIDLUKS      = "crypto_LUKS"
+)
+
+// DetectDevice tells what dev holds from `file -sL` and blkid, without
+// descending into it. fs is set for DeviceFilesystem and DeviceSwap
+func DetectDevice(dev string) (kind DeviceKind, fs FileSystemType, err error) {
+	return cmdEnv{}.DetectDevice(dev)
+}
+
+func (x cmdEnv) DetectDevice(dev string) (kind DeviceKind, fs FileSystemType, err error) {
+	r, out, err := x.ExecCmd(fmt.Sprintf("%s -sL %s", CFile, dev))
+	if r != 0 {
+		if err == nil {
+			err = ErrUnKFs
+		}
+		return "", "", err
+	}
+	t, _ := x.QueryDeviceTag(dev, "TYPE")
+	pt, _ := x.QueryDeviceTag(dev, "PTTYPE")
+	kind, fs = classifyDevice(dev, strings.ToLower(out), t, pt)
+	return kind, fs, nil
+}
+
+// classifyDevice is DetectDevice on the lower case output of file and the
+// blkid TYPE and PTTYPE of dev. A container goes before the file system
+// file may see through it, e.g. that of a raid1 member
+func classifyDevice(dev, fileOut, blkidType, ptType string) (kind DeviceKind, fs FileSystemType) {
+	switch {
+	case blkidType == BlkIDLUKS || strings.Contains(fileOut, "luks encrypted file"):
+		return DeviceLUKS, ""
+	case blkidType == BlkIDRAIDMember || strings.Contains(fileOut, "linux software raid"):
+		return DeviceRAIDMember, ""
+	case blkidType == BlkIDLVMMember || strings.Contains(fileOut, "lvm2 pv"):
+		return DeviceLVMMember, ""
+	case blkidType == string(FsSwap) || strings.Contains(fileOut, "swap file"):
+		return DeviceSwap, FsSwap
+	}
+
+	if fs = detectFS(dev, fileOut); fs != "" {
+		return DeviceFilesystem, fs
+	}
+	if fs = appleFileType(dev, fileOut); fs != "" {
+		return DeviceFilesystem, fs
+	}
+	switch blkidType {
+	case BlkIDZFSMember:
+		return DeviceFilesystem, FsZFS
+	case string(FsHFSPlus), string(FsAPFS):
+		return DeviceFilesystem, FileSystemType(blkidType)
+	}
+	// dos/mbr boot sector; partition 1 : id=0x83, ...
+	if ptType != "" || strings.Contains(fileOut, "; partition 1") {
+		return DevicePartitionTable, ""
+	}
+	return DeviceEmpty, ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const CLosetup Caller_ = "losetup"
+
+var ErrLoopAttach = errors.New("failed to attach the image to a loop device")
+
+// LoopAttach attaches image to a free loop device and scans its partition
+// table. A sectorSize of 0 keeps the default of 512 bytes. The image is used
+// in place, a sparse one stays sparse
+func LoopAttach(image string, sectorSize int, readOnly bool) (loop string, err error) {
+	return cmdEnv{}.LoopAttach(image, sectorSize, readOnly)
+}
+
+func (x cmdEnv) LoopAttach(image string, sectorSize int, readOnly bool) (loop string, err error) {
+	args := "-f --show -P"
+	if sectorSize > 0 {
+		args += fmt.Sprintf(" -b %d", sectorSize)
+	}
+	if readOnly {
+		args += " -r"
+	}
+	// losetup -f finds and takes the free device in two steps
+	attachMu.Lock()
+	defer attachMu.Unlock()
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s %s %s", CLosetup, args, image))
+	if r != 0 || strings.TrimSpace(out) == "" {
+		return "", ErrLoopAttach
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func LoopDetach(loop string) (err error) {
+	return cmdEnv{}.LoopDetach(loop)
+}
+
+func (x cmdEnv) LoopDetach(loop string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -d %s", CLosetup, loop)); r != 0 {
+		return fmt.Errorf("failed to detach %s", loop)
+	}
+	return nil
+}
+
+// attachLoop attaches an image file to a loop device with SectorSize, which
+// replaces it as the device to mount. mount would set up a loop device by
+// itself, but always with 512 byte sectors and never read-only
+func (m *DevMounter) attachLoop() (err error) {
+	loop, err := m.env().LoopAttach(m.args_.dev, m.SectorSize, m.LoopReadOnly)
+	if err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().LoopDetach(loop) })
+
+	m.image_ = m.args_.dev
+	m.args_.dev = loop
+	m.roLoop_ = m.LoopReadOnly
+	return nil
+}
+
+// needsLoop reports whether dev is an image file to attach with SectorSize
+// or LoopReadOnly
+func (m *DevMounter) needsLoop() bool {
+	if (m.SectorSize <= 0 && !m.LoopReadOnly) || m.image_ != "" {
+		return false
+	}
+	fi, err := os.Stat(m.args_.dev)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// noRecoveryOpts mount fs read-only without replaying its journal, which
+// would write to the device
+func noRecoveryOpts(fs FileSystemType) []string {
+	switch fs {
+	case FsExt3, FsExt4:
+		return []string{"noload"}
+	case FsXFS_:
+		return []string{"norecovery", "nouuid"}
+	}
+	return nil
+}
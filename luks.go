@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const CCryptSetup Caller_ = "cryptsetup"
+
+var (
+	ErrLUKSKey  = errors.New("a luks device needs a key file")
+	ErrLUKSOpen = errors.New("failed to open the luks device")
+)
+
+var luksVersion = regexp.MustCompile(`(?m)^Version:\s+(\d+)`)
+
+// LUKSVersion reads 1 or 2 from the luks header of dev, or from header when
+// the header is detached
+func LUKSVersion(dev, header string) (version int, err error) {
+	return cmdEnv{}.LUKSVersion(dev, header)
+}
+
+func (x cmdEnv) LUKSVersion(dev, header string) (version int, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s luksDump %s", CCryptSetup, luksHeaderArg(dev, header)))
+	if r != 0 {
+		return 0, fmt.Errorf("%w: no luks header on %s", ErrLUKSOpen, dev)
+	}
+	v := luksVersion.FindStringSubmatch(out)
+	if v == nil || (v[1] != "1" && v[1] != "2") {
+		return 0, fmt.Errorf("%w: unknown luks version of %s", ErrLUKSOpen, dev)
+	}
+	return int(v[1][0] - '0'), nil
+}
+
+// luksHeaderArg is dev, preceded by --header for a detached header
+func luksHeaderArg(dev, header string) string {
+	if header != "" {
+		return "--header " + header + " " + dev
+	}
+	return dev
+}
+
+// LUKSOpen maps dev to /dev/mapper/name, read-only when ro is set
+func LUKSOpen(dev, name, header, keyFile string, version int, ro bool) (err error) {
+	return cmdEnv{}.LUKSOpen(dev, name, header, keyFile, version, ro)
+}
+
+func (x cmdEnv) LUKSOpen(dev, name, header, keyFile string, version int, ro bool) (err error) {
+	args := fmt.Sprintf("open --type luks%d --key-file %s", version, keyFile)
+	if ro {
+		args += " --readonly"
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s %s %s %s", CCryptSetup, args, luksHeaderArg(dev, header), name)); r != 0 {
+		return ErrLUKSOpen
+	}
+	return nil
+}
+
+func LUKSClose(name string) (err error) {
+	return cmdEnv{}.LUKSClose(name)
+}
+
+func (x cmdEnv) LUKSClose(name string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s close %s", CCryptSetup, name)); r != 0 {
+		return fmt.Errorf("failed to close the luks device %s", name)
+	}
+	return nil
+}
+
+// isLUKS tells a luks device from the output of `file -sL`, one with a
+// detached header carries no signature at all
+func (m *DevMounter) isLUKS(fileOut string) bool {
+	return m.LUKSHeader != "" || strings.Contains(fileOut, "luks encrypted file")
+}
+
+// openLUKS unlocks the device, whose mapping replaces it as the device to
+// mount. Close closes the mapping again
+func (m *DevMounter) openLUKS() (err error) {
+	if m.LUKSKeyFile == "" {
+		return ErrLUKSKey
+	}
+	version, err := m.env().LUKSVersion(m.args_.dev, m.LUKSHeader)
+	if err != nil {
+		return err
+	}
+
+	name := m.LUKSName
+	if name == "" {
+		name = "newid-" + filepath.Base(m.args_.dev)
+	}
+	if err = m.env().LUKSOpen(m.args_.dev, name, m.LUKSHeader, m.LUKSKeyFile, version, m.ReadOnly); err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().LUKSClose(name) })
+
+	m.luks_ = m.args_.dev
+	m.args_.dev = filepath.Join(DevMapperDir, name)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CLVs      Caller_ = "lvs"
+	CLVChange Caller_ = "lvchange"
+)
+
+var (
+	ErrLVList       = errors.New("failed to list the logical volumes")
+	ErrLVActivate   = errors.New("failed to activate the logical volume")
+	ErrLVDeactivate = errors.New("failed to deactivate the logical volume")
+)
+
+// LogicalVolumes lists the mountable volumes of vg, thin pools are left out
+func LogicalVolumes(vg string) (lvs []string, err error) {
+	return cmdEnv{}.LogicalVolumes(vg)
+}
+
+func (x cmdEnv) LogicalVolumes(vg string) (lvs []string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s --noheadings -o lv_name,lv_attr %s", CLVs, vg))
+	if r != 0 {
+		return nil, ErrLVList
+	}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) > 1 && strings.HasPrefix(f[1], "t") {
+			continue
+		}
+		lvs = append(lvs, f[0])
+	}
+	return lvs, nil
+}
+
+func ActivateLV(vg, lv string) (err error) {
+	return cmdEnv{}.ActivateLV(vg, lv)
+}
+
+func (x cmdEnv) ActivateLV(vg, lv string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -ay %s/%s", CLVChange, vg, lv)); r != 0 {
+		return ErrLVActivate
+	}
+	return nil
+}
+
+func DeactivateLV(vg, lv string) (err error) {
+	return cmdEnv{}.DeactivateLV(vg, lv)
+}
+
+func (x cmdEnv) DeactivateLV(vg, lv string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -an %s/%s", CLVChange, vg, lv)); r != 0 {
+		return fmt.Errorf("%w: %s/%s", ErrLVDeactivate, vg, lv)
+	}
+	return nil
+}
+
+// MountVolumeGroup activates every logical volume of vg and mounts it with a
+// new uuid at baseMountDir/<lv>, creating the directory when missing. opts
+// apply to each volume. The volumes stay mounted and active, call closeAll to
+// unmount and deactivate them again. When one volume fails, those mounted
+// before it are unmounted and deactivated again and the error names the
+// failed volume. With WithNoFail the rest are still mounted and the failures
+// come back as a *BatchError along with the results, see StrictNoFail
+func MountVolumeGroup(vg, baseMountDir string, opts ...Option) (results []*MountResult, closeAll func() error, err error) {
+	conf := batchConf(opts)
+	lvs, err := conf.env().LogicalVolumes(vg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var failed BatchError
+	var done []*DevMounter
+	for _, lv := range lvs {
+		lv := lv
+		dev, path_ := filepath.Join("/dev", vg, lv), filepath.Join(baseMountDir, lv)
+		m := NewMounter(dev, path_, append([]Option{WithAutoMkdir()}, opts...)...)
+		if err = m.env().ActivateLV(vg, lv); err == nil {
+			// released last by Close, once the volume is unmounted
+			m.pushCleanup(func() error { return m.env().DeactivateLV(vg, lv) })
+			if err = m.Start(); err != nil {
+				m.Close()
+			} else {
+				done = append(done, m)
+				r := m.Result()
+				results = append(results, &r)
+				continue
+			}
+		}
+		r := &MountResult{Dev: dev, Path: path_}
+		if !failed.nofail(&conf, r, err) {
+			err = fmt.Errorf("%s/%s: %w", vg, lv, err)
+			break
+		}
+		results = append(results, r)
+		err = nil
+	}
+	if err == nil && conf.StrictNoFail {
+		err = failed.result()
+	}
+	closeAll = func() error {
+		var errs CleanupError
+		for i := len(done) - 1; i >= 0; i-- {
+			if err_ := done[i].Close(); err_ != nil {
+				errs = append(errs, err_)
+			}
+		}
+		if len(errs) != 0 {
+			return errs
+		}
+		return nil
+	}
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return results, closeAll, failed.result()
+}
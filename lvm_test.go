@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMountVolumeGroup(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"lvs":   {0, "  root -wi-a-----\n  pool twi-aotz--\n  home -wi-a-----\n"},
+		"blkid": {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+	base := t.TempDir()
+	skipCheck := func(m *DevMounter) { m.SkipCheck = true }
+
+	rs, closeAll, err := MountVolumeGroup("vg", base, WithFS(FsExt4), skipCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 || rs[0].Dev != "/dev/vg/root" || rs[1].Path != filepath.Join(base, "home") {
+		t.Errorf("got %+v", rs)
+	}
+	// nothing is mounted in the fake mountinfo, only the volumes are left
+	f.cmds = nil
+	if err = closeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lvchange -an vg/home", "lvchange -an vg/root"}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+
+	// root stays mounted until the failure of home unwinds it
+	line := "101 1 253:0 / " + filepath.Join(base, "root") + " rw shared:1 - ext4 /dev/mapper/vg-root rw\n"
+	if err = ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.cmds = nil
+	f.replies["mount -o noatime,X-mount.mkdir /dev/vg/home "+filepath.Join(base, "home")] = fakeReply{r: 32}
+	_, _, err = MountVolumeGroup("vg", base, WithFS(FsExt4), skipCheck)
+	if !errors.Is(err, ErrMount) {
+		t.Fatalf("got %v, want %v", err, ErrMount)
+	}
+	want := []string{"lvchange -an vg/home", "umount " + filepath.Join(base, "root"), "lvchange -an vg/root"}
+	if got := f.cmds[len(f.cmds)-3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMountVolumeGroupNoFail(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"lvs":   {0, "  root -wi-a-----\n  home -wi-a-----\n"},
+		"blkid": {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+	base := t.TempDir()
+	skipCheck := func(m *DevMounter) { m.SkipCheck = true }
+	f.replies["mount -o noatime,X-mount.mkdir /dev/vg/root "+filepath.Join(base, "root")] = fakeReply{r: 32}
+
+	rs, _, err := MountVolumeGroup("vg", base, WithFS(FsExt4), WithNoFail(false), skipCheck)
+	var be *BatchError
+	if !errors.As(err, &be) || len(be.Errs) != 1 || !errors.Is(be.Errs[0], ErrMount) {
+		t.Fatalf("got %v, want a batch error", err)
+	}
+	if len(rs) != 2 || rs[0].Error == "" || rs[1].Error != "" || rs[1].UUID == "" {
+		t.Errorf("got %+v %+v", rs[0], rs[1])
+	}
+
+	// home is mounted, then unmounted again once the batch fails
+	line := "101 1 253:1 / " + filepath.Join(base, "home") + " rw shared:1 - ext4 /dev/mapper/vg-home rw\n"
+	if err = ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.cmds = nil
+	rs, closeAll, err := MountVolumeGroup("vg", base, WithFS(FsExt4), WithNoFail(true), skipCheck)
+	if !errors.As(err, &be) || rs != nil || closeAll != nil {
+		t.Fatalf("got %v %v, want a batch error", rs, err)
+	}
+	want := []string{"umount " + filepath.Join(base, "home"), "lvchange -an vg/home"}
+	if got := f.cmds[len(f.cmds)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMountBatch(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"blkid": {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+	base := t.TempDir()
+	var ms []*DevMounter
+	for _, lv := range []string{"a", "b", "c", "d"} {
+		ms = append(ms, NewMounter("/dev/vg/"+lv, filepath.Join(base, lv),
+			WithFS(FsExt4), WithNoFail(false), func(m *DevMounter) { m.SkipCheck = true }))
+	}
+	f.replies["mount -o noatime /dev/vg/c "+filepath.Join(base, "c")] = fakeReply{r: 32}
+
+	rs, err := MountBatch(ms, 3)
+	var be *BatchError
+	if !errors.As(err, &be) || len(be.Errs) != 1 {
+		t.Fatalf("got %v, want a batch error", err)
+	}
+	for i, r := range rs {
+		if failed := r.Error != ""; failed != (i == 2) || r.Dev != ms[i].args_.dev {
+			t.Errorf("%d: got %+v", i, r)
+		}
+	}
+}
+
+func TestMountBatchFsckParallel(t *testing.T) {
+	var running, most int32
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		switch {
+		case strings.HasPrefix(cmdStr, "e2fsck"):
+			n := atomic.AddInt32(&running, 1)
+			for o := atomic.LoadInt32(&most); n > o && !atomic.CompareAndSwapInt32(&most, o, n); o = atomic.LoadInt32(&most) {
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		case strings.HasPrefix(cmdStr, "blkid"):
+			return 0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", nil
+		}
+		return 0, "", nil
+	}))
+	base := t.TempDir()
+	var ms []*DevMounter
+	for _, lv := range []string{"a", "b", "c", "d", "e", "f"} {
+		ms = append(ms, NewMounter("/dev/vg/"+lv, filepath.Join(base, lv), WithFS(FsExt4), func(m *DevMounter) {
+			m.SkipCheck = true
+			m.Fsck = true
+			m.FsckParallel = 2
+		}))
+	}
+
+	if _, err := MountBatch(ms, len(ms)); err != nil {
+		t.Fatal(err)
+	}
+	if most != 2 {
+		t.Errorf("%d checks at once, want 2", most)
+	}
+}
+
+func TestMountArgsClone(t *testing.T) {
+	conf := NewMounter("", "", WithMountOptions("discard"), func(m *DevMounter) {
+		m.BindPaths = []string{"/srv/a"}
+		m.MountDefaults = map[FileSystemType]string{FsExt4: "noatime"}
+	})
+
+	// the members of one batch, the first changing its own options
+	a, b := conf.clone(), conf.clone()
+	a.Reset("/dev/vg/a", "/mnt/a", "")
+	b.Reset("/dev/vg/b", "/mnt/b", "")
+	a.MountOptions[0] = "ro"
+	a.BindPaths[0] = "/srv/b"
+	a.MountDefaults[FsExt4] = "relatime"
+	for _, m := range []*DevMounter{conf, b} {
+		if m.MountOptions[0] != "discard" || m.BindPaths[0] != "/srv/a" || m.MountDefaults[FsExt4] != "noatime" {
+			t.Errorf("%s: got %q %q %q", m.args_.dev, m.MountOptions, m.BindPaths, m.MountDefaults)
+		}
+	}
+}
+
+// run with -race. The runner shares nothing between the mounters, a lock
+// of its own would hide the race on BlkID
+func TestMountBatchDetectBlkID(t *testing.T) {
+	var detected int32
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		switch {
+		case cmdStr == "blkid -V":
+			atomic.AddInt32(&detected, 1)
+			return 0, "blkid from util-linux 2.39.3  (libblkid 2.39.3, 04-Dec-2023)", nil
+		case strings.HasPrefix(cmdStr, "blkid"):
+			return 0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", nil
+		}
+		return 0, "", nil
+	}))
+	BlkID = ""
+	base := t.TempDir()
+	var ms []*DevMounter
+	for _, lv := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		ms = append(ms, NewMounter("/dev/vg/"+lv, filepath.Join(base, lv),
+			WithFS(FsExt4), func(m *DevMounter) { m.SkipCheck = true }))
+	}
+
+	if _, err := MountBatch(ms, len(ms)); err != nil {
+		t.Fatal(err)
+	}
+	if BlkID != BlkIDUtilLinux || detected != 1 {
+		t.Errorf("got %q, detected %d times", BlkID, detected)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const CMdadm Caller_ = "mdadm"
+
+// BlkIDRAIDMember is the blkid TYPE of an md raid member
+const BlkIDRAIDMember = "linux_raid_member"
+
+// MDDir holds the named md arrays, e.g. /dev/md/newid-sdb1
+var MDDir = "/dev/md"
+
+var ErrMDAssemble = errors.New("failed to assemble the md raid array")
+
+// MDAssemble assembles the array of members as md, started even when
+// degraded. The members are named instead of --scan, which would assemble
+// every array of the host
+func MDAssemble(md string, members []string, readOnly bool) (err error) {
+	return cmdEnv{}.MDAssemble(md, members, readOnly)
+}
+
+func (x cmdEnv) MDAssemble(md string, members []string, readOnly bool) (err error) {
+	args := "--assemble --run"
+	if readOnly {
+		args += " --readonly"
+	}
+	if r, out, _ := x.ExecCmd(fmt.Sprintf("%s %s %s %s",
+		CMdadm, args, md, strings.Join(members, " "))); r != 0 {
+		return fmt.Errorf("%w: %s", ErrMDAssemble, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func MDStop(md string) (err error) {
+	return cmdEnv{}.MDStop(md)
+}
+
+func (x cmdEnv) MDStop(md string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s --stop %s", CMdadm, md)); r != 0 {
+		return fmt.Errorf("failed to stop %s", md)
+	}
+	return nil
+}
+
+// isMDMember tells an md raid member from the output of `file -sL`. With the
+// superblock at the end, metadata 0.90 and 1.0, file sees the file system
+// of a raid1 member instead, name its other members in MDMembers then
+func (m *DevMounter) isMDMember(fileOut string) bool {
+	return len(m.MDMembers) != 0 || strings.Contains(fileOut, "linux software raid")
+}
+
+// assembleMD assembles the array of the device and MDMembers, which replaces
+// the device as the one to mount. Close stops the array again
+func (m *DevMounter) assembleMD() (err error) {
+	md := filepath.Join(MDDir, "newid-"+filepath.Base(m.args_.dev))
+	members := append([]string{m.args_.dev}, m.MDMembers...)
+	if err = m.env().MDAssemble(md, members, m.ReadOnly); err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().MDStop(md) })
+
+	m.md_ = m.args_.dev
+	m.args_.dev = md
+	return nil
+}
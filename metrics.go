@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Metrics receives the outcome of every Start, fs is empty when the file
+// system type could not be identified
+type Metrics interface {
+	MountAttempted(fs FileSystemType)
+	MountSucceeded(fs FileSystemType)
+	MountFailed(fs FileSystemType, step OpStep)
+	UUIDChanged(fs FileSystemType)
+}
+
+func (m *DevMounter) report(step OpStep, err error) {
+	m.Metrics.MountAttempted(m.fs)
+	if err != nil {
+		m.Metrics.MountFailed(m.fs, step)
+	} else {
+		m.Metrics.MountSucceeded(m.fs)
+	}
+}
+
+func (m *DevMounter) changeDevUUID() (err error) {
+	if m.keepUniqueUUID() {
+		return nil
+	}
+	if err = m.ChangeDevUUID(); err == nil && m.Metrics != nil && m.fs != FsZFS && !m.uuidKept() {
+		m.Metrics.UUIDChanged(m.fs)
+	}
+	return err
+}
+
+// Counters is a Metrics kept in memory, safe for concurrent use and shareable
+// between mounters. WritePrometheus exports it in the prometheus text format
+type Counters struct {
+	mu sync.Mutex
+	c  map[counterKey]uint64
+}
+
+type counterKey struct {
+	name string
+	fs   FileSystemType
+	step OpStep
+}
+
+const (
+	MetricMountsAttempted = "newid_mount_attempted_total"
+	MetricMountsSucceeded = "newid_mount_succeeded_total"
+	MetricMountsFailed    = "newid_mount_failed_total"
+	MetricUUIDChanges     = "newid_mount_uuid_changes_total"
+)
+
+func (c *Counters) inc(k counterKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		c.c = make(map[counterKey]uint64)
+	}
+	c.c[k]++
+}
+
+func (c *Counters) MountAttempted(fs FileSystemType) {
+	c.inc(counterKey{name: MetricMountsAttempted, fs: fs})
+}
+
+func (c *Counters) MountSucceeded(fs FileSystemType) {
+	c.inc(counterKey{name: MetricMountsSucceeded, fs: fs})
+}
+
+func (c *Counters) MountFailed(fs FileSystemType, step OpStep) {
+	c.inc(counterKey{name: MetricMountsFailed, fs: fs, step: step})
+}
+
+func (c *Counters) UUIDChanged(fs FileSystemType) {
+	c.inc(counterKey{name: MetricUUIDChanges, fs: fs})
+}
+
+// Get returns one counter, step only applies to MetricMountsFailed
+func (c *Counters) Get(name string, fs FileSystemType, step OpStep) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c[counterKey{name: name, fs: fs, step: step}]
+}
+
+func (c *Counters) WritePrometheus(w io.Writer) (err error) {
+	c.mu.Lock()
+	keys := make([]counterKey, 0, len(c.c))
+	values := make(map[counterKey]uint64, len(c.c))
+	for k, v := range c.c {
+		keys = append(keys, k)
+		values[k] = v
+	}
+	c.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].fs != keys[j].fs {
+			return keys[i].fs < keys[j].fs
+		}
+		return keys[i].step < keys[j].step
+	})
+
+	last := ""
+	for _, k := range keys {
+		if k.name != last {
+			if _, err = fmt.Fprintf(w, "# TYPE %s counter\n", k.name); err != nil {
+				return err
+			}
+			last = k.name
+		}
+		labels := fmt.Sprintf("fs=%q", string(k.fs))
+		if k.name == MetricMountsFailed {
+			labels += fmt.Sprintf(",step=%q", string(k.step))
+		}
+		if _, err = fmt.Fprintf(w, "%s{%s} %d\n", k.name, labels, values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	c := new(Counters)
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Metrics = c
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.replies["mount -o noatime "+fakeDev+" "+fakePath] = fakeReply{r: 32}
+	m.Reset(fakeDev, fakePath, "")
+	if err := m.Start(); !errors.Is(err, ErrMountFailure) || !errors.Is(err, ErrMount) {
+		t.Fatalf("got %v", err)
+	}
+
+	for _, v := range []struct {
+		name string
+		step OpStep
+		want uint64
+	}{
+		{MetricMountsAttempted, "", 2},
+		{MetricMountsSucceeded, "", 1},
+		{MetricMountsFailed, StepMount, 1},
+		{MetricUUIDChanges, "", 2},
+	} {
+		if got := c.Get(v.name, FsExt4, v.step); got != v.want {
+			t.Errorf("%s: got %d, want %d", v.name, got, v.want)
+		}
+	}
+
+	// mounted with the uuid kept
+	f.replies["file -sL "+fakeDev] = fakeReply{0, fakeDev + ": Macintosh HFS Extended version 4 data"}
+	m.Reset(fakeDev, fakePath, "")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Get(MetricUUIDChanges, FsHFSPlus, ""); got != 0 {
+		t.Errorf("hfsplus: got %d uuid changes, want 0", got)
+	}
+
+	var b strings.Builder
+	if err := c.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `newid_mount_failed_total{fs="ext4",step="mount"} 1`) {
+		t.Errorf("unexpected export:\n%s", b.String())
+	}
+}
@@ -17,15 +17,20 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/go-basic/uuid"
 	"github.com/go-cmd/cmd"
 	"github.com/kr/pretty"
+	"os"
+	"os/exec"
 	"regexp"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 var (
@@ -36,34 +41,76 @@ var (
 	ErrQueryUUID = errors.New("failed to query the device uuid. procedure")
 	ErrUMount    = errors.New("device uninstallation failed. procedure")
 	ErrMount     = errors.New("failed to mount the device. procedure")
+	ErrUUIDMode  = errors.New("invalid xfs uuid mode, expect generate, nil, restore or a uuid")
+	ErrResizeRO  = errors.New("cannot resize a file system mounted read-only")
+	ErrResize    = errors.New("failed to resize the file system")
+	ErrNotMount  = errors.New("nothing is mounted at the path")
+	ErrPropagate = errors.New("invalid mount propagation, expect shared, slave, private or unbindable")
+	ErrTimeout   = errors.New("timed out")
+	ErrExtraArgs = errors.New("extra arguments repeat the device, the uuid or -U")
 )
 
 type FileSystemType string
 
 const (
-	FsXFS_ FileSystemType = "xfs"
-	FsExt2 FileSystemType = "ext2"
-	FsExt3 FileSystemType = "ext3"
-	FsExt4 FileSystemType = "ext4"
-	FsNTFs FileSystemType = "ntfs"
+	FsXFS_  FileSystemType = "xfs"
+	FsExt2  FileSystemType = "ext2"
+	FsExt3  FileSystemType = "ext3"
+	FsExt4  FileSystemType = "ext4"
+	FsNTFs  FileSystemType = "ntfs"
+	FsBtrfs FileSystemType = "btrfs"
+
+	// the ntfs kernel driver of linux 5.15+, mounted by `mount -t ntfs3`
+	FsNTFs3 FileSystemType = "ntfs3"
 
 	// TODO more filesystem ...
 	//FsJFS  FileSystemType = "jfs"
 	//FsRFS  FileSystemType = "reiserfs"
 )
 
+// UUIDMode is the `-U` argument handed to xfs_admin,
+// one of the values below or a literal uuid
+type UUIDMode string
+
+const (
+	XFSUUIDLocal    UUIDMode = ""         // generated by this module
+	XFSUUIDGenerate UUIDMode = "generate" // generated by xfs_admin
+	XFSUUIDNil      UUIDMode = "nil"      // zero uuid, regenerate later
+	XFSUUIDRestore  UUIDMode = "restore"  // restore the uuid saved by a previous `nil`
+
+	NilUUID = "00000000-0000-0000-0000-000000000000"
+)
+
+var uuidPattern = regexp.MustCompile("^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$")
+
 type Caller_ string
 
 const (
-	CMount    Caller_ = "mount"
-	CUMount   Caller_ = "umount"
-	CNTFs3g   Caller_ = "ntfs-3g"
-	CTune2FS  Caller_ = "tune2fs"
-	CBlkID    Caller_ = "blkid"
-	CFile     Caller_ = "file"
-	CXFSAdmin Caller_ = "xfs_admin"
+	CMount     Caller_ = "mount"
+	CUMount    Caller_ = "umount"
+	CNTFs3g    Caller_ = "ntfs-3g"
+	CTune2FS   Caller_ = "tune2fs"
+	CBlkID     Caller_ = "blkid"
+	CFile      Caller_ = "file"
+	CXFSAdmin  Caller_ = "xfs_admin"
+	CNTFsLabel Caller_ = "ntfslabel"
+	CXFSRepair Caller_ = "xfs_repair"
+	CE2Fsck    Caller_ = "e2fsck"
+	CNTFsFix   Caller_ = "ntfsfix"
+	CBtrfsTune Caller_ = "btrfstune"
+	CBtrfs     Caller_ = "btrfs"
+	CDumpE2FS  Caller_ = "dumpe2fs"
+	CXFSInfo   Caller_ = "xfs_info"
+	CBlockDev  Caller_ = "blockdev"
+	CUdevadm   Caller_ = "udevadm"
+	CResize2FS Caller_ = "resize2fs"
+	CXFSGrowFS Caller_ = "xfs_growfs"
+	CXFSDB     Caller_ = "xfs_db"
 )
 
+// DevMounter mounts one device with a new uuid. It accumulates state while
+// running, so it is not safe for concurrent use, and must be Reset before
+// Start is called again, especially for another device
 type DevMounter struct {
 	args_ struct {
 		dev   string
@@ -73,6 +120,236 @@ type DevMounter struct {
 	caller_ Caller_
 	fs      FileSystemType
 	uuid_   string
+
+	// the file system type, detected when empty. CrossCheckFS has blkid
+	// confirm what file detected, see reconcileFS
+	FS           FileSystemType
+	CrossCheckFS bool
+	// warnings go to DefaultLogger when nil
+	Logger Logger
+
+	// allow mounting over /, /etc, /usr and the like, see UnsafeMountPaths
+	AllowUnsafePath bool
+	// mount over a directory with files in it, hidden until unmounted,
+	// with a warning instead of failing with ErrNonEmptyTarget
+	AllowNonEmptyTarget bool
+
+	// the mount path is created by `mount -o X-mount.mkdir` when missing,
+	// and removed again by Close
+	AutoMkdir bool
+	// without a mount path the device is mounted at AutoMountBase/<label>,
+	// or /<uuid> when it has no label
+	AutoMountBase string
+	autoPath_     bool
+	rmdir_        bool
+
+	// wait for udev to renew /dev/disk/by-uuid after the change
+	UdevSettle bool
+
+	// ext only, the external journal device of the file system
+	ExtJournalDevice string
+	// ext only, mount through a backup superblock when the primary one is
+	// damaged, trying the first MaxBackupSuperblocks backups or all when 0
+	TryBackupSuperblock  bool
+	MaxBackupSuperblocks int
+	extSB_               int64
+
+	XFSUUIDMode UUIDMode
+	// give the device the uuid of this one instead of a new uuid, e.g. of
+	// the disk it replaces. Both need the same file system type
+	CloneUUIDFrom string
+	clone_        string
+	// keep the uuid from before the change once mounted, in the
+	// OriginalUUIDXattr of the mount path or, when set, in OriginalUUIDFile
+	RecordOriginalUUID bool
+	OriginalUUIDFile   string
+	origUUID_          string
+	// makes the uuid given to xfs, and to ext instead of a random one
+	// by tune2fs, NewUUID when nil
+	UUIDGen func() string
+	// xfs_repair -L an xfs whose log cannot be replayed, losing what is in it
+	AllowXFSLogZeroing bool
+	// appended to the tune2fs/xfs_admin command line, e.g. -f
+	ExtraChangeArgs []string
+
+	// compare the size of an ext or xfs file system with its device,
+	// warn on a mismatch, or fail with StrictSize
+	CheckSize  bool
+	StrictSize bool
+
+	// check the file system read-only before touching it, bounded by
+	// FsckTimeout when set. In a MountBatch at most FsckParallel members
+	// check at once, like `fsck -A`, the smallest one set counts for the
+	// batch. Zero leaves it to the parallel of the batch
+	Fsck         bool
+	FsckTimeout  time.Duration
+	FsckParallel int
+	fsckSem_     chan struct{}
+
+	// zfs only, the dataset of the pool to mount, the root dataset when empty
+	ZFSDataset string
+	zpool_     string
+
+	ReadOnly bool
+	// write synchronously, and flush every cache once unmounted by Close,
+	// for a host that may lose power right after
+	Sync          bool
+	SyncOnUnmount bool
+	// activate swap with swapon instead of failing with ErrSwap
+	SwapOn bool
+	// keep a uuid no other device has instead of changing it, see
+	// UUIDConflicts. MountBatch decides for all of its devices up front
+	OnlyChangeIfConflict bool
+	uuidPlan_            uuidPlan
+	// fail with ErrUUIDChangeUnsupported instead of mounting a file system
+	// whose uuid is kept, see UUIDChangeable
+	RequireUUIDChange bool
+	// in a batch such as MountVolumeGroup, a failure of this device is kept in
+	// its result and the batch goes on, like nofail in fstab. StrictNoFail
+	// still fails the batch once every device was tried
+	NoFail       bool
+	StrictNoFail bool
+
+	// marks the mount as one of this owner, e.g. a job id, see TagOption
+	Tag string
+	// put before every command of this mounter, e.g. sudo -n, for a caller
+	// without root that escalates per command. What this module does
+	// itself, such as creating the mount path, is not affected
+	CommandPrefix []string
+
+	// mount the device read-only underneath a writable overlay whose upper
+	// and work directories are kept in this directory, see mountOverlay
+	OverlayScratch string
+	// extra options of the mount, merged with MountDefaults
+	MountOptions []string
+	// default options by file system type, DefaultMountOptions when nil,
+	// an empty map turns them off
+	MountDefaults map[FileSystemType]string
+
+	// btrfs only, mount this subvolume instead of the default one,
+	// by path or by id but not both
+	BtrfsSubvol   string
+	BtrfsSubvolID int
+	// btrfs only, mount with devices missing, always read-only and with
+	// the uuid kept
+	BtrfsDegraded bool
+
+	// shared, slave, private or unbindable, applied once mounted
+	Propagation string
+
+	// ntfs only, auto prefers the ntfs3 kernel driver when available
+	NTFSDriver NTFSDriver
+
+	// unmount whatever holds the device or the mount path before starting,
+	// retried UMountRetries times, then detached lazily if LazyUnmount is set
+	ForceUnmountExisting bool
+	UMountRetries        int
+	LazyUnmount          bool
+
+	// trust the mount command, Check is left to the caller
+	SkipCheck bool
+
+	// grow the file system to the size of the device once mounted
+	ResizeToFill bool
+
+	// optional counters of every Start, see Metrics
+	Metrics Metrics
+	// called when a step of Start begins and when it ends, see StepEvent
+	OnStep func(e StepEvent)
+	// the steps and commands of the Start StartWithEvents runs, next to
+	// OnStep and DebugLogger
+	onStep_ func(e StepEvent)
+	onCmd_  cmdWatcher
+	// bounds every mount command, the xfs log replay above all, when set
+	MountTimeout time.Duration
+
+	// qcow2 or vmdk images are connected to an nbd device, detected when
+	// ImageFormat is empty. NBDPartition selects a partition of the image
+	ImageFormat  ImageFormat
+	NBDPartition int
+	image_       string
+	// the logical sector size of image files, e.g. 4096 for images of 4Kn
+	// disks, they are attached to a loop device with it
+	SectorSize int
+	// attach image files to a read-only loop device, or connect a qcow2 or
+	// vmdk read-only, nothing can write to the image then. Its uuid is kept
+	// and the journal is not replayed
+	LoopReadOnly bool
+	roLoop_      bool
+	// mount read-only until StartVerified remounts it, nothing else is
+	// opened read-only for it. verifying_ runs verify_ right after the
+	// mount, before the steps writing to it
+	roMount_   bool
+	verifying_ bool
+	verifyFn_  func(mountPath string) error
+
+	// luks and luks2 devices are opened with LUKSKeyFile, and their header
+	// read from LUKSHeader when detached. The mapping is LUKSName,
+	// newid-<device name> when empty
+	LUKSKeyFile string
+	LUKSHeader  string
+	LUKSName    string
+	luks_       string
+
+	// the other members of an md raid array, the device is assembled with
+	// them as /dev/md/newid-<device name>. A raid1 member alone runs degraded
+	MDMembers []string
+	md_       string
+
+	// mount a dm-snapshot of the device instead, so that nothing, not even
+	// the uuid change or a journal replay, writes to the device. The writes
+	// go to SnapshotCOW, a device or file, a sparse temporary file when empty.
+	// zfs, hfsplus, apfs, swap and md members take no snapshot and fail
+	// with ErrSnapshotUnsupported
+	Snapshot    bool
+	SnapshotCOW string
+	snap_       string
+
+	// read the superblock regions before mounting, see warmCache
+	WarmCache bool
+
+	// bind mounted after the mount, at each of them, see bindPaths
+	BindPaths []string
+
+	// quota mount options, e.g. usrquota,grpquota. EnableQuota also runs
+	// quotacheck and quotaon on an ext after mounting it
+	Quota       string
+	EnableQuota bool
+
+	// mount an ext3 or ext4 with data=writeback,nobarrier for a faster
+	// restore, see fastRestoreOpts. FastRestoreNoJournal removes the journal
+	// as well, Close adds it back after unmounting. Both give up durability
+	// until the file system is unmounted
+	FastRestore          bool
+	FastRestoreNoJournal bool
+	noJournal_           bool
+
+	// export the mount over nfs to NFSExportClient, e.g. 10.0.0.0/24, with
+	// NFSExportOptions, until Close
+	NFSExportClient  string
+	NFSExportOptions string
+
+	// run on the mounted path, {} in it replaced by the path, and kept in
+	// the result. StrictVerify unmounts again and fails when it fails
+	PostMountCmd []string
+	StrictVerify bool
+	verify_      *VerifyResult
+
+	// for TreeChecksum, the paths left out and how many files are read at
+	// a time
+	ChecksumExclude []string
+	ChecksumWorkers int
+	checksum_       string
+
+	// optional operation log, lets Start resume after a crash, see OpState
+	StateFile string
+	state_    *OpState
+
+	devInfo_  DevInfo
+	warnings_ []string
+
+	// undone by Close in reverse order
+	cleanups_ []func() error
 }
 
 func NewMounterWithArgs(dev, path_ string, ctx interface{}) *DevMounter {
@@ -85,7 +362,163 @@ func NewMounterWithArgs(dev, path_ string, ctx interface{}) *DevMounter {
 	return d
 }
 
+// Reset rebinds the mounter to the given arguments and drops everything learned
+// by a previous Start. Options such as XFSUUIDMode are kept. What the Start
+// left mounted or attached is released first, see Close, and when that fails
+// the mounter stays as it was so that Reset can be retried
+func (m *DevMounter) Reset(dev, path_ string, ctx interface{}) (err error) {
+	if err = m.Close(); err != nil {
+		return err
+	}
+	m.args_.dev = dev
+	m.args_.path_ = path_
+	m.args_.ctx = ctx
+
+	m.caller_ = ""
+	m.fs = ""
+	m.uuid_ = ""
+	m.zpool_ = ""
+	m.image_ = ""
+	m.luks_ = ""
+	m.md_ = ""
+	m.snap_ = ""
+	m.noJournal_ = false
+	m.roLoop_ = false
+	m.roMount_ = false
+	m.verifying_ = false
+	m.verifyFn_ = nil
+	m.extSB_ = 0
+	m.clone_ = ""
+	m.origUUID_ = ""
+	m.rmdir_ = false
+	m.autoPath_ = false
+	m.verify_ = nil
+	m.checksum_ = ""
+	m.uuidPlan_ = planNone
+	m.devInfo_ = DevInfo{}
+	m.warnings_ = nil
+	m.state_ = nil
+	return nil
+}
+
+// Runner runs one command line, split on white space, and returns its exit
+// code and stdout, followed by stderr when the command failed
+type Runner interface {
+	Run(cmdStr string) (r int, out string, err error)
+}
+
+type RunnerFunc func(cmdStr string) (r int, out string, err error)
+
+func (f RunnerFunc) Run(cmdStr string) (r int, out string, err error) {
+	return f(cmdStr)
+}
+
+// TimeoutRunner is a Runner able to stop a command running longer than d
+type TimeoutRunner interface {
+	Runner
+	RunTimeout(cmdStr string, d time.Duration) (r int, out string, err error)
+}
+
+// ArgvRunner is a Runner taking an argv as well, for the rare argument with
+// white space in it, e.g. a command of xfs_db -c
+type ArgvRunner interface {
+	Runner
+	RunArgv(argv []string) (r int, out string, err error)
+}
+
+// DefaultRunner executes every command of this module, replace it to trace
+// or fake them
+var DefaultRunner Runner = execRunner{}
+
+// LookPath finds the tools, replace it to fake their presence
+var LookPath = exec.LookPath
+
+// DebugLogger, when set, is told every command with the binary it resolves
+// to, the exact argv, the exit code and how long it took
+var DebugLogger Logger
+
+// cmdEnv is how the commands of one mounter run, with its CommandPrefix put
+// before each. The zero cmdEnv runs those of the package functions
+type cmdEnv struct {
+	prefix []string
+	onCmd  cmdWatcher
+}
+
+// env is the cmdEnv of the commands of m
+func (m *DevMounter) env() cmdEnv {
+	return cmdEnv{prefix: m.CommandPrefix, onCmd: m.onCmd_}
+}
+
 func ExecCmd(cmdStr string) (r int, out string, err error) {
+	return cmdEnv{}.ExecCmd(cmdStr)
+}
+
+// ExecCmdTimeout stops the command after d, returning ErrTimeout, when
+// DefaultRunner is a TimeoutRunner. Zero d means no limit
+func ExecCmdTimeout(cmdStr string, d time.Duration) (r int, out string, err error) {
+	return cmdEnv{}.ExecCmdTimeout(cmdStr, d)
+}
+
+// ExecArgv runs argv unsplit when DefaultRunner is an ArgvRunner, other
+// runners get it joined into one command line
+func ExecArgv(argv ...string) (r int, out string, err error) {
+	return cmdEnv{}.ExecArgv(argv...)
+}
+
+func (x cmdEnv) ExecCmd(cmdStr string) (r int, out string, err error) {
+	return x.ExecCmdTimeout(cmdStr, 0)
+}
+
+func (x cmdEnv) ExecCmdTimeout(cmdStr string, d time.Duration) (r int, out string, err error) {
+	if len(x.prefix) != 0 {
+		cmdStr = strings.Join(x.prefix, " ") + " " + cmdStr
+	}
+	defer func(start time.Time) { x.cmdDone(cmdStr, r, err, time.Since(start)) }(time.Now())
+	if t, ok := DefaultRunner.(TimeoutRunner); ok && d > 0 {
+		return t.RunTimeout(cmdStr, d)
+	}
+	return DefaultRunner.Run(cmdStr)
+}
+
+func (x cmdEnv) ExecArgv(argv ...string) (r int, out string, err error) {
+	argv = append(append([]string(nil), x.prefix...), argv...)
+	cmdStr := strings.Join(argv, " ")
+	defer func(start time.Time) { x.cmdDone(cmdStr, r, err, time.Since(start)) }(time.Now())
+	if a, ok := DefaultRunner.(ArgvRunner); ok {
+		return a.RunArgv(argv)
+	}
+	return DefaultRunner.Run(cmdStr)
+}
+
+// debugCmd shows the argv as the split on white space made it, quoted, so a
+// stray `|` or an argument broken apart stands out
+func debugCmd(cmdStr string, r int, err error, d time.Duration) {
+	argv := strings.Fields(cmdStr)
+	bin := "<empty command>"
+	if len(argv) != 0 {
+		var err_ error
+		if bin, err_ = LookPath(argv[0]); err_ != nil {
+			bin = argv[0] + " (not found)"
+		}
+	}
+	DebugLogger.Logf("DEBUG: exec %s argv=%q exit=%d err=%v took %s", bin, argv, r, err, d)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(cmdStr string) (r int, out string, err error) {
+	return execCmd(cmdStr, 0)
+}
+
+func (execRunner) RunArgv(argv []string) (r int, out string, err error) {
+	return execArgv(argv, 0)
+}
+
+func (execRunner) RunTimeout(cmdStr string, d time.Duration) (r int, out string, err error) {
+	return execCmd(cmdStr, d)
+}
+
+func execCmd(cmdStr string, d time.Duration) (r int, out string, err error) {
 
 	//c := cmd.NewCmd("sh")
 	//in := bytes.NewBuffer(nil)
@@ -94,204 +527,889 @@ func ExecCmd(cmdStr string) (r int, out string, err error) {
 	//s := <-c.StartWithStdin(in)
 	//return s.Exit, strings.Join(s.Stdout, "\n"), s.Error
 
-	cs := strings.Fields(cmdStr)
+	return execArgv(strings.Fields(cmdStr), d)
+}
+
+func execArgv(cs []string, d time.Duration) (r int, out string, err error) {
 	c := cmd.NewCmd(cs[0], cs[1:]...)
-	s := <-c.Start()
-	return s.Exit, strings.Join(s.Stdout, "\n"), s.Error
+	c_ := c.Start()
+
+	var s cmd.Status
+	if d > 0 {
+		select {
+		case s = <-c_:
+		case <-time.After(d):
+			_ = c.Stop()
+			<-c_
+			return -1, "", ErrTimeout
+		}
+	} else {
+		s = <-c_
+	}
+
+	out = strings.Join(s.Stdout, "\n")
+	if s.Exit != 0 && len(s.Stderr) != 0 {
+		out = strings.TrimPrefix(out+"\n"+strings.Join(s.Stderr, "\n"), "\n")
+	}
+	return s.Exit, out, s.Error
 }
 
 func GetCallerByFS(fs FileSystemType) Caller_ {
-	switch fs {
-	case FsExt2:
-		fallthrough
-	case FsExt3:
-		fallthrough
-	case FsExt4:
-		fallthrough
-	case FsXFS_:
-		return CMount
-	case FsNTFs:
-		return CNTFs3g
-	default:
+	c := fs.MountHelper()
+	if h, ok := lookupFS(fs); ok {
+		c = h.MountHelper()
+	}
+	if c == "" {
 		panic(ErrUnsFs)
 	}
+	return c
 }
 
-func QueryDeviceUUID(dev string) (uuid string, err error) {
-	if r, out, _ := ExecCmd(
-		fmt.Sprintf("%s | grep %s", CBlkID, dev)); r != 0 {
-		return "", ErrDevUUID
-	} else {
-		out = strings.ToLower(out)
-		us := regexp.MustCompile("uuid=\"(?P<uuid>.*?)\"").FindStringSubmatch(out)
-		if len(us) >= 2 {
-			return us[1], nil
-		}
-	}
-	return "", ErrDevUUID
+func UMount(path_ string) (err error) {
+	return cmdEnv{}.UMount(path_)
 }
 
-func UMount(path_ string) (err error) {
-	if r, _, _ := ExecCmd(
+func (x cmdEnv) UMount(path_ string) (err error) {
+	if r, out, _ := x.ExecCmd(
 		fmt.Sprintf("%s %s", CUMount, path_)); r != 0 {
-		return ErrUMount
+		return mountExitError(ErrUMount, CUMount, r, out)
 	}
 	return nil
 }
 
 func Mount(fs FileSystemType, dev, path_, ctx_ string) (err error) {
+	return cmdEnv{}.Mount(fs, dev, path_, ctx_)
+}
 
-	__c := CMount
-	if fs == FsNTFs {
-		__c = CNTFs3g
+func (x cmdEnv) Mount(fs FileSystemType, dev, path_, ctx_ string) (err error) {
+	return x.MountWithTimeout(fs, dev, path_, ctx_, 0)
+}
+
+// MountWithTimeout is Mount giving up with ErrTimeout after d, unbounded when
+// d is 0. The kernel may still finish the mount after the command was killed
+func MountWithTimeout(fs FileSystemType, dev, path_, ctx_ string, d time.Duration) (err error) {
+	return cmdEnv{}.MountWithTimeout(fs, dev, path_, ctx_, d)
+}
+
+func (x cmdEnv) MountWithTimeout(fs FileSystemType, dev, path_, ctx_ string, d time.Duration) (err error) {
+	_, err = x.mountCmd(fs, dev, path_, ctx_, d)
+	return err
+}
+
+// mountCmd also returns what mount printed
+func (x cmdEnv) mountCmd(fs FileSystemType, dev, path_, ctx_ string, d time.Duration) (out string, err error) {
+	return x.mountCmdBy(GetCallerByFS(fs), fs, dev, path_, ctx_, d)
+}
+
+// mountCmdBy mounts with __c instead of the caller of fs, mount itself for the
+// old kernel ntfs driver
+func (x cmdEnv) mountCmdBy(__c Caller_, fs FileSystemType, dev, path_, ctx_ string, d time.Duration) (out string, err error) {
+	line := fmt.Sprintf("%s %s %s %s", __c, ctx_, dev, path_)
+	if fs == FsNTFs3 || fs == FsZFS || fs == FsHFSPlus || (__c == CMount && (fs == FsNTFs || pluginFS(fs))) {
+		line = fmt.Sprintf("%s -t %s %s %s %s", __c, fs, ctx_, dev, path_)
+	} else if isMountHelper(__c) {
+		// helpers take `spec dir [-o options]`
+		line = fmt.Sprintf("%s %s %s %s", __c, dev, path_, ctx_)
 	}
 
-	if r, _, _ := ExecCmd(
-		fmt.Sprintf("%s %s %s %s", __c, ctx_, dev, path_)); r != 0 {
-		return ErrMount
+	r, out, err_ := x.ExecCmdTimeout(line, d)
+	if err_ == ErrTimeout {
+		return out, ErrTimeout
+	} else if r != 0 {
+		return out, mountExitError(ErrMount, __c, r, out)
+	}
+	return out, nil
+}
+
+// UMountLazy detaches path_ now and cleans it up once it is no longer busy
+func UMountLazy(path_ string) (err error) {
+	return cmdEnv{}.UMountLazy(path_)
+}
+
+func (x cmdEnv) UMountLazy(path_ string) (err error) {
+	if r, out, _ := x.ExecCmd(
+		fmt.Sprintf("%s -l %s", CUMount, path_)); r != 0 {
+		return mountExitError(ErrUMount, CUMount, r, out)
 	}
 	return nil
 }
 
-func IsMount(path_ string) bool {
-	if r, out, _ := ExecCmd(string(CMount)); r != 0 {
-		panic(CMount)
-	} else {
-		if strings.Contains(out, fmt.Sprintf("%s ", path_)) {
-			return true
-		}
+func GenExtDevUUID(dev string, extra ...string) (err error) {
+	return cmdEnv{}.GenExtDevUUID(dev, extra...)
+}
+
+func (x cmdEnv) GenExtDevUUID(dev string, extra ...string) (err error) {
+	return x.SetExtDevUUID("random", dev, extra...)
+}
+
+// SetExtDevUUID gives dev the uuid uuid_, or one generated by tune2fs for
+// random and time
+func SetExtDevUUID(uuid_ string, dev string, extra ...string) (err error) {
+	return cmdEnv{}.SetExtDevUUID(uuid_, dev, extra...)
+}
+
+func (x cmdEnv) SetExtDevUUID(uuid_ string, dev string, extra ...string) (err error) {
+	if err = checkExtraArgs(extra, dev, uuid_); err != nil {
+		return err
 	}
-	return false
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -U %s %s %s", CTune2FS, uuid_, strings.Join(extra, " "), dev)); r != 0 {
+		return ErrGenUUID
+	}
+	return nil
 }
 
-func GenExtDevUUID(dev string) (err error) {
-	if r, _, _ := ExecCmd(
-		fmt.Sprintf("%s -U random %s", CTune2FS, dev)); r != 0 {
+func GenXFSDevUUID(uuid_ string, dev string, extra ...string) (err error) {
+	return cmdEnv{}.GenXFSDevUUID(uuid_, dev, extra...)
+}
+
+func (x cmdEnv) GenXFSDevUUID(uuid_ string, dev string, extra ...string) (err error) {
+	if err = checkExtraArgs(extra, dev, uuid_); err != nil {
+		return err
+	}
+	if _, err = LookPath(string(CXFSAdmin)); err != nil {
+		if _, err_ := LookPath(string(CXFSDB)); err_ == nil {
+			// extra is for xfs_admin, xfs_db knows none of it
+			if len(extra) != 0 {
+				return fmt.Errorf("%w: %q without xfs_admin", ErrExtraArgs, extra)
+			}
+			return x.XFSDBSetUUID(uuid_, dev)
+		}
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -U %s %s %s", CXFSAdmin, uuid_, strings.Join(extra, " "), dev)); r != 0 {
 		return ErrGenUUID
 	}
 	return nil
 }
 
-func GenXFSDevUUID(uuid_ string, dev string) (err error) {
-	if r, _, _ := ExecCmd(
-		fmt.Sprintf("%s -U %s %s", CXFSAdmin, uuid_, dev)); r != 0 {
+func GenNTFsDevSerial(dev string) (err error) {
+	return cmdEnv{}.GenNTFsDevSerial(dev)
+}
+
+func (x cmdEnv) GenNTFsDevSerial(dev string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s --new-serial %s", CNTFsLabel, dev)); r != 0 {
 		return ErrGenUUID
 	}
 	return nil
 }
 
+// checkExtraArgs rejects extra arguments clashing with the ones supplied by
+// this module, or which the command line splitting would break apart
+func checkExtraArgs(extra []string, dev, uuid_ string) error {
+	for _, a := range extra {
+		if a == dev || a == uuid_ || a == "-U" || a == "" || len(strings.Fields(a)) != 1 {
+			return ErrExtraArgs
+		}
+	}
+	return nil
+}
+
 func (m *DevMounter) Start() (err error) {
-	if err = m.BindArgs(); err != nil {
-		return err
+	step := StepBind
+	if m.Metrics != nil {
+		defer func() { m.report(step, err) }()
 	}
-	if err = m.ChangeDevUUID(); err != nil {
-		return err
+
+	for _, s := range []struct {
+		step OpStep
+		fn   func() error
+	}{
+		{StepBind, func() error {
+			if err := m.BindArgs(); err != nil {
+				return err
+			}
+			m.warnSystemImage()
+			return m.requireUUIDChange()
+		}},
+		{StepUnmountExisting, m.unmountExisting},
+		{StepLoadState, m.loadState},
+		{StepPreparePath, m.preparePath},
+		{StepCheckSize, m.checkSize},
+		{StepFsck, m.RunFsck},
+		{StepChangeUUID, func() error { return m.runStep(StepChangeUUID, m.changeDevUUID) }},
+		{StepMount, func() error { return m.runStep(StepMount, m.MountDevice) }},
+		{StepVerifyMount, m.verifyMount},
+		{StepBindPaths, m.bindPaths},
+		{StepRecordUUID, m.recordOriginalUUID},
+		{StepCheck, m.Check},
+		{StepQuota, m.enableQuota},
+		{StepResize, m.ResizeFS},
+		{StepVerify, m.runPostMountCmd},
+		{StepExport, m.exportNFS},
+		{StepClearState, m.clearState},
+	} {
+		if s.step == StepVerifyMount && !m.verifying_ {
+			continue
+		}
+		step = s.step
+		if err = m.timeStep(s.step, s.fn); err != nil {
+			return err
+		}
+		if m.fs == FsSwap {
+			step = StepSwapOn
+			return m.timeStep(StepSwapOn, m.swapOn)
+		}
 	}
-	if err = m.MountDevice(); err != nil {
+	return nil
+}
+
+// uuidKept tells a ChangeDevUUID which left the uuid as it was: of an image
+// attached read-only, of hfs+ or apfs, of a degraded btrfs, or on a mount
+// through a backup ext superblock
+func (m *DevMounter) uuidKept() bool {
+	return m.roLoop_ || appleFS(m.fs) || m.degradedBtrfs() || m.extSB_ != 0
+}
+
+// degradedBtrfs tells a btrfs mounted with devices missing, a new fsid on the
+// devices present would split them from the missing ones for good
+func (m *DevMounter) degradedBtrfs() bool {
+	return m.fs == FsBtrfs && m.BtrfsDegraded
+}
+
+func (m *DevMounter) ChangeDevUUID() (err error) {
+	if m.roLoop_ {
+		m.warn("%s is attached read-only, its uuid is kept", m.image_)
+		m.uuid_, _ = m.env().QueryDeviceUUID(m.args_.dev)
+		return nil
+	}
+	if appleFS(m.fs) {
+		m.warn("%s is %s, mounted read-only with its uuid kept", m.args_.dev, m.fs)
+		m.uuid_, _ = m.env().QueryDeviceUUID(m.args_.dev)
+		return nil
+	}
+	if m.degradedBtrfs() {
+		m.warn("%s is a degraded btrfs, its uuid is kept", m.args_.dev)
+		m.uuid_, _ = m.env().QueryDeviceUUID(m.args_.dev)
+		return nil
+	}
+	if m.RecordOriginalUUID {
+		m.origUUID_, _ = m.env().QueryDeviceUUID(m.args_.dev)
+	}
+	if err = m.changeByFS(); err != nil {
 		return err
 	}
-	if err = m.Check(); err != nil {
+	if err = m.checkClone(); err != nil {
 		return err
 	}
-	return nil
+	if m.fs == FsZFS {
+		return nil
+	}
+	return m.settleUdev()
 }
 
-func (m *DevMounter) ChangeDevUUID() (err error) {
-	if strings.HasPrefix(string(m.fs), "ext") {
-		return m.changeEXT()
-	} else if m.fs == FsNTFs {
-		return m.changeNTFs()
-	} else if m.fs == FsXFS_ {
-		return m.changeXFS()
+func (m *DevMounter) changeByFS() (err error) {
+	if err = m.readCloneUUID(); err != nil {
+		return err
+	}
+	if m.fs == FsZFS {
+		return m.bindZFS()
+	}
+	h, ok := lookupFS(m.fs)
+	if !ok {
+		return ErrUnsFs
+	}
+	if err = h.ChangeUUID(m); errors.Is(err, ErrGenUUID) {
+		return m.toolVersionError(err)
+	} else if err != nil {
+		return err
+	}
+	if m.uuid_ == "" {
+		m.uuid_, err = m.env().QueryDeviceUUID(m.args_.dev)
 	}
-	return ErrUnsFs
+	return err
 }
 
 func (m *DevMounter) changeEXT() (err error) {
-
-	if err = GenExtDevUUID(m.args_.dev); err != nil {
+	// the mount through a backup superblock needs the journal device too
+	if err = m.checkExtJournal(); err != nil {
 		return err
 	}
+	if m.TryBackupSuperblock {
+		if found, err := m.findBackupSuperblock(); err != nil || found {
+			return err
+		}
+	}
 
-	if m.uuid_, err = QueryDeviceUUID(m.args_.dev); err != nil {
-		return ErrQueryUUID
+	uuid_ := "random"
+	if m.clone_ != "" {
+		uuid_ = m.clone_
+	} else if m.UUIDGen != nil {
+		if uuid_, err = m.newUUID(); err != nil {
+			return err
+		}
 	}
-	return nil
+	// read from the superblock itself, blkid may answer from its cache
+	old, _ := SuperblockUUID(m.args_.dev)
+	if m.clone_ == old {
+		old = ""
+	}
+	if err = m.env().SetExtDevUUID(uuid_, m.args_.dev, m.ExtraChangeArgs...); err != nil {
+		return err
+	}
+
+	m.uuid_, err = m.env().verifyUUID(m.args_.dev, old)
+	return err
 }
 
 func (m *DevMounter) changeXFS() (err error) {
 
+	// what the temporary mount printed
+	var out string
 	__registerXFSDev := func(fs FileSystemType, dev_, path_ string) (err_ error) {
-		if err_ = Mount(m.fs, dev_, path_, "-o rw,nouuid"); err_ != nil {
+		// mounting replays the log, by far the slowest step on a large volume
+		return m.timeStep(StepXFSLogReplay, func() (err_ error) {
+			out, err_ = m.replayJournal(path_)
 			return err_
+		})
+	}
+
+	///////////////////////////////
+
+	uuid_ := string(m.XFSUUIDMode)
+	switch {
+	case m.clone_ != "":
+		uuid_ = m.clone_
+	case m.XFSUUIDMode == XFSUUIDLocal:
+		if uuid_, err = m.newUUID(); err != nil {
+			return err
 		}
-		if err_ = UMount(dev_); err_ != nil {
-			return err_
+	case m.XFSUUIDMode == XFSUUIDGenerate, m.XFSUUIDMode == XFSUUIDNil, m.XFSUUIDMode == XFSUUIDRestore:
+	default:
+		if !uuidPattern.MatchString(uuid_) {
+			return ErrUUIDMode
+		}
+		uuid_ = strings.ToLower(uuid_)
+	}
+
+	if err = checkExtraArgs(m.ExtraChangeArgs, m.args_.dev, uuid_); err != nil {
+		return err
+	}
+	if err = __registerXFSDev(m.fs, m.args_.dev, m.args_.path_); err != nil {
+		if err == ErrTimeout {
+			return err
+		}
+		if !m.env().XFSLogDirty(m.args_.dev) {
+			if errors.Is(err, ErrMount) {
+				return m.xfsMountError(out)
+			}
+			return err
+		}
+		if !m.AllowXFSLogZeroing {
+			return ErrXFSDirtyLog
+		}
+		m.warn("zeroing the unclean xfs log of %s, the metadata changes in it are lost", m.args_.dev)
+		if err = m.env().ZeroXFSLog(m.args_.dev); err != nil {
+			return err
 		}
+	}
+	// restore may give back the uuid the file system has
+	old, _ := SuperblockUUID(m.args_.dev)
+	if m.XFSUUIDMode == XFSUUIDRestore || uuid_ == old {
+		old = ""
+	}
+	if err = m.env().GenXFSDevUUID(uuid_, m.args_.dev, m.ExtraChangeArgs...); err != nil {
+		return err
+	}
+
+	// blkid reports nothing for a zero uuid
+	if m.XFSUUIDMode == XFSUUIDNil {
+		m.uuid_ = NilUUID
 		return nil
 	}
+	m.uuid_, err = m.env().verifyUUID(m.args_.dev, old)
+	return err
+}
 
-	///////////////////////////////
+// changeNTFs gives the volume a new serial number, which blkid reports as uuid
+func (m *DevMounter) changeNTFs() (err error) {
 
-	uuid_ := uuid.New()
+	if m.clone_ != "" {
+		err = m.env().SetNTFsDevSerial(m.clone_, m.args_.dev)
+	} else {
+		err = m.env().GenNTFsDevSerial(m.args_.dev)
+	}
+	if err != nil {
+		return err
+	}
 
-	if err = __registerXFSDev(m.fs, m.args_.dev, m.args_.path_); err != nil {
+	if m.uuid_, err = m.env().QueryDeviceUUID(m.args_.dev); err != nil {
+		return ErrQueryUUID
+	}
+	return nil
+}
+
+func (m *DevMounter) MountDevice() (err error) {
+	if m.Propagation != "" && !validPropagation(m.Propagation) {
+		return ErrPropagate
+	}
+
+	if err = m.dropJournal(); err != nil {
 		return err
 	}
-	if err := GenXFSDevUUID(uuid_, m.args_.dev); err != nil {
+	m.warmCache()
+	opts := append([]string(nil), m.MountOptions...)
+	opts = append(opts, m.fastRestoreOpts()...)
+	if m.roLoop_ {
+		opts = append(append(opts, "ro"), noRecoveryOpts(m.fs)...)
+	} else if m.ReadOnly || appleFS(m.fs) {
+		opts = append(opts, "ro")
+	} else {
+		// the remount to rw keeps sync
+		if m.roMount_ {
+			opts = append(opts, "ro")
+		}
+		if m.Sync {
+			opts = append(opts, "sync")
+		}
+	}
+	if m.fs == FsBtrfs {
+		if opts, err = m.btrfsOpts(opts); err != nil {
+			return err
+		}
+	}
+	if m.ExtJournalDevice != "" && strings.HasPrefix(string(m.fs), "ext") {
+		o, err := m.extJournalOpt()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, o)
+	}
+	if m.extSB_ != 0 {
+		opts = append(opts, fmt.Sprintf("sb=%d", m.extSB_))
+	}
+	quota, err := m.quotaOpts()
+	if err != nil {
 		return err
 	}
+	opts = append(opts, quota...)
+	if c := m.seContext(); c != "" && !hasContextOption(opts) {
+		opts = append(opts, fmt.Sprintf("context=\"%s\"", c))
+	}
+	// mount(8) keeps x- options from the kernel, helpers may not
+	if t := m.tagOpt(); t != "" && m.caller_ == CMount {
+		opts = append(opts, t)
+	}
+	defaults := m.mountDefaults(m.mountFS())
+	// the old kernel driver is mounted as ntfs too, the defaults of that
+	// type are those of ntfs-3g
+	if m.mountFS() == FsNTFs && m.caller_ == CMount {
+		defaults = ""
+	}
+	opts = mergeMountOptions(defaults, opts)
+	if m.OverlayScratch != "" {
+		if err = m.mountOverlay(opts); err != nil {
+			return err
+		}
+	} else if m.fs == FsZFS {
+		if err = m.mountZFS(opts...); err != nil {
+			return err
+		}
+	} else if err = m.mount(m.args_.dev, m.args_.path_, m.mountCtx(opts...)); err != nil {
+		return m.endianError(err)
+	}
+	m.pushCleanup(m.unmountPath)
+	if m.OverlayScratch == "" {
+		if err = m.checkDegraded(); err != nil {
+			return err
+		}
+	}
+
+	if m.Propagation != "" {
+		return m.env().MakePropagation(m.Propagation, m.args_.path_)
+	}
 	return nil
 }
 
-func (m *DevMounter) changeNTFs() (err error) {
-	return nil // TODO change NTFs filesystem uuid ...
+// Move relocates the mounted tree to newPath, an existing directory, with
+// `mount --move`. Close unmounts newPath afterwards
+func (m *DevMounter) Move(newPath string) (err error) {
+	if !IsPathMounted(m.args_.path_) {
+		return ErrNotMount
+	}
+	if r, _, _ := m.env().ExecCmd(
+		fmt.Sprintf("%s --move %s %s", CMount, m.args_.path_, newPath)); r != 0 {
+		return ErrMount
+	}
+	if !IsPathMounted(newPath) {
+		return ErrMount
+	}
+	m.args_.path_ = newPath
+	return nil
 }
 
-func (m *DevMounter) MountDevice() (err error) {
-	return Mount(m.fs, m.args_.dev, m.args_.path_, "")
+func validPropagation(p string) bool {
+	switch p {
+	case "shared", "slave", "private", "unbindable":
+		return true
+	}
+	return false
+}
+
+// MakePropagation runs `mount --make-<prop> path_`
+func MakePropagation(prop, path_ string) (err error) {
+	return cmdEnv{}.MakePropagation(prop, path_)
+}
+
+func (x cmdEnv) MakePropagation(prop, path_ string) (err error) {
+	if !validPropagation(prop) {
+		return ErrPropagate
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s --make-%s %s", CMount, prop, path_)); r != 0 {
+		return ErrMount
+	}
+	return nil
+}
+
+// seContext is the selinux context carried by ctx, "{}" stands for none
+func (m *DevMounter) seContext() string {
+	var c string
+	switch v := m.args_.ctx.(type) {
+	case string:
+		c = v
+	case *string:
+		if v != nil {
+			c = *v
+		}
+	}
+	if c = strings.TrimSpace(c); c == "{}" {
+		return ""
+	}
+	return c
+}
+
+// hasContextOption tells whether opts set a selinux context themselves, which
+// then replaces the one of ctx
+func hasContextOption(opts []string) bool {
+	for _, o := range opts {
+		switch optionKey(o) {
+		case "context", "fscontext", "defcontext", "rootcontext":
+			return true
+		}
+	}
+	return false
+}
+
+// mountCtx joins the mount options into a `-o` argument,
+// adding X-mount.mkdir when the caller is mount
+func (m *DevMounter) mountCtx(opts ...string) string {
+	if m.mkdir() && m.caller_ == CMount {
+		opts = append(opts, "X-mount.mkdir")
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return "-o " + strings.Join(opts, ",")
+}
+
+// preparePath remembers whether the mount path has to be created, ntfs-3g
+// knows nothing about X-mount.mkdir so the path is created here for it
+func (m *DevMounter) preparePath() (err error) {
+	if err = m.checkEmptyTarget(); err != nil {
+		return err
+	}
+	if !m.mkdir() {
+		return nil
+	}
+	if !m.rmdir_ {
+		if _, err = os.Stat(m.args_.path_); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		m.rmdir_ = true
+		if m.state_ != nil {
+			m.state_.CreatedDir = true
+			if err = m.saveState(); err != nil {
+				return err
+			}
+		}
+	}
+	dir := m.args_.path_
+	m.pushCleanup(func() error { return m.removePath(dir) })
+	if m.caller_ != CMount {
+		return os.MkdirAll(m.args_.path_, 0755)
+	}
+	return nil
+}
+
+func (m *DevMounter) removePath(dir string) (err error) {
+	if err = os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.rmdir_ = false
+	return nil
+}
+
+func (m *DevMounter) unmountPath() (err error) {
+	if !IsMount(m.args_.path_) {
+		return nil
+	}
+	if err = m.env().UMount(m.args_.path_); err != nil {
+		return err
+	}
+	// umount flushes the file system, but for a loop device or an nbd
+	// image the data may still sit in the page cache of the backing file
+	if m.SyncOnUnmount {
+		syscall.Sync()
+	}
+	return nil
+}
+
+// ResizeFS grows a mounted ext, xfs or btrfs file system to fill its device when
+// ResizeToFill is set, both tools resize online
+func (m *DevMounter) ResizeFS() (err error) {
+	if !m.ResizeToFill {
+		return nil
+	}
+	if m.OverlayScratch != "" {
+		return ErrResizeRO
+	}
+
+	e, err := MountEntryAt(m.args_.path_)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrMount
+	}
+	if e.HasOption("ro") {
+		return ErrResizeRO
+	}
+
+	var c string
+	switch m.fs {
+	case FsExt2, FsExt3, FsExt4:
+		c = fmt.Sprintf("%s %s", CResize2FS, m.args_.dev)
+	case FsXFS_:
+		c = fmt.Sprintf("%s %s", CXFSGrowFS, m.args_.path_)
+	case FsBtrfs:
+		c = fmt.Sprintf("%s filesystem resize max %s", CBtrfs, m.args_.path_)
+	default:
+		return ErrUnsFs
+	}
+	if r, _, _ := m.env().ExecCmd(c); r != 0 {
+		return ErrResize
+	}
+	return nil
 }
 
 func (m *DevMounter) Check() (err error) {
-	if IsMount(m.args_.dev) || IsMount(m.args_.path_) {
+	if m.SkipCheck {
 		return nil
 	}
-	return ErrMount
+	// the device mounted elsewhere does not count, the mount path itself
+	// has to be a mount point now
+	if !IsPathMounted(m.args_.path_) {
+		return ErrMount
+	}
+	return m.CheckWritable()
 }
 
 func (m *DevMounter) BindArgs() (err error) {
+	if m.args_.path_ != "" {
+		if err = m.checkPath(); err != nil {
+			return err
+		}
+	}
+	if err = m.checkArgs(); err != nil {
+		return err
+	}
 	if err = m.bindFS(); err != nil {
 		return err
 	}
+	if err = m.bindAutoPath(); err != nil {
+		return err
+	}
 	if err = m.bindCaller(); err != nil {
 		return err
 	}
+	if err = m.bindDevInfo(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// fileQuoted are the labels and names in the output of `file`
+var fileQuoted = regexp.MustCompile(`"[^"]*"`)
+
+// fileFSTypes are the file systems told by `file`, zfs and swap by blkid
+var fileFSTypes = []FileSystemType{FsExt2, FsExt3, FsExt4, FsXFS_, FsNTFs, FsBtrfs}
+
+// fileFSType finds the file system in the output of `file -sL dev`, the
+// first type named as a whole word. The device path and quoted strings such
+// as the volume name are skipped, so a label "xfs-backup" on an ext4 or a
+// type in the path does not count, except the OEM-ID "NTFS    " which older
+// versions of file give as the only hint of a ntfs
+func fileFSType(dev, fileOut string) FileSystemType {
+	out := strings.TrimPrefix(strings.ToLower(fileOut), strings.ToLower(dev)+":")
+	out = fileQuoted.ReplaceAllStringFunc(out, func(q string) string {
+		if strings.TrimSpace(strings.Trim(q, `"`)) == string(FsNTFs) {
+			return q
+		}
+		return " "
+	})
+	words := strings.FieldsFunc(out, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		for _, fs := range fileFSTypes {
+			if w == string(fs) {
+				return fs
+			}
+		}
+	}
+	return ""
+}
+
 func (m *DevMounter) bindFS() (err error) {
-	r, out, err_ := ExecCmd(fmt.Sprintf("%s -sL %s", CFile, m.args_.dev))
+	if m.ImageFormat != "" && m.image_ == "" {
+		if err = m.attachImage(m.ImageFormat); err != nil {
+			return err
+		}
+	}
+
+	// a detached header leaves nothing on the device to detect
+	if m.LUKSHeader != "" && m.luks_ == "" {
+		if err = m.openLUKS(); err != nil {
+			return err
+		}
+	}
+
+	if m.FS != "" {
+		if !supportedFS(m.FS) {
+			return ErrUnsFs
+		}
+		m.fs = m.FS
+		return m.snapshot()
+	}
+
+	r, out, err_ := m.env().ExecCmd(fmt.Sprintf("%s -sL %s", CFile, m.args_.dev))
 	out = strings.ToLower(out)
 
 	if r != 0 {
+		if err_ == nil {
+			err_ = ErrUnKFs
+		}
 		return err_
 	}
 
-	for _, _v := range []FileSystemType{FsExt2, FsExt3, FsExt4, FsXFS_, FsNTFs} {
-		if strings.Contains(out, string(_v)) {
-			m.fs = _v
-			return nil
+	if f := imageFormat(out); f != "" && m.image_ == "" {
+		if err = m.attachImage(f); err != nil {
+			return err
+		}
+		return m.bindFS()
+	}
+	if m.needsLoop() {
+		if err = m.attachLoop(); err != nil {
+			return err
 		}
+		return m.bindFS()
+	}
+	if m.luks_ == "" && m.isLUKS(out) {
+		if err = m.openLUKS(); err != nil {
+			return err
+		}
+		return m.bindFS()
+	}
+	if m.md_ == "" && m.isMDMember(out) {
+		if err = m.noSnapshot("an md member"); err != nil {
+			return err
+		}
+		if err = m.assembleMD(); err != nil {
+			return err
+		}
+		return m.bindFS()
 	}
 
+	if fs := detectFS(m.args_.dev, out); fs != "" {
+		m.fs = m.reconcileFS(fs)
+		return m.snapshot()
+	}
+	if fs := appleFileType(m.args_.dev, out); fs != "" {
+		m.fs = fs
+		return m.noSnapshot(string(fs))
+	}
+
+	if strings.Contains(out, "swap file") {
+		if err = m.noSnapshot(string(FsSwap)); err != nil {
+			return err
+		}
+		return m.bindSwap()
+	}
+	// file knows nothing about zfs pool members
+	t, _ := m.env().QueryDeviceTag(m.args_.dev, "TYPE")
+	if t == BlkIDZFSMember {
+		m.fs = FsZFS
+		return m.noSnapshot("a zfs pool member")
+	} else if t == string(FsSwap) {
+		if err = m.noSnapshot(string(FsSwap)); err != nil {
+			return err
+		}
+		return m.bindSwap()
+	} else if t == string(FsHFSPlus) || t == string(FsAPFS) {
+		m.fs = FileSystemType(t)
+		return m.noSnapshot(t)
+	} else if t == BlkIDRAIDMember && m.md_ == "" {
+		if err = m.noSnapshot("an md member"); err != nil {
+			return err
+		}
+		if err = m.assembleMD(); err != nil {
+			return err
+		}
+		return m.bindFS()
+	}
+
+	// tell the caller about the layer to descend first
+	pt, _ := m.env().QueryDeviceTag(m.args_.dev, "PTTYPE")
+	if kind, _ := classifyDevice(m.args_.dev, out, t, pt); kind != DeviceEmpty {
+		return fmt.Errorf("%w: %s holds a %s", ErrUnKFs, m.args_.dev, kind)
+	}
 	return ErrUnKFs
 }
 
 func (m *DevMounter) bindCaller() (err error) {
 	m.caller_ = GetCallerByFS(m.fs)
+	if m.fs != FsNTFs {
+		return nil
+	}
+
+	switch m.NTFSDriver {
+	case "", NTFSAuto:
+		if HasNTFs3() {
+			m.caller_ = CMount
+		}
+	case NTFSKernel, NTFSLegacy:
+		m.caller_ = CMount
+	case NTFSFuse:
+	default:
+		return ErrNTFSDriver
+	}
 	return nil
 }
 
+// mount mounts dev with the caller bindCaller chose, which for ntfs depends
+// on NTFSDriver
+func (m *DevMounter) mount(dev, path_, ctx_ string) (err error) {
+	c := m.caller_
+	if c == "" {
+		c = GetCallerByFS(m.mountFS())
+	}
+	_, err = m.env().mountCmdBy(c, m.mountFS(), dev, path_, ctx_, m.MountTimeout)
+	return err
+}
+
+// mountFS is the file system type handed to Mount, which depends on the
+// driver chosen for ntfs
+func (m *DevMounter) mountFS() FileSystemType {
+	if m.fs == FsNTFs && m.caller_ == CMount && m.NTFSDriver != NTFSLegacy {
+		return FsNTFs3
+	}
+	return m.fs
+}
+
 func main() {
 	var err error
 
@@ -304,10 +1422,235 @@ func main() {
 	}()
 
 	FDevPath := flag.String("dev", "", "device file path")
-	FPath := flag.String("path", "", "mount path, an empty directory or a nonexistent path")
-	FCtx := flag.String("ctx", "{}", "TODO. Reserved parameter")
+	var FPaths pathList
+	flag.Var(&FPaths, "path", "mount path, an empty directory or a nonexistent path (default the label or uuid under -mount-base), repeated to bind mount it at the others too")
+	FMountBase := flag.String("mount-base", DefaultAutoMountBase, "without -path, the directory to mount under")
+	FCtx := flag.String("ctx", "", "selinux context of the mounted file system, e.g. system_u:object_r:tmp_t:s0")
+	FChangeArgs := flag.String("change-args", "", "extra arguments of tune2fs/xfs_admin, e.g. -f")
+	FNTFSDriver := flag.String("ntfs-driver", "auto", "ntfs only, auto, ntfs3, ntfs or ntfs-3g")
+	FForce := flag.Bool("force-umount", false, "unmount the device and the mount path first when already mounted")
+	FLazy := flag.Bool("lazy-umount", false, "with -force-umount, detach lazily when the mount stays busy")
+	FPropagation := flag.String("propagation", "", "shared, slave, private or unbindable")
+	FZeroLog := flag.Bool("xfs-zero-log", false, "xfs only, zero an unclean log that cannot be replayed, its changes are lost")
+	FCheckSize := flag.Bool("check-size", false, "ext and xfs only, warn when the file system is larger than the device")
+	FStrictSize := flag.Bool("strict-size", false, "like -check-size, but fail")
+	FFsck := flag.Bool("fsck", false, "check the file system before changing its uuid")
+	FFsckTimeout := flag.Duration("fsck-timeout", 0, "stop the check after this long, e.g. 10m")
+	FFsckParallel := flag.Int("fsck-parallel", 0, "with dev:path arguments, how many to check at the same time (default the -parallel)")
+	FZFSDataset := flag.String("zfs-dataset", "", "zfs only, the dataset to mount, relative to the pool (default the root dataset)")
+	FNonEmpty := flag.Bool("allow-non-empty", false, "mount over a directory with files in it, hiding them until unmounted")
+	FUnsafe := flag.Bool("allow-unsafe-path", false, "allow mounting over a system directory such as / or /etc")
+	FOptions := flag.String("o", "", "extra mount options, comma separated, e.g. noexec,nodev")
+	FNoDefaults := flag.Bool("no-default-options", false, "do not add the default options of the file system, e.g. noatime for ext")
+	FOverlay := flag.String("overlay", "", "mount read-only under a writable overlay, whose changes go to this directory")
+	FLUKSKey := flag.String("luks-key-file", "", "luks only, the key file")
+	FMDMembers := flag.String("md-members", "", "md raid only, the other members of the array, comma separated")
+	FSnapshot := flag.Bool("snapshot", false, "mount a dm-snapshot of the device, leaving the device itself untouched")
+	FSnapshotCOW := flag.String("snapshot-cow", "", "with -snapshot, the device or file the writes go to (default a sparse temporary file)")
+	FLUKSHeader := flag.String("luks-header", "", "luks only, the detached header")
+	FQuota := flag.String("quota", "", "ext and xfs only, quota mount options, e.g. usrquota,grpquota")
+	FQuotaOn := flag.Bool("quotaon", false, "with -quota, create the quota files of an ext and turn its quotas on")
+	FExport := flag.String("nfs-export", "", "export the mount over nfs to this client, e.g. 10.0.0.0/24")
+	FExportOpts := flag.String("nfs-export-options", "", "with -nfs-export, the export options, e.g. ro,no_subtree_check")
+	FPostMount := flag.String("post-mount-cmd", "", "run this on the mounted path, {} replaced by the path, e.g. \"sha256sum -c {}/SHA256SUMS\"")
+	FStrictVerify := flag.Bool("strict-verify", false, "with -post-mount-cmd, unmount and fail when the command fails")
+	FChecksum := flag.Bool("tree-checksum", false, "hash the mounted tree after mounting, kept in the result, reads every file")
+	FChecksumExclude := flag.String("checksum-exclude", "", "with -tree-checksum, paths relative to the mount path to leave out, comma separated patterns")
+	FChecksumWorkers := flag.Int("checksum-workers", 1, "with -tree-checksum, how many files are read at a time")
+	FSync := flag.Bool("sync", false, "mount with -o sync")
+	FWarm := flag.Bool("warm-cache", false, "read the superblock regions of the device before mounting, for high latency storage")
+	FFastRestore := flag.Bool("fast-restore", false, "ext3 and ext4 only, mount with data=writeback,nobarrier, unsafe after a crash")
+	FNoJournal := flag.Bool("fast-restore-no-journal", false, "with -fast-restore, remove the journal until unmounted")
+	FRO := flag.Bool("ro", false, "mount read-only")
+	FROFirst := flag.Bool("ro-first", false, "mount read-only, check the mount and run -post-mount-cmd, then remount read-write")
+	FFS := flag.String("fs", "", "skip the detection of the file system type, e.g. ext4 or xfs")
+	FCrossCheck := flag.Bool("cross-check-fs", false, "have blkid confirm the file system file detected, a disagreement is settled by mount -t auto")
+	FMountTimeout := flag.Duration("mount-timeout", 0, "stop a mount taking longer than this, e.g. 5m")
+	FRetries := flag.Int("umount-retries", DefaultUMountRetries, "how often a busy mount is unmounted before giving up")
+	FSubvol := flag.String("subvol", "", "btrfs only, the subvolume to mount")
+	FDegraded := flag.Bool("degraded", false, "btrfs only, mount read-only with devices missing, the uuid is kept")
+	FSubvolID := flag.Int("subvolid", 0, "btrfs only, the id of the subvolume to mount")
+	FResize := flag.Bool("resize", false, "ext and xfs only, grow the file system to fill the device after mounting")
+	FSkipCheck := flag.Bool("skip-check", false, "do not verify the mount afterwards")
+	FOutput := flag.String("output", "", "write the result as json to this file, replaced atomically, instead of printing the results of dev:path arguments")
+	FParallel := flag.Int("parallel", 1, "with dev:path arguments, how many to mount at the same time")
+	FNoFail := flag.Bool("nofail", false, "with dev:path arguments, go on past a device that fails, failing only at the end")
+	FVersion := flag.Bool("version", false, "print the version and what is supported for each file system")
+	FProbe := flag.Bool("probe", false, "print what is known about the device as json, without changing or mounting it writable")
+	FDebug := flag.Bool("debug", false, "log every command run")
+	FPrefix := flag.String("cmd-prefix", "", "run every command through this, e.g. \"sudo -n\"")
+	FClone := flag.String("clone-uuid-from", "", "take the uuid of this device, of the same file system type, instead of a new one")
+	FRecord := flag.String("record-uuid", "", "keep the uuid from before the change in this file, or in the "+OriginalUUIDXattr+" xattr of the mount path with \"xattr\"")
+	FTag := flag.String("tag", "", "owner of the mount, e.g. a job id, kept as the "+TagOption+" option")
+	FInventory := flag.String("inventory", "", "attach this whole disk image read-only, print what its partitions hold as json and exit, mounting nothing")
+	FReap := flag.String("umount-tag", "", "unmount everything tagged with this owner, release the loop, luks and dm devices under it and exit")
+	FIfConflict := flag.Bool("only-if-conflict", false, "change the uuid only when another device has it too")
+	FRequire := flag.Bool("require-uuid-change", false, "fail instead of mounting a file system whose uuid cannot be changed, e.g. zfs")
+	FSwapOn := flag.Bool("swapon", false, "activate a swap device instead of failing")
+	FSettle := flag.Bool("udev-settle", false, "wait for udev after changing the uuid")
+	FState := flag.String("state", "", "operation log file, resumes an interrupted run")
+	FBackupSB := flag.Int("try-backup-sb", 0, "ext only, mount through one of the first N backup superblocks when the primary one is damaged, -1 for all")
+	FJournal := flag.String("journal-dev", "", "ext only, the external journal device")
+	FLoopRO := flag.Bool("loop-ro", false, "image files only, attach the image read-only and keep its uuid")
+	FSectorSize := flag.Int("sector-size", 0, "raw images only, the logical sector size, e.g. 4096 (default 512)")
+	FPartition := flag.Int("partition", 0, "qcow2 and vmdk images only, the partition to mount (default the whole disk)")
+	FMkdir := flag.Bool("mkdir", false, "create the mount path when missing")
+	FXFSUUID := flag.String("xfs-uuid", "", "xfs only, generate, nil, restore or a uuid (default a locally generated uuid)")
 	flag.Parse()
+	if err_ := setFlagsFromEnv(flag.CommandLine); err_ != nil {
+		fmt.Fprintln(os.Stderr, err_)
+		os.Exit(2)
+	}
+	if *FVersion {
+		PrintVersion(os.Stdout)
+		return
+	}
+	if *FDebug {
+		DebugLogger = DefaultLogger
+	}
+	env := cmdEnv{prefix: strings.Fields(*FPrefix)}
+	if *FReap != "" {
+		err = env.CleanupStale(*FReap)
+		return
+	}
+	if *FInventory != "" {
+		var inv *Inventory
+		if inv, err = env.TakeInventory(*FInventory); err != nil {
+			return
+		}
+		if *FOutput != "" {
+			err = WriteResult(*FOutput, inv)
+			return
+		}
+		b, _ := json.MarshalIndent(inv, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
 
-	m := NewMounterWithArgs(*FDevPath, *FPath, FCtx)
-	err = m.Start()
+	path_ := ""
+	if len(FPaths) != 0 {
+		path_ = FPaths[0]
+	}
+	m := NewMounterWithArgs(*FDevPath, path_, *FCtx)
+	if len(FPaths) > 1 {
+		m.BindPaths = FPaths[1:]
+	}
+	m.AutoMkdir = *FMkdir
+	m.AutoMountBase = *FMountBase
+	m.StateFile = *FState
+	m.ResizeToFill = *FResize
+	m.NTFSDriver = NTFSDriver(*FNTFSDriver)
+	m.ForceUnmountExisting = *FForce
+	m.LazyUnmount = *FLazy
+	m.Propagation = *FPropagation
+	m.AllowXFSLogZeroing = *FZeroLog
+	m.Fsck = *FFsck
+	m.CheckSize = *FCheckSize
+	m.StrictSize = *FStrictSize
+	m.ZFSDataset = *FZFSDataset
+	m.ExtJournalDevice = *FJournal
+	if *FBackupSB != 0 {
+		m.TryBackupSuperblock = true
+		m.MaxBackupSuperblocks = *FBackupSB
+	}
+	m.NBDPartition = *FPartition
+	m.SectorSize = *FSectorSize
+	m.LoopReadOnly = *FLoopRO
+	m.ReadOnly = *FRO
+	m.FS = FileSystemType(*FFS)
+	m.CrossCheckFS = *FCrossCheck
+	m.MountTimeout = *FMountTimeout
+	m.UMountRetries = *FRetries
+	m.Sync = *FSync
+	m.WarmCache = *FWarm
+	m.FastRestore = *FFastRestore
+	m.FastRestoreNoJournal = *FNoJournal
+	m.Quota = *FQuota
+	m.PostMountCmd = strings.Fields(*FPostMount)
+	m.StrictVerify = *FStrictVerify
+	if *FChecksumExclude != "" {
+		m.ChecksumExclude = strings.Split(*FChecksumExclude, ",")
+	}
+	m.ChecksumWorkers = *FChecksumWorkers
+	m.NFSExportClient = *FExport
+	m.NFSExportOptions = *FExportOpts
+	m.EnableQuota = *FQuotaOn
+	m.LUKSKeyFile = *FLUKSKey
+	m.LUKSHeader = *FLUKSHeader
+	if *FMDMembers != "" {
+		m.MDMembers = strings.Split(*FMDMembers, ",")
+	}
+	m.Snapshot = *FSnapshot
+	m.SnapshotCOW = *FSnapshotCOW
+	m.OverlayScratch = *FOverlay
+	if *FOptions != "" {
+		m.MountOptions = SplitMountOptions(*FOptions)
+	}
+	if *FNoDefaults {
+		m.MountDefaults = map[FileSystemType]string{}
+	}
+	m.SkipCheck = *FSkipCheck
+	m.UdevSettle = *FSettle
+	m.CloneUUIDFrom = *FClone
+	m.Tag = *FTag
+	m.CommandPrefix = env.prefix
+	if *FRecord != "" {
+		m.RecordOriginalUUID = true
+		if *FRecord != "xattr" {
+			m.OriginalUUIDFile = *FRecord
+		}
+	}
+	m.SwapOn = *FSwapOn
+	m.RequireUUIDChange = *FRequire
+	m.OnlyChangeIfConflict = *FIfConflict
+	m.AllowUnsafePath = *FUnsafe
+	m.AllowNonEmptyTarget = *FNonEmpty
+	m.BtrfsSubvol = *FSubvol
+	m.BtrfsSubvolID = *FSubvolID
+	m.BtrfsDegraded = *FDegraded
+	m.FsckTimeout = *FFsckTimeout
+	m.FsckParallel = *FFsckParallel
+	m.ExtraChangeArgs = strings.Fields(*FChangeArgs)
+	m.XFSUUIDMode = UUIDMode(*FXFSUUID)
+	if *FProbe {
+		defer m.Close()
+		var report *ProbeReport
+		report, err = m.Probe()
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	m.NoFail = *FNoFail
+	if flag.NArg() != 0 {
+		err = mountArgs(m, flag.Args(), *FParallel, *FOutput)
+		return
+	}
+	// a usage error like those of flag, without the stack of a failed mount
+	if err_ := m.Validate(); err_ != nil {
+		fmt.Fprintln(os.Stderr, err_)
+		os.Exit(2)
+	}
+	if *FROFirst {
+		err = m.StartVerified(nil)
+	} else {
+		err = m.Start()
+	}
+	if err == nil && path_ == "" {
+		fmt.Println(m.Result().Path)
+	}
+	if err == nil && *FChecksum {
+		var sum string
+		if sum, err = m.TreeChecksum(); err == nil && *FOutput == "" {
+			fmt.Println(sum)
+		}
+	}
+	if *FOutput != "" {
+		r := m.Result()
+		if err != nil {
+			r.Error = err.Error()
+		}
+		if err_ := WriteResult(*FOutput, &r); err == nil {
+			err = err_
+		}
+	}
 }
@@ -0,0 +1,1613 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeReply struct {
+	r   int
+	out string
+}
+
+// fakeRunner records every command line and answers from replies, looked up
+// by the whole line first and by the command name next. Unknown commands
+// succeed silently
+type fakeRunner struct {
+	mu      sync.Mutex
+	cmds    []string
+	replies map[string]fakeReply
+}
+
+func (f *fakeRunner) Run(cmdStr string) (r int, out string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := strings.Join(strings.Fields(cmdStr), " ")
+	f.cmds = append(f.cmds, c)
+	if v, ok := f.replies[c]; ok {
+		return v.r, v.out, nil
+	}
+	if v, ok := f.replies[strings.Fields(c)[0]]; ok {
+		return v.r, v.out, nil
+	}
+	return 0, "", nil
+}
+
+func (f *fakeRunner) RunArgv(argv []string) (r int, out string, err error) {
+	return f.Run(strings.Join(argv, " "))
+}
+
+// useRunner also hides the mount helpers of the host and replaces its
+// mountinfo with one where fakeDev is mounted at fakePath
+func useRunner(t *testing.T, r Runner) {
+	mountinfo := filepath.Join(t.TempDir(), "mountinfo")
+	line := "100 1 8:1 / " + fakePath + " rw,relatime shared:1 - ext4 " + fakeDev + " rw\n"
+	if err := ioutil.WriteFile(mountinfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old, oldBlkID, oldDirs, oldInfo := DefaultRunner, BlkID, MountHelperDirs, ProcMountInfo
+	DefaultRunner, BlkID, MountHelperDirs, ProcMountInfo = r, BlkIDUtilLinux, nil, mountinfo
+	t.Cleanup(func() { DefaultRunner, BlkID, MountHelperDirs, ProcMountInfo = old, oldBlkID, oldDirs, oldInfo })
+}
+
+const (
+	fakeDev  = "/dev/fake0"
+	fakePath = "/mnt/fake0"
+)
+
+func newFakeRunner(fileOut string) *fakeRunner {
+	return &fakeRunner{replies: map[string]fakeReply{
+		"file -sL " + fakeDev:               {0, fakeDev + ": " + fileOut},
+		"blkid -s UUID -o value " + fakeDev: {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+}
+
+func TestStartCommands(t *testing.T) {
+	cases := []struct {
+		name    string
+		fileOut string
+		replies map[string]fakeReply
+		setup   func(m *DevMounter)
+		want    []string
+	}{
+		{
+			name:    "ext4",
+			fileOut: "Linux rev 1.0 ext4 filesystem data, UUID=1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+			want: []string{
+				"file -sL /dev/fake0",
+				"dumpe2fs -h /dev/fake0",
+				"tune2fs -U random /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -o noatime /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "ext4 propagation",
+			fileOut: "Linux rev 1.0 ext4 filesystem data, UUID=1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+			setup:   func(m *DevMounter) { m.Propagation = "slave" },
+			want: []string{
+				"file -sL /dev/fake0",
+				"dumpe2fs -h /dev/fake0",
+				"tune2fs -U random /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -o noatime /dev/fake0 /mnt/fake0",
+				"mount --make-slave /mnt/fake0",
+			},
+		},
+		{
+			name:    "xfs",
+			fileOut: "SGI XFS filesystem data (blksz 4096, inosz 512, v2 dirs)",
+			setup:   func(m *DevMounter) { m.XFSUUIDMode = XFSUUIDGenerate },
+			want: []string{
+				"file -sL /dev/fake0",
+				"mount -o rw,nouuid /dev/fake0 /mnt/fake0",
+				"umount /mnt/fake0",
+				"xfs_admin -U generate /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -o inode64 /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "ntfs",
+			fileOut: `DOS/MBR boot sector, code offset 0x52+2, OEM-ID "NTFS    "`,
+			setup:   func(m *DevMounter) { m.NTFSDriver = NTFSFuse },
+			want: []string{
+				"file -sL /dev/fake0",
+				"ntfslabel --new-serial /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"ntfs-3g -o windows_names /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "ntfs kernel",
+			fileOut: `DOS/MBR boot sector, code offset 0x52+2, OEM-ID "NTFS    "`,
+			setup:   func(m *DevMounter) { m.NTFSDriver = NTFSKernel },
+			want: []string{
+				"file -sL /dev/fake0",
+				"ntfslabel --new-serial /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -t ntfs3 /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "ntfs legacy",
+			fileOut: `DOS/MBR boot sector, code offset 0x52+2, OEM-ID "NTFS    "`,
+			setup: func(m *DevMounter) {
+				m.NTFSDriver = NTFSLegacy
+				m.ReadOnly = true
+			},
+			want: []string{
+				"file -sL /dev/fake0",
+				"ntfslabel --new-serial /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -t ntfs -o ro /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "hfsplus",
+			fileOut: "Macintosh HFS Extended version 4 data last mounted by: '10.0', created: Mon Jan  1 00:00:00 2024",
+			want: []string{
+				"file -sL /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -t hfsplus -o ro /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "apfs",
+			fileOut: "data",
+			replies: map[string]fakeReply{
+				"blkid -s TYPE -o value /dev/fake0": {0, "apfs"},
+			},
+			want: []string{
+				"file -sL /dev/fake0",
+				"blkid -s TYPE -o value /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"apfs-fuse -o ro /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "btrfs",
+			fileOut: "BTRFS Filesystem sectorsize 4096, nodesize 16384, leafsize 16384",
+			setup: func(m *DevMounter) {
+				m.ReadOnly = true
+				m.BtrfsSubvolID = 257
+			},
+			want: []string{
+				"file -sL /dev/fake0",
+				"btrfstune -f -u /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"mount -o noatime,ro,subvolid=257 /dev/fake0 /mnt/fake0",
+			},
+		},
+		{
+			name:    "zfs",
+			fileOut: "data",
+			replies: map[string]fakeReply{
+				"blkid -s TYPE -o value /dev/fake0":  {0, "zfs_member"},
+				"blkid -s LABEL -o value /dev/fake0": {0, "tank"},
+			},
+			setup: func(m *DevMounter) { m.ZFSDataset = "home" },
+			want: []string{
+				"file -sL /dev/fake0",
+				"blkid -s TYPE -o value /dev/fake0",
+				"blkid -s LABEL -o value /dev/fake0",
+				"blkid -s UUID -o value /dev/fake0",
+				"zpool import -d /dev -N tank",
+				"mount -t zfs -o zfsutil tank/home /mnt/fake0",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeRunner(c.fileOut)
+			for k, v := range c.replies {
+				f.replies[k] = v
+			}
+			useRunner(t, f)
+
+			m := NewMounterWithArgs(fakeDev, fakePath, "")
+			if c.setup != nil {
+				c.setup(m)
+			}
+			if err := m.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if !reflect.DeepEqual(f.cmds, c.want) {
+				t.Errorf("commands\n got %q\nwant %q", f.cmds, c.want)
+			}
+			if got := m.Result().UUID; got != "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4" {
+				t.Errorf("uuid %q", got)
+			}
+		})
+	}
+}
+
+func TestStartErrors(t *testing.T) {
+	ext4 := "Linux rev 1.0 ext4 filesystem data"
+	cases := []struct {
+		name    string
+		fileOut string
+		fail    string
+		want    error
+	}{
+		{"file", ext4, "file -sL /dev/fake0", ErrUnKFs},
+		{"unknown fs", "data", "", ErrUnKFs},
+		{"tune2fs", ext4, "tune2fs -U random /dev/fake0", ErrGenUUID},
+		{"blkid", ext4, "blkid -s UUID -o value /dev/fake0", ErrQueryUUID},
+		{"mount", ext4, "mount -o noatime /dev/fake0 /mnt/fake0", ErrMount},
+		{"xfs temporary mount", "SGI XFS filesystem data", "umount /mnt/fake0", ErrUMount},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeRunner(c.fileOut)
+			if c.fail != "" {
+				f.replies[c.fail] = fakeReply{r: 1}
+			}
+			useRunner(t, f)
+
+			m := NewMounterWithArgs(fakeDev, fakePath, "")
+			if err := m.Start(); !errors.Is(err, c.want) {
+				t.Fatalf("Start: got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestExtraChangeArgs(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.ExtraChangeArgs = []string{"-f"}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if f.cmds[2] != "tune2fs -U random -f /dev/fake0" {
+		t.Errorf("got %q", f.cmds[2])
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.ExtraChangeArgs = []string{fakeDev}
+	if err := m.Start(); err != ErrExtraArgs {
+		t.Errorf("got %v, want %v", err, ErrExtraArgs)
+	}
+}
+
+// makeExt4Image creates a sparse file system image of size bytes
+func makeExt4Image(t *testing.T, size int64) string {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+
+	img := filepath.Join(t.TempDir(), "ext4.img")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", img).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v: %s", err, out)
+	}
+	return img
+}
+
+func TestIntegrationExt4(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short mode")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	for _, tool := range []string{"losetup", "file", "tune2fs", "blkid"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	img := makeExt4Image(t, 16<<20)
+	out, err := exec.Command("losetup", "-f", "--show", img).Output()
+	if err != nil {
+		t.Skipf("losetup: %v", err)
+	}
+	loop := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", loop).Run()
+
+	old, err := QueryDeviceUUID(loop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMounterWithArgs(loop, filepath.Join(t.TempDir(), "mnt"), "")
+	m.AutoMkdir = true
+	err = m.WithMount(func(mountPath string) error {
+		if !IsMount(mountPath) {
+			t.Errorf("%s is not mounted", mountPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := m.Result()
+	if r.UUID == "" || r.UUID == old {
+		t.Errorf("uuid not changed: %q -> %q", old, r.UUID)
+	}
+	if r.BackingFile != img {
+		t.Errorf("backing file %q, want %q", r.BackingFile, img)
+	}
+}
+
+func TestMountHelper(t *testing.T) {
+	f := newFakeRunner(`DOS/MBR boot sector, OEM-ID "NTFS    "`)
+	useRunner(t, f)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "mount.ntfs-3g"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	MountHelperDirs = []string{dir}
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.NTFSDriver = NTFSFuse
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "mount.ntfs-3g") + " " + fakeDev + " " + fakePath + " -o windows_names"; f.cmds[3] != want {
+		t.Errorf("got %q, want %q", f.cmds[3], want)
+	}
+}
+
+func TestXFSDirtyLog(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		f := newFakeRunner("SGI XFS filesystem data")
+		f.replies["mount -o rw,nouuid "+fakeDev+" "+fakePath] = fakeReply{r: 32}
+		f.replies["xfs_repair -n "+fakeDev] = fakeReply{2, "ERROR: The filesystem has valuable metadata changes in a log which needs to be replayed."}
+		useRunner(t, f)
+
+		m := NewMounterWithArgs(fakeDev, fakePath, "")
+		m.AllowXFSLogZeroing = allow
+		err := m.Start()
+		if !allow {
+			if err != ErrXFSDirtyLog {
+				t.Errorf("got %v, want %v", err, ErrXFSDirtyLog)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.cmds[3] != "xfs_repair -L "+fakeDev || len(m.Result().Warnings) != 1 {
+			t.Errorf("log not zeroed: %q %q", f.cmds, m.Result().Warnings)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["blkid -s LABEL -o value "+fakeDev] = fakeReply{0, "data"}
+	f.replies["dumpe2fs"] = fakeReply{0, "Filesystem features:      has_journal ext_attr extent\nBlock count:              4096\nBlock size:               4096\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, "", "")
+	defer m.Close()
+	r, err := m.Probe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FS != FsExt4 || r.Label != "data" || r.FSSize != 4096*4096 {
+		t.Errorf("got %+v", r)
+	}
+	if !reflect.DeepEqual(r.Features, []string{"has_journal", "ext_attr", "extent"}) {
+		t.Errorf("features %q", r.Features)
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") || (strings.HasPrefix(c, "mount") && !strings.Contains(c, "-o ro,noload")) {
+			t.Errorf("probe ran %q", c)
+		}
+	}
+}
+
+func TestOnStep(t *testing.T) {
+	f := newFakeRunner("SGI XFS filesystem data")
+	useRunner(t, f)
+
+	var got []string
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.OnStep = func(e StepEvent) {
+		if e.Done {
+			got = append(got, "/"+string(e.Step))
+		} else {
+			got = append(got, string(e.Step))
+		}
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := "bind /bind unmount-existing /unmount-existing load-state /load-state prepare-path /prepare-path " +
+		"check-size /check-size fsck /fsck change-uuid xfs-log-replay /xfs-log-replay /change-uuid " +
+		"mount /mount bind-paths /bind-paths record-uuid /record-uuid check /check quota /quota resize /resize verify /verify nfs-export /nfs-export clear-state /clear-state"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestStartWithEvents(t *testing.T) {
+	f := newFakeRunner("SGI XFS filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	ch, err := m.StartWithEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Event
+	for e := range ch {
+		got = append(got, e)
+	}
+	first, last := got[0], got[len(got)-1]
+	if first.Kind != EventStepStarted || first.Step != StepBind {
+		t.Errorf("first %+v", first)
+	}
+	if last.Kind != EventDone || last.Err != nil || last.Result.FS != FsXFS_ {
+		t.Errorf("last %+v", last)
+	}
+	ran := false
+	for _, e := range got {
+		ran = ran || e.Kind == EventCommandRun && e.Command == "file -sL "+fakeDev
+	}
+	if !ran {
+		t.Errorf("no command event in %+v", got)
+	}
+	if m.onStep_ != nil || m.onCmd_ != nil {
+		t.Error("hooks left set")
+	}
+}
+
+func TestStartWithEventsFull(t *testing.T) {
+	f := newFakeRunner("SGI XFS filesystem data")
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	// another mounter of the batch
+	other := NewMounterWithArgs("/dev/other", "/mnt/other", "")
+	flooded := false
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		if cmdStr == "file -sL "+fakeDev && !flooded {
+			flooded = true
+			other.env().ExecCmd("file -sL /dev/other")
+			for i := 0; i < EventBuffer; i++ {
+				m.env().ExecCmd("true")
+			}
+		}
+		return f.Run(cmdStr)
+	}))
+
+	ch, err := m.StartWithEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads until Start is done, the done event still gets in
+	for deadline := time.Now().Add(2 * time.Second); len(ch) != EventBuffer+1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events buffered, want %d", len(ch), EventBuffer+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var last Event
+	for e := range ch {
+		if e.Kind == EventCommandRun && e.Command == "file -sL /dev/other" {
+			t.Errorf("command of another mounter: %+v", e)
+		}
+		last = e
+	}
+	if last.Kind != EventDone || last.Err != nil {
+		t.Errorf("last %+v", last)
+	}
+}
+
+func TestMove(t *testing.T) {
+	f := newFakeRunner("")
+	const newPath = "/mnt/final"
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		if cmdStr == "mount --move "+fakePath+" "+newPath {
+			line := "100 1 8:1 / " + newPath + " rw,relatime shared:1 - ext4 " + fakeDev + " rw\n"
+			if err := ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f.Run(cmdStr)
+	}))
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Move(newPath); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"mount --move " + fakePath + " " + newPath}; !reflect.DeepEqual(f.cmds, want) || m.args_.path_ != newPath {
+		t.Errorf("got %q at %s, want %q", f.cmds, m.args_.path_, want)
+	}
+
+	// nothing is mounted at fakePath any more
+	f.cmds = nil
+	m = NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Move(newPath); err != ErrNotMount || len(f.cmds) != 0 {
+		t.Errorf("got %v after %q, want %v", err, f.cmds, ErrNotMount)
+	}
+
+	// the tree stays where it was when the move fails
+	f.replies["mount --move "+newPath+" /mnt/other"] = fakeReply{r: 32}
+	m = NewMounterWithArgs(fakeDev, newPath, "")
+	if err := m.Move("/mnt/other"); err != ErrMount || m.args_.path_ != newPath {
+		t.Errorf("got %v at %s, want %v", err, m.args_.path_, ErrMount)
+	}
+}
+
+func TestUdevSettle(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.UdevSettle = true
+	m.Logger = LoggerFunc(func(string, ...interface{}) {})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the uuid is read again once udev settled
+	want := []string{
+		"file -sL /dev/fake0",
+		"dumpe2fs -h /dev/fake0",
+		"tune2fs -U random /dev/fake0",
+		"blkid -s UUID -o value /dev/fake0",
+		"udevadm settle",
+		"blkid -s UUID -o value /dev/fake0",
+		"mount -o noatime /dev/fake0 /mnt/fake0",
+	}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("commands\n got %q\nwant %q", f.cmds, want)
+	}
+	// there is no by-uuid link of the fake uuid
+	if r := m.Result(); len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], DiskByUUID) {
+		t.Errorf("got warnings %q", r.Warnings)
+	}
+
+	f.cmds = nil
+	f.replies["udevadm settle"] = fakeReply{r: 1}
+	m = NewMounterWithArgs(fakeDev, fakePath, "")
+	m.UdevSettle = true
+	if err := m.Start(); err != ErrUdevSettle || f.cmds[len(f.cmds)-1] != "udevadm settle" {
+		t.Errorf("got %v after %q, want %v", err, f.cmds, ErrUdevSettle)
+	}
+}
+
+func TestMountTimeout(t *testing.T) {
+	useRunner(t, sleepRunner{})
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.fs = FsXFS_
+	m.MountTimeout = 50 * time.Millisecond
+	if err := m.changeXFS(); err != ErrTimeout {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestBtrfsDegraded(t *testing.T) {
+	f := newFakeRunner("BTRFS Filesystem sectorsize 4096")
+	useRunner(t, f)
+
+	// the fake mountinfo has fakePath mounted rw
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.BtrfsDegraded = true
+	m.Logger = LoggerFunc(func(string, ...interface{}) {})
+	if err := m.Start(); err != ErrBtrfsDegradedRW {
+		t.Fatalf("got %v, want %v", err, ErrBtrfsDegradedRW)
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "btrfstune") {
+			t.Errorf("uuid of a degraded btrfs changed: %q", c)
+		}
+	}
+	if want := "mount -o noatime,ro,degraded " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+	if len(m.Result().Warnings) != 2 {
+		t.Errorf("warnings %q", m.Result().Warnings)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.RequireUUIDChange = true
+	if err := m.Start(); !errors.Is(err, ErrUUIDChangeUnsupported) {
+		t.Errorf("got %v, want %v", err, ErrUUIDChangeUnsupported)
+	}
+}
+
+// the mount table is read from mountinfo, a hung network mount cannot block
+// a mount(8) child there
+func TestIsMountRunsNothing(t *testing.T) {
+	f := newFakeRunner("")
+	useRunner(t, f)
+
+	if !IsMount(fakePath) || !IsMount(fakeDev) || IsMount("/mnt/other") {
+		t.Error("wrong mount table")
+	}
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Check(); err != nil {
+		t.Error(err)
+	}
+	if len(f.cmds) != 0 {
+		t.Errorf("ran %q", f.cmds)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+	scratch := t.TempDir()
+	lower := filepath.Join(scratch, ".lower")
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.OverlayScratch = scratch
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"mount -o noatime,ro " + fakeDev + " " + lower,
+		"mount -t overlay -o lowerdir=" + lower + ",upperdir=" + filepath.Join(scratch, "upper") +
+			",workdir=" + filepath.Join(scratch, "work") + " overlay " + fakePath,
+		"umount " + fakePath,
+		"umount " + lower,
+	}
+	if got := f.cmds[len(f.cmds)-4:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands\n got %q\nwant %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "upper")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestXFSDuplicateUUID(t *testing.T) {
+	f := newFakeRunner("SGI XFS filesystem data")
+	f.replies["mount -o rw,nouuid "+fakeDev+" "+fakePath] = fakeReply{32, "mount: /mnt/fake0: wrong fs type, bad option, bad superblock"}
+	f.replies["blkid -o device -t UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"] = fakeReply{0, fakeDev + "\n/dev/zero\n"}
+	useRunner(t, f)
+	// any device number works as the holder of the uuid, /dev/zero is 1:5
+	line := "101 1 1:5 / /mnt/orig rw shared:1 - xfs /dev/zero rw\n"
+	if err := ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	err := m.Start()
+	if !errors.Is(err, ErrXFSDuplicateUUID) || !strings.Contains(err.Error(), "/dev/zero") ||
+		!strings.Contains(err.Error(), "/mnt/orig") || !strings.Contains(err.Error(), "wrong fs type") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUMountDevice(t *testing.T) {
+	f := newFakeRunner("")
+	useRunner(t, f)
+	// /dev/zero stands in for a device mounted twice, the bind mount last
+	lines := "101 1 1:5 / /mnt/a rw shared:1 - xfs /dev/zero rw\n" +
+		"102 1 1:5 /sub /mnt/b rw shared:1 - xfs /dev/zero rw\n"
+	if err := ioutil.WriteFile(ProcMountInfo, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UMountDevice("/dev/zero"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"umount /mnt/b", "umount /mnt/a"}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+}
+
+func TestLUKSDetachedHeader(t *testing.T) {
+	const mapped = "/dev/mapper/newid-fake0"
+	f := newFakeRunner("data")
+	f.replies["cryptsetup luksDump --header /backup/hdr.img "+fakeDev] = fakeReply{0, "LUKS header information\nVersion:       \t2\n"}
+	f.replies["file -sL "+mapped] = fakeReply{0, mapped + ": Linux rev 1.0 ext4 filesystem data"}
+	f.replies["blkid -s UUID -o value "+mapped] = fakeReply{0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.LUKSHeader = "/backup/hdr.img"
+	m.LUKSKeyFile = "/backup/key"
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "cryptsetup open --type luks2 --key-file /backup/key --header /backup/hdr.img " + fakeDev + " newid-fake0"; f.cmds[1] != want {
+		t.Errorf("got %q, want %q", f.cmds[1], want)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "cryptsetup close newid-fake0" {
+		t.Errorf("not closed, last command %q", last)
+	}
+	if r := m.Result(); r.Dev != mapped || r.FS != FsExt4 {
+		t.Errorf("got %+v", r)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.LUKSKeyFile = ""
+	if err := m.Start(); err != ErrLUKSKey {
+		t.Errorf("got %v, want %v", err, ErrLUKSKey)
+	}
+}
+
+func TestMDRaid(t *testing.T) {
+	const md = "/dev/md/newid-fake0"
+	f := newFakeRunner("Linux Software RAID version 1.2 (1) UUID=6f1a9e2b:... level=1 disks=2")
+	f.replies["file -sL "+md] = fakeReply{0, md + ": Linux rev 1.0 ext4 filesystem data"}
+	f.replies["blkid -s UUID -o value "+md] = fakeReply{0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.ReadOnly = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mdadm --assemble --run --readonly " + md + " " + fakeDev; f.cmds[1] != want {
+		t.Errorf("got %q, want %q", f.cmds[1], want)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "mdadm --stop "+md {
+		t.Errorf("not stopped, last command %q", last)
+	}
+	if r := m.Result(); r.Dev != md || r.FS != FsExt4 {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestSync(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Sync, m.SyncOnUnmount = true, true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,sync " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	errs := m.WatchWritable(10*time.Millisecond, done)
+
+	// what the kernel shows after errors=remount-ro struck
+	line := "100 1 8:1 / " + fakePath + " rw,relatime shared:1 - ext4 " + fakeDev + " ro,errors=remount-ro\n"
+	if err := ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckWritable(); err != ErrRemountedRO {
+		t.Errorf("got %v, want %v", err, ErrRemountedRO)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrRemountedRO {
+			t.Errorf("watch: got %v, want %v", err, ErrRemountedRO)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("watch saw nothing")
+	}
+
+	m.ReadOnly = true
+	if err := m.CheckWritable(); err != nil {
+		t.Errorf("read-only mount: %v", err)
+	}
+}
+
+func TestUnmountExisting(t *testing.T) {
+	var lines []string
+	umounts := 0
+	// with gone false every umount succeeds but leaves the mount in place
+	gone := true
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		if cmdStr == "umount "+fakePath {
+			umounts++
+			if gone {
+				lines = lines[:len(lines)-1]
+			}
+			if err := ioutil.WriteFile(ProcMountInfo, []byte(strings.Join(lines, "")), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return 0, "", nil
+	}))
+	stack := func() {
+		lines = []string{
+			"100 1 8:1 / " + fakePath + " rw,relatime shared:1 - ext4 " + fakeDev + " rw\n",
+			"101 1 8:2 / " + fakePath + " rw,relatime shared:2 - ext4 /dev/fake1 rw\n",
+		}
+		if err := ioutil.WriteFile(ProcMountInfo, []byte(strings.Join(lines, "")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		umounts = 0
+	}
+
+	// /dev/null is mounted nowhere, only the path is taken
+	m := NewMounterWithArgs("/dev/null", fakePath, "")
+	m.ForceUnmountExisting = true
+	stack()
+	if err := m.unmountExisting(); err != nil || umounts != 2 {
+		t.Errorf("got %v after %d unmounts", err, umounts)
+	}
+
+	gone = false
+	stack()
+	if err := m.unmountExisting(); !errors.Is(err, ErrUMount) || umounts != 2 {
+		t.Errorf("got %v after %d unmounts, want %v", err, umounts, ErrUMount)
+	}
+}
+
+func TestXFSDBFallback(t *testing.T) {
+	f := newFakeRunner("SGI XFS filesystem data")
+	useRunner(t, f)
+	old := LookPath
+	LookPath = func(file string) (string, error) {
+		if file == string(CXFSAdmin) {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/sbin/" + file, nil
+	}
+	defer func() { LookPath = old }()
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.XFSUUIDMode = XFSUUIDGenerate
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "xfs_db -x -c uuid generate " + fakeDev; f.cmds[3] != want {
+		t.Errorf("got %q, want %q", f.cmds[3], want)
+	}
+
+	// the arguments are meant for xfs_admin
+	m = NewMounterWithArgs(fakeDev, fakePath, "")
+	m.XFSUUIDMode = XFSUUIDGenerate
+	m.ExtraChangeArgs = []string{"-f"}
+	if err := m.Start(); !errors.Is(err, ErrExtraArgs) {
+		t.Errorf("got %v, want %v", err, ErrExtraArgs)
+	}
+
+	// a runner splitting "uuid generate" cannot run xfs_db
+	f.cmds = nil
+	useRunner(t, RunnerFunc(f.Run))
+	if err := XFSDBSetUUID("generate", fakeDev); !errors.Is(err, ErrGenUUID) || len(f.cmds) != 0 {
+		t.Errorf("got %v after %q, want %v", err, f.cmds, ErrGenUUID)
+	}
+}
+
+func TestExecArgv(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	if _, out, err := ExecArgv("sh", "-c", "echo $0", "a b"); err != nil || out != "a b" {
+		t.Errorf("got %q, %v", out, err)
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	const uuid = "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"
+	f := &fakeRunner{replies: map[string]fakeReply{"blkid": {0, uuid}, "sudo": {0, uuid}}}
+	useRunner(t, f)
+
+	// only the mounter given the prefix escalates, also in one batch
+	base := t.TempDir()
+	skipCheck := func(m *DevMounter) { m.SkipCheck = true }
+	ms := []*DevMounter{
+		NewMounter("/dev/vg/a", filepath.Join(base, "a"), WithFS(FsExt4), WithCommandPrefix("sudo", "-n"), skipCheck),
+		NewMounter("/dev/vg/b", filepath.Join(base, "b"), WithFS(FsExt4), skipCheck),
+	}
+	if _, err := MountBatch(ms, len(ms)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range f.cmds {
+		if strings.Contains(c, "/dev/vg/a") != strings.HasPrefix(c, "sudo -n ") {
+			t.Errorf("ran %q", c)
+		}
+	}
+
+	f.cmds = nil
+	if err := UMount(fakePath); err != nil {
+		t.Fatal(err)
+	}
+	ms[0].env().ExecArgv("xfs_db", "-c", "uuid")
+	if want := []string{"umount " + fakePath, "sudo -n xfs_db -c uuid"}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+}
+
+func TestTag(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+	old := Utab
+	Utab = filepath.Join(t.TempDir(), "utab")
+	defer func() { Utab = old }()
+	utab := "SRC=/dev/sdb1 TARGET=/mnt/gone ROOT=/ OPTS=x-newid.owner=job-1\n" +
+		"SRC=" + fakeDev + " TARGET=" + fakePath + " ROOT=/ OPTS=x-newid.owner=job-1\n" +
+		"SRC=/dev/sdc1 TARGET=/mnt/other ROOT=/ OPTS=x-newid.owner=job-2\n"
+	if err := ioutil.WriteFile(Utab, []byte(utab), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Tag = "job-1"
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,x-newid.owner=job-1 " + fakeDev + " " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+
+	f.cmds = nil
+	if err := UMountTagged("job-1"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"umount " + fakePath}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.replies["umount "+fakePath] = fakeReply{r: 32}
+	var ce CleanupError
+	if err := m.Reset("/dev/fake1", "/mnt/fake1", ""); !errors.As(err, &ce) {
+		t.Errorf("got %v, want a CleanupError", err)
+	}
+	if m.args_.dev != fakeDev || len(m.cleanups_) == 0 {
+		t.Errorf("reset while still mounted, bound to %s", m.args_.dev)
+	}
+
+	delete(f.replies, "umount "+fakePath)
+	f.cmds = nil
+	if err := m.Reset("/dev/fake1", "/mnt/fake1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"umount " + fakePath}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+	if m.args_.dev != "/dev/fake1" || len(m.cleanups_) != 0 {
+		t.Errorf("got %s with %d cleanups", m.args_.dev, len(m.cleanups_))
+	}
+}
+
+func TestBindPaths(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.BindPaths = []string{"/srv/a", "/srv/b"}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := "100 1 8:1 / " + fakePath + " rw shared:1 - ext4 " + fakeDev + " rw\n" +
+		"101 1 8:1 / /srv/a rw shared:1 - ext4 " + fakeDev + " rw\n" +
+		"102 1 8:1 / /srv/b rw shared:1 - ext4 " + fakeDev + " rw\n"
+	if err := ioutil.WriteFile(ProcMountInfo, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.cmds = nil
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"umount /srv/b", "umount /srv/a", "umount " + fakePath}; !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+
+	f.cmds = nil
+	m.Reset(fakeDev, fakePath, "")
+	f.replies["mount --bind "+fakePath+" /srv/b"] = fakeReply{32, "mount: /srv/b: mount point does not exist."}
+	if err := m.Start(); !errors.Is(err, ErrMount) {
+		t.Fatalf("got %v, want %v", err, ErrMount)
+	}
+	want := []string{
+		"mount -o noatime " + fakeDev + " " + fakePath,
+		"mount --bind " + fakePath + " /srv/a",
+		"mount --bind " + fakePath + " /srv/b",
+	}
+	if got := f.cmds[len(f.cmds)-3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCleanupStale(t *testing.T) {
+	f := newFakeRunner("")
+	dir := t.TempDir()
+	cow := filepath.Join(dir, "newid-cow-1")
+	if err := ioutil.WriteFile(cow, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.replies["losetup -l -n -O NAME,BACK-FILE"] = fakeReply{0, "/dev/loop3 /images/disk.img\n/dev/loop4 " + cow + "\n"}
+	f.replies["dmsetup deps -o devname newid-fake0"] = fakeReply{0, "1 dependencies\t: (newid-snap-loop3p1)\n"}
+	f.replies["dmsetup deps -o devname newid-snap-loop3p1"] = fakeReply{0, "2 dependencies\t: (loop4) (loop3p1)\n"}
+	useRunner(t, f)
+	mountinfo := "100 1 253:2 / /mnt/luks rw shared:1 - ext4 /dev/mapper/newid-fake0 rw\n" +
+		"101 1 7:3 / /mnt/plain rw shared:1 - ext4 /dev/loop3p2 rw\n"
+	if err := ioutil.WriteFile(ProcMountInfo, []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := Utab
+	Utab = filepath.Join(dir, "utab")
+	defer func() { Utab = old }()
+	utab := "SRC=/dev/mapper/newid-fake0 TARGET=/mnt/luks ROOT=/ OPTS=x-newid.owner=job-1\n"
+	if err := ioutil.WriteFile(Utab, []byte(utab), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanupStale("job-1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"losetup -l -n -O NAME,BACK-FILE",
+		"umount /mnt/luks",
+		"dmsetup deps -o devname newid-fake0",
+		"cryptsetup close newid-fake0",
+		"dmsetup deps -o devname newid-snap-loop3p1",
+		"dmsetup remove newid-snap-loop3p1",
+		"losetup -d /dev/loop4",
+	}
+	// loop3 stays, its second partition is mounted with no tag
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("got %q, want %q", f.cmds, want)
+	}
+	if _, err := os.Stat(cow); !os.IsNotExist(err) {
+		t.Errorf("the copy-on-write file is left: %v", err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	f := newFakeRunner("")
+	f.replies["blkid -s TYPE -o value "+fakeDev] = fakeReply{0, "swap"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	if err := m.Start(); err != ErrSwap {
+		t.Fatalf("got %v, want %v", err, ErrSwap)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.SwapOn = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.cmds[len(f.cmds)-2:]; !reflect.DeepEqual(got, []string{"swapon " + fakeDev, "swapoff " + fakeDev}) {
+		t.Errorf("got %q", got)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.RequireUUIDChange = true
+	if err := m.Start(); !errors.Is(err, ErrUUIDChangeUnsupported) {
+		t.Errorf("got %v, want %v", err, ErrUUIDChangeUnsupported)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	f := newFakeRunner("")
+	useRunner(t, f)
+
+	m := NewMounter(fakeDev, "", WithFS(FsXFS_))
+	if err := m.BindArgs(); err != nil {
+		t.Fatal(err)
+	}
+	f.cmds = nil
+	if err := m.ReplayJournal(); err != nil {
+		t.Fatal(err)
+	}
+	// unmounted at the temporary directory, not wherever else the device is
+	if len(f.cmds) != 2 || !strings.HasPrefix(f.cmds[0], "mount -o rw,nouuid "+fakeDev+" ") ||
+		f.cmds[1] != "umount "+strings.Fields(f.cmds[0])[4] {
+		t.Errorf("got %q", f.cmds)
+	}
+
+	m.fs = FsNTFs
+	if err := m.ReplayJournal(); err != ErrUnsFs {
+		t.Errorf("got %v, want %v", err, ErrUnsFs)
+	}
+}
+
+func TestFileFSType(t *testing.T) {
+	for _, c := range []struct {
+		dev, out string
+		want     FileSystemType
+	}{
+		{"/dev/sdb1", "/dev/sdb1: Linux rev 1.0 ext4 filesystem data, UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4, " +
+			"volume name \"xfs-backup\" (extents) (64bit) (large files) (huge files)", FsExt4},
+		{"/dev/sdb1", "/dev/sdb1: Linux rev 1.0 ext3 filesystem data, UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4 " +
+			"(needs journal recovery) (large files)", FsExt3},
+		{"/dev/sdb1", "/dev/sdb1: Linux rev 1.0 ext2 filesystem data (mounted or unclean), UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", FsExt2},
+		{"/tmp/xfs.img", "/tmp/xfs.img: Linux rev 1.0 ext4 filesystem data, UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", FsExt4},
+		{"/dev/sdc1", "/dev/sdc1: SGI XFS filesystem data (blksz 4096, inosz 512, v2 dirs)", FsXFS_},
+		{"/dev/sdc1", "/dev/sdc1: SGI XFS filesystem version 5", FsXFS_},
+		{"/dev/sdd1", "/dev/sdd1: DOS/MBR boot sector, code offset 0x52, OEM-ID \"NTFS    \", sectors/cluster 8, " +
+			"Media descriptor 0xf8, sectors/track 63, heads 255, hidden sectors 2048, dos < 4.0 BootSector (0x80), " +
+			"FAT (1Y bit by descriptor); NTFS, sectors/track 63, physical drive 0x80, sectors 204799, " +
+			"$MFT start cluster 4, $MFTMirror start cluster 12799, serial number 05c3bd5c1113eb8e8; contains bootstrap BOOTMGR", FsNTFs},
+		{"/dev/sde1", "/dev/sde1: BTRFS Filesystem label \"ext4-old\", sectorsize 4096, nodesize 16384, leafsize 16384, " +
+			"UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4, 1048576/1073741824 bytes used, 1 devices", FsBtrfs},
+		{"/dev/sdf1", "/dev/sdf1: Linux rev 1.0 ext4filesystem-like data", ""},
+		{"/dev/sdf1", "/dev/sdf1: data", ""},
+	} {
+		if got := fileFSType(c.dev, c.out); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.out, got, c.want)
+		}
+	}
+}
+
+func TestSupportMatrix(t *testing.T) {
+	got := map[FileSystemType]FSSupport{}
+	for _, s := range SupportMatrix() {
+		got[s.FS] = s
+	}
+	if s := got[FsXFS_]; !s.Detect || !s.Mount || !s.ChangeUUID {
+		t.Errorf("xfs %+v", s)
+	}
+	if s := got[FsZFS]; !s.Mount || s.ChangeUUID {
+		t.Errorf("zfs %+v", s)
+	}
+	if s := got[FsSwap]; !s.Detect || s.Mount {
+		t.Errorf("swap %+v", s)
+	}
+	if s := got[FsHFSPlus]; !s.Mount || s.ChangeUUID {
+		t.Errorf("hfsplus %+v", s)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Quota = "usrquota,grpquota"
+	m.EnableQuota = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"mount -o noatime,usrquota,grpquota " + fakeDev + " " + fakePath,
+		"quotacheck -cugm " + fakePath,
+		"quotaon " + fakePath,
+	}
+	if got := f.cmds[len(f.cmds)-3:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	f = newFakeRunner("SGI XFS filesystem data")
+	useRunner(t, f)
+	m = NewMounterWithArgs(fakeDev, fakePath, "")
+	m.Quota = "usrquota"
+	m.FS = FsBtrfs
+	if err := m.Start(); !errors.Is(err, ErrQuotaUnsupported) {
+		t.Errorf("got %v, want %v", err, ErrQuotaUnsupported)
+	}
+}
+
+func TestExportNFS(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.NFSExportClient = "10.0.0.0/24"
+	m.NFSExportOptions = "ro,no_subtree_check"
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "exportfs -o ro,no_subtree_check 10.0.0.0/24:" + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+
+	f.cmds = nil
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "exportfs -u 10.0.0.0/24:" + fakePath; len(f.cmds) == 0 || f.cmds[0] != want {
+		t.Errorf("closed with %q, want %q first", f.cmds, want)
+	}
+}
+
+func TestPostMountCmd(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["sha256sum -c "+fakePath+"/SUMS"] = fakeReply{1, "a: FAILED"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.PostMountCmd = []string{"sha256sum", "-c", "{}/SUMS"}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.Result().Verify; v == nil || v.Exit != 1 || v.Output != "a: FAILED" || len(m.Result().Warnings) != 1 {
+		t.Errorf("got %+v, warnings %q", v, m.Result().Warnings)
+	}
+
+	f.cmds = nil
+	m.Reset(fakeDev, fakePath, "")
+	m.StrictVerify = true
+	if err := m.Start(); !errors.Is(err, ErrVerify) {
+		t.Errorf("got %v, want %v", err, ErrVerify)
+	}
+	if c := f.cmds[len(f.cmds)-1]; c != "umount "+fakePath {
+		t.Errorf("not unmounted, last ran %q", c)
+	}
+
+	m.Reset(fakeDev, fakePath, "")
+	m.PostMountCmd = []string{"ls"}
+	if argv := m.postMountArgv(); strings.Join(argv, " ") != "ls "+fakePath {
+		t.Errorf("got %q", argv)
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "result.json")
+	if err := ioutil.WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteResult(file, &MountResult{Dev: fakeDev, Path: fakePath, FS: FsExt4}); err != nil {
+		t.Fatal(err)
+	}
+	var r MountResult
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &r); err != nil || r.Dev != fakeDev || r.FS != FsExt4 {
+		t.Errorf("got %+v, %v", r, err)
+	}
+	if left, _ := filepath.Glob(file + ".*"); len(left) != 0 {
+		t.Errorf("temporary files left: %q", left)
+	}
+}
+
+func TestListBtrfsSubvolumes(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"btrfs": {0, "ID 256 gen 10 parent 5 top level 5 parent_uuid - uuid 6d2c41a0-0000-4000-8000-000000000001 path @home\n" +
+			"ID 258 gen 12 parent 256 top level 256 parent_uuid 6d2c41a0-0000-4000-8000-000000000001 uuid 9f1e0000-0000-4000-8000-000000000002 path @home/.snapshots/1 day\n"},
+	}}
+	useRunner(t, f)
+
+	subvols, err := ListBtrfsSubvolumes(fakeDev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BtrfsSubvol{
+		{ID: 256, Parent: 5, Path: "@home", UUID: "6d2c41a0-0000-4000-8000-000000000001"},
+		{ID: 258, Parent: 256, Path: "@home/.snapshots/1 day", UUID: "9f1e0000-0000-4000-8000-000000000002", ParentUUID: "6d2c41a0-0000-4000-8000-000000000001"},
+	}
+	if !reflect.DeepEqual(subvols, want) || subvols[0].Snapshot() || !subvols[1].Snapshot() {
+		t.Errorf("got %+v", subvols)
+	}
+	if len(f.cmds) != 3 || !strings.HasPrefix(f.cmds[0], "mount -o ro,subvolid=5 "+fakeDev+" ") || !strings.HasPrefix(f.cmds[2], "umount ") {
+		t.Errorf("ran %q", f.cmds)
+	}
+}
+
+func TestMountExitError(t *testing.T) {
+	for _, c := range []struct {
+		caller Caller_
+		code   int
+		out    string
+		want   error
+	}{
+		{CMount, 1, "mount: only root can do that", ErrMountPermission},
+		{CMount, 32, "mount: /mnt/fake0: wrong fs type, bad option, bad superblock", ErrMountFailure},
+		{CMount, 32, "mount: /mnt/fake0: /dev/fake0 already mounted on /mnt/a.", ErrMountAlreadyMounted},
+		{CNTFs3g, 32, "", nil},
+	} {
+		err := mountExitError(ErrMount, c.caller, c.code, c.out)
+		var e *MountExitError
+		if !errors.Is(err, ErrMount) || !errors.As(err, &e) || e.Code != c.code || e.Kind != c.want {
+			t.Errorf("%s exit %d: got %v", c.caller, c.code, err)
+		}
+		if c.want != nil && !errors.Is(err, c.want) {
+			t.Errorf("%s exit %d: %v is not %v", c.caller, c.code, err, c.want)
+		}
+	}
+}
+
+func TestStartVerified(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	verified := ""
+	if err := m.StartVerified(func(p string) error { verified = f.cmds[len(f.cmds)-1]; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mount -o noatime,ro " + fakeDev + " " + fakePath; verified != want {
+		t.Errorf("verified after %q, want %q", verified, want)
+	}
+	if want := "mount -o remount,rw " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+	if m.ReadOnly {
+		t.Errorf("ReadOnly left set")
+	}
+
+	f.cmds = nil
+	m.Reset(fakeDev, fakePath, "")
+	errBad := errors.New("bad checksum")
+	if err := m.StartVerified(func(string) error { return errBad }); err != errBad {
+		t.Errorf("got %v, want %v", err, errBad)
+	}
+	for _, c := range f.cmds {
+		if strings.Contains(c, "remount") {
+			t.Errorf("remounted after a failed verification: %q", c)
+		}
+	}
+
+	// only the mount is read-only, the luks mapping has to take the remount
+	const mapped = "/dev/mapper/newid-fake0"
+	f = newFakeRunner("LUKS encrypted file, ver 2")
+	f.replies["cryptsetup luksDump "+fakeDev] = fakeReply{0, "LUKS header information\nVersion:       \t2\n"}
+	f.replies["file -sL "+mapped] = fakeReply{0, mapped + ": Linux rev 1.0 ext4 filesystem data"}
+	f.replies["blkid -s UUID -o value "+mapped] = fakeReply{0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"}
+	useRunner(t, f)
+	m = NewMounterWithArgs(fakeDev, fakePath, "")
+	m.LUKSKeyFile = "/backup/key"
+	m.Sync = true
+	if err := m.StartVerified(nil); err != nil {
+		t.Fatal(err)
+	}
+	ran := strings.Join(f.cmds, "\n")
+	if want := "cryptsetup open --type luks2 --key-file /backup/key " + fakeDev + " newid-fake0"; !strings.Contains(ran, want) {
+		t.Errorf("%q not run, ran %q", want, f.cmds)
+	}
+	if !strings.Contains(ran, "tune2fs -U") {
+		t.Errorf("uuid kept, ran %q", f.cmds)
+	}
+	if want := "mount -o noatime,ro,sync " + mapped + " " + fakePath; !strings.Contains(ran, want) {
+		t.Errorf("%q not run, ran %q", want, f.cmds)
+	}
+	if want := "mount -o remount,rw " + fakePath; f.cmds[len(f.cmds)-1] != want {
+		t.Errorf("got %q, want %q", f.cmds[len(f.cmds)-1], want)
+	}
+}
+
+// the steps writing to the mount follow the remount
+func TestStartVerifiedWrites(t *testing.T) {
+	const orig = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	for _, c := range []struct {
+		name  string
+		setup func(m *DevMounter)
+		// the command writing to the mount, none for the xattr
+		write string
+	}{
+		{"xattr", func(m *DevMounter) { m.RecordOriginalUUID = true }, ""},
+		{"quota", func(m *DevMounter) { m.Quota, m.EnableQuota = "usrquota", true }, "quotacheck"},
+		{"resize", func(m *DevMounter) { m.ResizeToFill = true }, "resize2fs"},
+	} {
+		f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+		f.replies["blkid -s UUID -o value "+fakeDev] = fakeReply{0, orig}
+		useRunner(t, f)
+		dir := t.TempDir()
+		line := "100 1 8:1 / " + dir + " rw,relatime shared:1 - ext4 " + fakeDev + " rw\n"
+		if err := ioutil.WriteFile(ProcMountInfo, []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		m := NewMounterWithArgs(fakeDev, dir, "")
+		c.setup(m)
+		verified := 0
+		if err := m.StartVerified(func(p string) error {
+			verified = len(f.cmds)
+			if _, err := OriginalUUID(p); err == nil {
+				t.Errorf("%s: original uuid recorded before the remount", c.name)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if want := "mount -o remount,rw " + dir; verified >= len(f.cmds) || f.cmds[verified] != want {
+			t.Errorf("%s: %q after the verification, want %q", c.name, f.cmds[verified:], want)
+		}
+		for _, cmd := range f.cmds[:verified] {
+			if c.write != "" && strings.HasPrefix(cmd, c.write) {
+				t.Errorf("%s: %q before the remount", c.name, cmd)
+			}
+		}
+		if u, err := OriginalUUID(dir); m.RecordOriginalUUID && (err != nil || u != orig) {
+			t.Errorf("%s: got %q, %v, want %q", c.name, u, err, orig)
+		}
+	}
+}
+
+func TestTreeChecksum(t *testing.T) {
+	tree := func() string {
+		dir := t.TempDir()
+		for p, c := range map[string]string{"a/b.txt": "b", "c.txt": "c", "cache/x": "x"} {
+			if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(c), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("c.txt", filepath.Join(dir, "d")); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	src, dst := tree(), tree()
+
+	m := NewMounterWithArgs(fakeDev, src, "")
+	want, err := m.TreeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewMounterWithArgs(fakeDev, dst, "")
+	m.ChecksumWorkers = 4
+	if got, err := m.TreeChecksum(); err != nil || got != want {
+		t.Errorf("got %s %v, want %s", got, err, want)
+	}
+	if m.Result().Checksum != want {
+		t.Errorf("result has %q", m.Result().Checksum)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dst, "cache/x"), []byte("y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.TreeChecksum(); got == want {
+		t.Error("a changed file gives the same checksum")
+	}
+	m.ChecksumExclude = []string{"cache"}
+	excl, _ := m.TreeChecksum()
+	m = NewMounterWithArgs(fakeDev, src, "")
+	m.ChecksumExclude = []string{"cache/"}
+	if got, _ := m.TreeChecksum(); got != excl {
+		t.Errorf("got %s, want %s with cache excluded", got, excl)
+	}
+}
+
+func TestCrossCheckFS(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["blkid -s TYPE -o value "+fakeDev] = fakeReply{0, "ext3"}
+	auto := "mount -t auto -o ro " + fakeDev + " "
+	var info string
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		if strings.HasPrefix(cmdStr, auto) {
+			line := "101 1 8:1 / " + strings.TrimPrefix(cmdStr, auto) + " ro shared:1 - ext3 " + fakeDev + " ro\n"
+			if err := ioutil.WriteFile(info, []byte(line), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f.Run(cmdStr)
+	}))
+	info = ProcMountInfo
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.CrossCheckFS = true
+	if err := m.BindArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if m.fs != FsExt3 || len(m.warnings_) != 2 {
+		t.Errorf("got %s, warnings %q", m.fs, m.warnings_)
+	}
+
+	// blkid wins when the kernel cannot tell
+	f.replies["blkid -s TYPE -o value "+fakeDev] = fakeReply{0, "xfs"}
+	f.replies["mount"] = fakeReply{32, "mount: wrong fs type"}
+	m.Reset(fakeDev, fakePath, "")
+	if err := m.BindArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if m.fs != FsXFS_ {
+		t.Errorf("got %s, want %s", m.fs, FsXFS_)
+	}
+}
+
+func TestUnmountNative(t *testing.T) {
+	m := NewMounterWithArgs(fakeDev, t.TempDir(), "")
+	// nothing is mounted there, umount2 gives EINVAL, or EPERM for a user
+	if err := m.Unmount(syscall.MNT_DETACH); !errors.Is(err, ErrUMount) {
+		t.Errorf("got %v, want %v", err, ErrUMount)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "img")
+	if err := ioutil.WriteFile(img, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMounterWithArgs(img, fakePath, "")
+	m.warmCache()
+	m.WarmCache = true
+	m.warmCache()
+	if len(m.warnings_) != 0 {
+		t.Errorf("a short image warns: %q", m.warnings_)
+	}
+
+	m.Reset(img+".gone", fakePath, "")
+	m.warmCache()
+	if len(m.warnings_) != 1 {
+		t.Errorf("got %q", m.warnings_)
+	}
+}
+
+func TestProbeReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	img, nbd := filepath.Join(dir, "disk.qcow2"), filepath.Join(dir, "nbd0")
+	for _, p := range []string{img, nbd} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := freeNBD
+	freeNBD = func(cmdEnv) (string, error) { return nbd, nil }
+	defer func() { freeNBD = old }()
+	f := newFakeRunner("")
+	f.replies["file -sL "+img] = fakeReply{0, img + ": QEMU QCOW2 Image (v3)"}
+	f.replies["file -sL "+nbd] = fakeReply{0, nbd + ": Linux rev 1.0 ext4 filesystem data"}
+	f.replies["blkid -s TYPE -o value "+nbd] = fakeReply{0, "ext3"}
+	f.replies["file -sL /dev/md/newid-fake0"] = fakeReply{0, "Linux rev 1.0 ext4 filesystem data"}
+	useRunner(t, f)
+
+	for _, m := range []*DevMounter{
+		NewMounter(img, "", func(m *DevMounter) { m.CrossCheckFS = true }),
+		NewMounter(fakeDev, "", func(m *DevMounter) { m.MDMembers = []string{"/dev/fake1"} }),
+	} {
+		if _, err := m.Probe(); err != nil {
+			t.Fatal(err)
+		}
+		m.Close()
+		if m.ReadOnly || m.LoopReadOnly {
+			t.Error("probe left the mounter read-only")
+		}
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") || strings.HasPrefix(c, "xfs_admin") || strings.HasPrefix(c, "mount -t auto") ||
+			(strings.HasPrefix(c, "qemu-nbd --connect") && !strings.Contains(c, "--read-only")) ||
+			(strings.HasPrefix(c, "mdadm --assemble") && !strings.Contains(c, "--readonly")) ||
+			(strings.HasPrefix(c, "mount") && !strings.Contains(c, "-o ro")) {
+			t.Errorf("probe ran %q", c)
+		}
+	}
+	ran := strings.Join(f.cmds, "\n")
+	if !strings.Contains(ran, "--read-only "+img) || !strings.Contains(ran, "mdadm --assemble --run --readonly") {
+		t.Errorf("got %q", f.cmds)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the failures told apart by the exit code of util-linux mount and umount
+var (
+	ErrMountPermission     = errors.New("incorrect invocation or permissions")
+	ErrMountSystem         = errors.New("system error, e.g. out of memory or no free loop device")
+	ErrMountFailure        = errors.New("mount failure")
+	ErrMountAlreadyMounted = errors.New("already mounted")
+)
+
+// MountExitError is a failed mount or umount, it is ErrMount or ErrUMount
+// for errors.Is as well as the Kind told by its exit code, nil for the exit
+// codes of other helpers such as ntfs-3g, which mean something else. A
+// byte swapped superblock gives ErrWrongEndian as the Kind instead
+type MountExitError struct {
+	Op     error
+	Kind   error
+	Code   int
+	Output string
+}
+
+func (e *MountExitError) Error() string {
+	msg := fmt.Sprintf("%v: exit code %d", e.Op, e.Code)
+	if e.Kind != nil {
+		msg = fmt.Sprintf("%v: %v, exit code %d", e.Op, e.Kind, e.Code)
+	}
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	return msg
+}
+
+func (e *MountExitError) Unwrap() error { return e.Kind }
+
+func (e *MountExitError) Is(target error) bool { return target == e.Op }
+
+// mountExitError wraps op, ErrMount or ErrUMount, with what the exit code r
+// of c means
+func mountExitError(op error, c Caller_, r int, out string) error {
+	e := &MountExitError{Op: op, Code: r, Output: strings.TrimSpace(out)}
+	if c != CMount && c != CUMount {
+		return e
+	}
+	switch r {
+	case 1:
+		e.Kind = ErrMountPermission
+	case 2:
+		e.Kind = ErrMountSystem
+	case 32:
+		e.Kind = ErrMountFailure
+		if strings.Contains(out, "already mounted") {
+			e.Kind = ErrMountAlreadyMounted
+		}
+	}
+	return e
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ProcMountInfo lists the mounts of this process, unlike mount(8) its paths are exact
+var ProcMountInfo = "/proc/self/mountinfo"
+
+var ErrMountInfo = errors.New("failed to parse the mountinfo")
+
+// MountEntry is one line of /proc/self/mountinfo
+type MountEntry struct {
+	ID           int
+	ParentID     int
+	Major        uint32
+	Minor        uint32
+	Root         string
+	MountPoint   string
+	Options      []string
+	FSType       string
+	Source       string
+	SuperOptions []string
+}
+
+// MountsForDevice returns every mount point of dev with its options,
+// an unmounted device gives an empty list
+func MountsForDevice(dev string) (entries []MountEntry, err error) {
+	major, minor, err := DeviceNumber(dev)
+	if err != nil {
+		return nil, err
+	}
+	real_, _ := filepath.EvalSymlinks(dev)
+
+	all, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range all {
+		// fuse mounts such as ntfs-3g carry an anonymous device number
+		if (e.Major == major && e.Minor == minor) || SameDevPath(e.Source, dev) || (real_ != "" && e.Source == real_) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// MountEntryAt returns the topmost mount on path, nil when nothing is mounted there
+func MountEntryAt(path_ string) (entry *MountEntry, err error) {
+	entries, err := MountEntriesAt(path_)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[len(entries)-1], nil
+}
+
+// MountEntriesAt returns every mount stacked on path, the topmost last
+func MountEntriesAt(path_ string) (entries []MountEntry, err error) {
+	if abs, err := filepath.Abs(path_); err == nil {
+		path_ = abs
+	}
+	all, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range all {
+		if e.MountPoint == path_ {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// IsMount reports whether path_ is a mount point, or a device mounted somewhere.
+// A logical volume matches in both its /dev/vg/lv and /dev/mapper/vg-lv form
+func IsMount(path_ string) bool {
+	all, err := ReadMountInfo()
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path_)
+	if err != nil {
+		abs = path_
+	}
+	for _, e := range all {
+		if e.MountPoint == abs || SameDevPath(e.Source, path_) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPathMounted reports whether something is mounted exactly at path_
+func IsPathMounted(path_ string) bool {
+	e, err := MountEntryAt(path_)
+	return err == nil && e != nil
+}
+
+// HasOption reports whether opt is one of the per mount options
+func (e *MountEntry) HasOption(opt string) bool {
+	for _, o := range e.Options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceNumber returns the major:minor of a block device
+func DeviceNumber(dev string) (major, minor uint32, err error) {
+	fi, err := os.Stat(dev)
+	if err != nil {
+		return 0, 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeDevice == 0 {
+		return 0, 0, fmt.Errorf("%s is not a device", dev)
+	}
+	rdev := uint64(st.Rdev)
+	major = uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+	minor = uint32(rdev&0xff | (rdev>>12)&^0xff)
+	return major, minor, nil
+}
+
+func ReadMountInfo() (entries []MountEntry, err error) {
+	f, err := os.Open(ProcMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e, err := parseMountInfoLine(s.Text())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfoLine(line string) (e MountEntry, err error) {
+	fs := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fs); i++ {
+		if fs[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fs) < sep+4 {
+		return e, ErrMountInfo
+	}
+
+	if e.ID, err = strconv.Atoi(fs[0]); err != nil {
+		return e, ErrMountInfo
+	}
+	if e.ParentID, err = strconv.Atoi(fs[1]); err != nil {
+		return e, ErrMountInfo
+	}
+	if _, err = fmt.Sscanf(fs[2], "%d:%d", &e.Major, &e.Minor); err != nil {
+		return e, ErrMountInfo
+	}
+	e.Root = unescapeMountInfo(fs[3])
+	e.MountPoint = unescapeMountInfo(fs[4])
+	e.Options = SplitMountOptions(fs[5])
+	e.FSType = fs[sep+1]
+	e.Source = unescapeMountInfo(fs[sep+2])
+	e.SuperOptions = SplitMountOptions(fs[sep+3])
+	return e, nil
+}
+
+// the kernel escapes space, tab, newline and backslash as \ooo
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type ImageFormat string
+
+const (
+	ImageQCOW2 ImageFormat = "qcow2"
+	ImageVMDK  ImageFormat = "vmdk"
+)
+
+const (
+	CQemuNBD  Caller_ = "qemu-nbd"
+	CModprobe Caller_ = "modprobe"
+
+	NBDWaitTimeout = 5 * time.Second
+)
+
+var (
+	ErrNoNBD      = errors.New("no free nbd device")
+	ErrNBDConnect = errors.New("failed to connect the image to an nbd device")
+)
+
+// imageFormat recognizes virtual disk images in the output of `file -sL`
+func imageFormat(fileOut string) ImageFormat {
+	if strings.Contains(fileOut, "qemu qcow") {
+		return ImageQCOW2
+	} else if strings.Contains(fileOut, "vmware4 disk image") || strings.Contains(fileOut, "vmdk") {
+		return ImageVMDK
+	}
+	return ""
+}
+
+// FreeNBD returns the first nbd device not connected, loading the nbd
+// module with partition support when needed
+func FreeNBD() (dev string, err error) {
+	return cmdEnv{}.FreeNBD()
+}
+
+func (x cmdEnv) FreeNBD() (dev string, err error) {
+	if _, err = os.Stat("/sys/block/nbd0"); os.IsNotExist(err) {
+		x.ExecCmd(fmt.Sprintf("%s nbd max_part=16", CModprobe))
+	}
+	for i := 0; ; i++ {
+		sys := fmt.Sprintf("/sys/block/nbd%d", i)
+		if _, err = os.Stat(sys); err != nil {
+			return "", ErrNoNBD
+		}
+		// pid only exists while connected
+		if _, err = os.Stat(sys + "/pid"); os.IsNotExist(err) {
+			return fmt.Sprintf("/dev/nbd%d", i), nil
+		}
+	}
+}
+
+// freeNBD finds the nbd device to connect, replace it to fake one
+var freeNBD = cmdEnv.FreeNBD
+
+// NBDConnectFree connects image to the first free nbd device, a concurrent
+// attach cannot take the same one
+func NBDConnectFree(image string, format ImageFormat) (nbd string, err error) {
+	return cmdEnv{}.NBDConnectFree(image, format)
+}
+
+func (x cmdEnv) NBDConnectFree(image string, format ImageFormat) (nbd string, err error) {
+	return x.nbdConnectFree(image, format, false)
+}
+
+func (x cmdEnv) nbdConnectFree(image string, format ImageFormat, readOnly bool) (nbd string, err error) {
+	attachMu.Lock()
+	defer attachMu.Unlock()
+	if nbd, err = freeNBD(x); err != nil {
+		return "", err
+	}
+	if err = x.nbdConnect(nbd, image, format, readOnly); err != nil {
+		return "", err
+	}
+	return nbd, nil
+}
+
+func NBDConnect(nbd, image string, format ImageFormat) (err error) {
+	return cmdEnv{}.NBDConnect(nbd, image, format)
+}
+
+func (x cmdEnv) NBDConnect(nbd, image string, format ImageFormat) (err error) {
+	return x.nbdConnect(nbd, image, format, false)
+}
+
+func (x cmdEnv) nbdConnect(nbd, image string, format ImageFormat, readOnly bool) (err error) {
+	args := fmt.Sprintf("--connect=%s -f %s", nbd, format)
+	if readOnly {
+		args += " --read-only"
+	}
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s %s %s", CQemuNBD, args, image)); r != 0 {
+		return ErrNBDConnect
+	}
+	return nil
+}
+
+func NBDDisconnect(nbd string) (err error) {
+	return cmdEnv{}.NBDDisconnect(nbd)
+}
+
+func (x cmdEnv) NBDDisconnect(nbd string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -d %s", CQemuNBD, nbd)); r != 0 {
+		return fmt.Errorf("failed to disconnect %s", nbd)
+	}
+	return nil
+}
+
+// attachImage connects the image to an nbd device, which, or its partition
+// NBDPartition, replaces the image as the device to mount. LoopReadOnly
+// connects it read-only
+func (m *DevMounter) attachImage(format ImageFormat) (err error) {
+	nbd, err := m.env().nbdConnectFree(m.args_.dev, format, m.LoopReadOnly)
+	if err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().NBDDisconnect(nbd) })
+
+	dev := nbd
+	if m.NBDPartition > 0 {
+		dev = fmt.Sprintf("%sp%d", nbd, m.NBDPartition)
+	}
+	// partitions show up once the kernel has read the table
+	for deadline := time.Now().Add(NBDWaitTimeout); ; time.Sleep(100 * time.Millisecond) {
+		if _, err = os.Stat(dev); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not show up: %w", dev, err)
+		}
+	}
+
+	m.image_ = m.args_.dev
+	m.args_.dev = dev
+	m.roLoop_ = m.LoopReadOnly
+	return nil
+}
+
+// sourceDev is the device, or image, the mounter was given
+func (m *DevMounter) sourceDev() string {
+	if m.image_ != "" {
+		return m.image_
+	}
+	// luks on md is the common order
+	if m.md_ != "" {
+		return m.md_
+	}
+	if m.luks_ != "" {
+		return m.luks_
+	}
+	if m.snap_ != "" {
+		return m.snap_
+	}
+	return m.args_.dev
+}
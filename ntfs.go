@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ProcFilesystems = "/proc/filesystems"
+
+var ErrNTFSDriver = errors.New("invalid ntfs driver, expect auto, ntfs3, ntfs or ntfs-3g")
+
+type NTFSDriver string
+
+const (
+	NTFSAuto   NTFSDriver = "auto"
+	NTFSKernel NTFSDriver = "ntfs3"
+	NTFSFuse   NTFSDriver = "ntfs-3g"
+	// the kernel driver before ntfs3, mount -t ntfs, read-only on most
+	// kernels. Newer kernels may hand it to ntfs3 as well
+	NTFSLegacy NTFSDriver = "ntfs"
+)
+
+// HasNTFs3 reports whether the running kernel can mount ntfs3, either
+// registered already or as a module mount would load
+func HasNTFs3() bool {
+	if KernelHasFS(string(FsNTFs3)) {
+		return true
+	}
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join("/lib/modules", strings.TrimSpace(string(release)), "kernel/fs/ntfs3"))
+	return err == nil
+}
+
+// KernelHasFS looks fs up in /proc/filesystems
+func KernelHasFS(fs string) bool {
+	f, err := os.Open(ProcFilesystems)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// "nodev\tproc" or "\text4"
+		fields := strings.Fields(s.Text())
+		if len(fields) != 0 && fields[len(fields)-1] == fs {
+			return true
+		}
+	}
+	return false
+}
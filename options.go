@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kr/pretty"
+)
+
+// Option configures a DevMounter built by NewMounter
+type Option func(m *DevMounter)
+
+// Logger receives the warnings of a DevMounter
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+type LoggerFunc func(format string, args ...interface{})
+
+func (f LoggerFunc) Logf(format string, args ...interface{}) {
+	f(format, args...)
+}
+
+var DefaultLogger Logger = LoggerFunc(pretty.Logf)
+
+// NewMounter is NewMounterWithArgs with options instead of assigning fields,
+// e.g. NewMounter(dev, path, WithReadOnly(), WithFS(FsXFS_))
+func NewMounter(dev, path_ string, opts ...Option) *DevMounter {
+	m := NewMounterWithArgs(dev, path_, "")
+	for _, o := range opts {
+		o(m)
+	}
+	return m
+}
+
+// NewMounterFromFd mounts the device open as fd, for callers that may not
+// open it by path. The external tools reach it through /proc/<pid>/fd/<fd>
+// of this process, /proc/self would name their own fd table. The fd has to
+// stay open until Close returned, closing it earlier leaves a dangling path
+func NewMounterFromFd(fd int, path_ string, opts ...Option) *DevMounter {
+	return NewMounter(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd), path_, opts...)
+}
+
+func WithReadOnly() Option {
+	return func(m *DevMounter) { m.ReadOnly = true }
+}
+
+// WithMountOptions adds options to the mount, see MountDefaults
+func WithMountOptions(opts ...string) Option {
+	return func(m *DevMounter) { m.MountOptions = append(m.MountOptions, opts...) }
+}
+
+// WithFS skips the detection of the file system type
+func WithFS(fs FileSystemType) Option {
+	return func(m *DevMounter) { m.FS = fs }
+}
+
+// WithContext sets the selinux context of the mount
+func WithContext(ctx string) Option {
+	return func(m *DevMounter) { m.args_.ctx = ctx }
+}
+
+// WithRetries sets how often a busy mount is unmounted before giving up
+func WithRetries(n int) Option {
+	return func(m *DevMounter) { m.UMountRetries = n }
+}
+
+func WithLogger(l Logger) Option {
+	return func(m *DevMounter) { m.Logger = l }
+}
+
+// WithNoFail lets a batch go on past a failure of the device, with strict
+// the batch still fails at the end, see BatchError
+func WithNoFail(strict bool) Option {
+	return func(m *DevMounter) { m.NoFail, m.StrictNoFail = true, strict }
+}
+
+// WithOnlyChangeIfConflict changes only the uuids that collide, in a batch
+// such as MountVolumeGroup the uuid of an earlier volume counts as well
+func WithOnlyChangeIfConflict() Option {
+	return func(m *DevMounter) { m.OnlyChangeIfConflict = true }
+}
+
+func WithAutoMkdir() Option {
+	return func(m *DevMounter) { m.AutoMkdir = true }
+}
+
+func WithXFSUUIDMode(mode UUIDMode) Option {
+	return func(m *DevMounter) { m.XFSUUIDMode = mode }
+}
+
+func WithStateFile(file string) Option {
+	return func(m *DevMounter) { m.StateFile = file }
+}
+
+func WithMetrics(metrics Metrics) Option {
+	return func(m *DevMounter) { m.Metrics = metrics }
+}
+
+// WithForceUnmount unmounts earlier mounts of the device or the path first
+func WithForceUnmount(lazy bool) Option {
+	return func(m *DevMounter) {
+		m.ForceUnmountExisting = true
+		m.LazyUnmount = lazy
+	}
+}
+
+// WithCommandPrefix runs every command of the mounter through prefix, e.g.
+// WithCommandPrefix("sudo", "-n")
+func WithCommandPrefix(prefix ...string) Option {
+	return func(m *DevMounter) { m.CommandPrefix = prefix }
+}
+
+func (m *DevMounter) logger() Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return DefaultLogger
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMounter(t *testing.T) {
+	f := newFakeRunner("")
+	useRunner(t, f)
+
+	var logged []string
+	m := NewMounter(fakeDev, fakePath,
+		WithFS(FsExt4),
+		WithReadOnly(),
+		WithContext("system_u:object_r:tmp_t:s0"),
+		WithLogger(LoggerFunc(func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		})),
+	)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if f.cmds[0] != "dumpe2fs -h "+fakeDev {
+		t.Errorf("file system detected anyway: %q", f.cmds)
+	}
+	if want := `mount -o noatime,ro,context="system_u:object_r:tmp_t:s0" ` + fakeDev + " " + fakePath; f.cmds[3] != want {
+		t.Errorf("got %q, want %q", f.cmds[3], want)
+	}
+
+	m.warn("hello")
+	if len(logged) != 1 || logged[0] != "WARNING: hello" {
+		t.Errorf("logged %q", logged)
+	}
+}
+
+func TestNewMounterFromFd(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m := NewMounterFromFd(int(f.Fd()), fakePath)
+	a, err := os.Stat(m.Result().Dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := f.Stat()
+	if !os.SameFile(a, b) {
+		t.Errorf("%s is not the open file", m.Result().Dev)
+	}
+}
+
+func TestDebugLogger(t *testing.T) {
+	useRunner(t, newFakeRunner(""))
+	var logged []string
+	DebugLogger = LoggerFunc(func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	defer func() { DebugLogger = nil }()
+
+	ExecCmd("blkid | grep dev")
+	if len(logged) != 1 || !strings.Contains(logged[0], `argv=["blkid" "|" "grep" "dev"] exit=0`) {
+		t.Errorf("logged %q", logged)
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("newid-mount", flag.ContinueOnError)
+	ro := fs.Bool("ro", false, "")
+	timeout := fs.Duration("mount-timeout", 0, "")
+	opts := fs.String("o", "", "")
+	if err := fs.Parse([]string{"-o", "noexec"}); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"NEWID_RO": "true", "NEWID_MOUNT_TIMEOUT": "5m", "NEWID_O": "nodev"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	if err := setFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if !*ro || *timeout != 5*time.Minute || *opts != "noexec" {
+		t.Errorf("got ro %v, timeout %v, o %q", *ro, *timeout, *opts)
+	}
+
+	fs = flag.NewFlagSet("newid-mount", flag.ContinueOnError)
+	fs.Bool("ro", false, "")
+	os.Setenv("NEWID_RO", "maybe")
+	if err := setFlagsFromEnv(fs); err == nil {
+		t.Error("invalid value accepted")
+	}
+}
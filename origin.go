@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// OriginalUUIDXattr holds the uuid the device had before Start changed it,
+// on the root directory of the mounted file system
+const OriginalUUIDXattr = "user.newid.original_uuid"
+
+var ErrRecordUUID = errors.New("failed to record the original uuid")
+
+// recordOriginalUUID keeps the uuid from before the change, when asked to.
+// A resumed run finds it in the operation log
+func (m *DevMounter) recordOriginalUUID() (err error) {
+	if !m.RecordOriginalUUID {
+		return nil
+	}
+	u := m.origUUID_
+	if u == "" && m.state_ != nil {
+		u = m.state_.OldUUID
+	}
+	if u == "" {
+		return fmt.Errorf("%w: %s had no uuid before the change", ErrRecordUUID, m.args_.dev)
+	}
+
+	if m.OriginalUUIDFile != "" {
+		err = ioutil.WriteFile(m.OriginalUUIDFile, []byte(u+"\n"), 0644)
+	} else {
+		err = syscall.Setxattr(m.args_.path_, OriginalUUIDXattr, []byte(u), 0)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRecordUUID, err)
+	}
+	return nil
+}
+
+// OriginalUUID reads what RecordOriginalUUID kept, from a sidecar file or
+// from the xattr of a mount path
+func OriginalUUID(path_ string) (uuid string, err error) {
+	fi, err := os.Stat(path_)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		b, err := ioutil.ReadFile(path_)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	b := make([]byte, 64)
+	n, err := syscall.Getxattr(path_, OriginalUUIDXattr, b)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrOverlay = errors.New("failed to mount the overlay")
+
+// mountOverlay mounts the device read-only at OverlayScratch/.lower and
+// layers the upper and work directories of OverlayScratch over it at the
+// mount path, so every write lands in OverlayScratch/upper. Close unmounts
+// both, the upper directory is kept
+func (m *DevMounter) mountOverlay(opts []string) (err error) {
+	if m.fs == FsZFS {
+		return fmt.Errorf("%w: zfs cannot be a lower layer here", ErrOverlay)
+	}
+	scratch, err := filepath.Abs(m.OverlayScratch)
+	if err != nil {
+		return err
+	}
+	lower := filepath.Join(scratch, ".lower")
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	for _, p := range []string{lower, upper, work} {
+		// the kernel splits the options at commas and lowerdir at colons
+		if strings.ContainsAny(p, ",:") {
+			return fmt.Errorf("%w: %s has a comma or colon", ErrOverlay, p)
+		}
+		if err = os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+	}
+
+	if !m.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	if err = m.mount(m.args_.dev, lower, m.mountCtx(opts...)); err != nil {
+		return err
+	}
+	m.pushCleanup(func() error {
+		if err := m.env().UMount(lower); err != nil {
+			return err
+		}
+		return os.Remove(lower)
+	})
+
+	if r, _, _ := m.env().ExecCmd(fmt.Sprintf("%s -t overlay %s overlay %s", CMount,
+		m.mountCtx("lowerdir="+lower, "upperdir="+upper, "workdir="+work), m.args_.path_)); r != 0 {
+		return ErrOverlay
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const CLsblk Caller_ = "lsblk"
+
+var ErrPartitions = errors.New("failed to list the partitions")
+
+// Partitions lists the partition devices of disk in table order
+func Partitions(disk string) (parts []string, err error) {
+	return cmdEnv{}.Partitions(disk)
+}
+
+func (x cmdEnv) Partitions(disk string) (parts []string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -lnp -o NAME,TYPE %s", CLsblk, disk))
+	if r != 0 {
+		return nil, ErrPartitions
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[1] == "part" {
+			parts = append(parts, f[0])
+		}
+	}
+	return parts, nil
+}
+
+// attachDisk connects a qcow2 or vmdk image to an nbd device and a raw one to
+// a loop device, either read-only when readOnly is set
+func (x cmdEnv) attachDisk(image string, sectorSize int, readOnly bool) (disk string, detach func() error, err error) {
+	_, out, _ := x.ExecCmd(fmt.Sprintf("%s -sL %s", CFile, image))
+	if f := imageFormat(strings.ToLower(out)); f != "" {
+		if disk, err = x.nbdConnectFree(image, f, readOnly); err != nil {
+			return "", nil, err
+		}
+		return disk, func() error { return x.NBDDisconnect(disk) }, nil
+	}
+	if disk, err = x.LoopAttach(image, sectorSize, readOnly); err != nil {
+		return "", nil, err
+	}
+	return disk, func() error { return x.LoopDetach(disk) }, nil
+}
+
+// MountAllPartitions attaches a whole disk image and mounts each partition
+// with a new uuid at baseDir/p1, baseDir/p2 and so on, creating the
+// directories when missing. opts apply to each partition. Swap and
+// partitions without a known file system are not mounted, their result tells
+// why in Skipped. The image stays attached while mounted, call detach once
+// the partitions are unmounted. With nothing mounted it is detached on
+// return already and detach does nothing. On an error everything is
+// unmounted and detached again. With WithNoFail the rest are still mounted
+// and the failures come back as a *BatchError along with the results, see
+// StrictNoFail
+func MountAllPartitions(image, baseDir string, opts ...Option) (results []*MountResult, detach func() error, err error) {
+	conf := batchConf(opts)
+	var failed BatchError
+	disk, detachDisk, err := conf.env().attachDisk(image, conf.SectorSize, conf.LoopReadOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var done []*DevMounter
+	var keep bool
+	defer func() {
+		if keep {
+			return
+		}
+		for i := len(done) - 1; i >= 0; i-- {
+			done[i].Close()
+		}
+		detachDisk()
+	}()
+
+	parts, err := conf.env().Partitions(disk)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, part := range parts {
+		path_ := filepath.Join(baseDir, fmt.Sprintf("p%d", i+1))
+		r := &MountResult{Dev: part, Image: image, Path: path_}
+		results = append(results, r)
+
+		m := NewMounter(part, path_, append([]Option{WithAutoMkdir()}, opts...)...)
+		if err = m.Start(); errors.Is(err, ErrSwap) {
+			m.Close()
+			r.Skipped = "swap"
+			continue
+		} else if errors.Is(err, ErrUnKFs) {
+			m.Close()
+			r.Skipped = "unknown file system"
+			continue
+		} else if err != nil {
+			m.Close()
+			if failed.nofail(&conf, r, err) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %w", part, err)
+		}
+		done = append(done, m)
+		*r = m.Result()
+		r.Image = image
+	}
+	if err = failed.result(); err != nil && conf.StrictNoFail {
+		return nil, nil, err
+	}
+	keep = true
+	if len(done) == 0 {
+		if err_ := detachDisk(); err == nil {
+			err = err_
+		}
+		return results, func() error { return nil }, err
+	}
+	return results, detachDisk, err
+}
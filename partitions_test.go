@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountAllPartitions(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL disk.img":                   {0, "disk.img: DOS/MBR boot sector; partition 1 : ID=0x83"},
+		"losetup -f --show -P disk.img":       {0, "/dev/loop7\n"},
+		"lsblk -lnp -o NAME,TYPE /dev/loop7":  {0, "/dev/loop7 loop\n/dev/loop7p1 part\n/dev/loop7p2 part\n/dev/loop7p3 part\n"},
+		"file -sL /dev/loop7p1":               {0, "Linux rev 1.0 ext4 filesystem data"},
+		"blkid -s TYPE -o value /dev/loop7p2": {0, "swap"},
+		"file -sL /dev/loop7p3":               {0, "data"},
+		"blkid -s UUID -o value /dev/loop7p1": {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+	base := t.TempDir()
+	skipCheck := func(m *DevMounter) { m.SkipCheck = true }
+	mount := "mount -o noatime,X-mount.mkdir /dev/loop7p1 " + filepath.Join(base, "p1")
+	f.replies[mount] = fakeReply{r: 32}
+
+	_, _, err := MountAllPartitions("disk.img", base, skipCheck)
+	if !errors.Is(err, ErrMount) {
+		t.Fatalf("got %v, want %v", err, ErrMount)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "losetup -d /dev/loop7" {
+		t.Errorf("not detached, last command %q", last)
+	}
+
+	delete(f.replies, mount)
+	rs, detach, err := MountAllPartitions("disk.img", base, skipCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last == "losetup -d /dev/loop7" {
+		t.Error("detached while mounted")
+	}
+	if err = detach(); err != nil {
+		t.Fatal(err)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "losetup -d /dev/loop7" {
+		t.Errorf("not detached, last command %q", last)
+	}
+	var skipped []string
+	for _, r := range rs {
+		skipped = append(skipped, r.Skipped)
+	}
+	if !reflect.DeepEqual(skipped, []string{"", "swap", "unknown file system"}) {
+		t.Errorf("skipped %q", skipped)
+	}
+	if rs[0].FS != FsExt4 || rs[0].Path != filepath.Join(base, "p1") || rs[0].Image != "disk.img" {
+		t.Errorf("got %+v", rs[0])
+	}
+
+	// nothing to mount, nothing stays attached
+	f.replies["file -sL /dev/loop7p1"] = fakeReply{0, "data"}
+	n := len(f.cmds)
+	if _, detach, err = MountAllPartitions("disk.img", base, skipCheck); err != nil {
+		t.Fatal(err)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "losetup -d /dev/loop7" {
+		t.Errorf("not detached, last command %q", last)
+	}
+	n = len(f.cmds)
+	if err = detach(); err != nil || len(f.cmds) != n {
+		t.Errorf("detach ran %q, %v", f.cmds[n:], err)
+	}
+}
+
+func TestSectorSize(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "4kn.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL " + img:                     {0, img + ": Linux rev 1.0 ext4 filesystem data"},
+		"losetup -f --show -P -b 4096 " + img: {0, "/dev/loop9\n"},
+		"file -sL /dev/loop9":                 {0, "/dev/loop9: Linux rev 1.0 ext4 filesystem data"},
+		"blkid -s UUID -o value /dev/loop9":   {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+
+	m := NewMounter(img, fakePath, func(m *DevMounter) { m.SectorSize = 4096 })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.Result(); r.Dev != "/dev/loop9" || r.Image != img {
+		t.Errorf("got %+v", r)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "losetup -d /dev/loop9" {
+		t.Errorf("not detached, last command %q", last)
+	}
+}
+
+func TestLoopReadOnly(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "evidence.img")
+	if err := ioutil.WriteFile(img, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL " + img:                   {0, img + ": Linux rev 1.0 ext4 filesystem data"},
+		"losetup -f --show -P -r " + img:    {0, "/dev/loop9\n"},
+		"file -sL /dev/loop9":               {0, "/dev/loop9: Linux rev 1.0 ext4 filesystem data"},
+		"blkid -s UUID -o value /dev/loop9": {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+
+	m := NewMounter(img, fakePath, func(m *DevMounter) { m.LoopReadOnly = true })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	mounted := false
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") {
+			t.Errorf("uuid changed on a read-only loop: %q", c)
+		}
+		mounted = mounted || c == "mount -o noatime,ro,noload /dev/loop9 "+fakePath
+	}
+	if !mounted {
+		t.Errorf("not mounted read-only: %q", f.cmds)
+	}
+	if r := m.Result(); r.UUID != "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4" || len(r.Warnings) != 1 {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestLoopReadOnlyQCOW2(t *testing.T) {
+	dir := t.TempDir()
+	img, nbd := filepath.Join(dir, "evidence.qcow2"), filepath.Join(dir, "nbd0")
+	for _, p := range []string{img, nbd} {
+		if err := ioutil.WriteFile(p, nil, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := freeNBD
+	freeNBD = func(cmdEnv) (string, error) { return nbd, nil }
+	defer func() { freeNBD = old }()
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL " + img:               {0, img + ": QEMU QCOW2 Image (v3), 10737418240 bytes"},
+		"file -sL " + nbd:               {0, nbd + ": SGI XFS filesystem data"},
+		"blkid -s UUID -o value " + nbd: {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+
+	m := NewMounter(img, fakePath, func(m *DevMounter) { m.LoopReadOnly = true })
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if want := "qemu-nbd --connect=" + nbd + " -f qcow2 --read-only " + img; f.cmds[1] != want {
+		t.Errorf("got %q, want %q", f.cmds[1], want)
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") || strings.HasPrefix(c, "xfs_admin") || strings.HasPrefix(c, "xfs_db") ||
+			strings.HasPrefix(c, "mount -o rw") {
+			t.Errorf("wrote to a read-only image: %q", c)
+		}
+	}
+	if last := f.cmds[len(f.cmds)-1]; last != "mount -o inode64,ro,norecovery,nouuid "+nbd+" "+fakePath {
+		t.Errorf("not mounted read-only: %q", last)
+	}
+}
+
+func TestMountNBD(t *testing.T) {
+	dir := t.TempDir()
+	img, nbd := filepath.Join(dir, "disk.img"), filepath.Join(dir, "nbd0")
+	for _, p := range []string{img, nbd, nbd + "p1"} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := freeNBD
+	freeNBD = func(cmdEnv) (string, error) { return nbd, nil }
+	defer func() { freeNBD = old }()
+
+	for _, c := range []struct {
+		name  string
+		setup func(m *DevMounter)
+		dev   string
+		want  []string
+	}{
+		{"qcow2 detected", nil, nbd, []string{
+			"file -sL " + img,
+			"qemu-nbd --connect=" + nbd + " -f qcow2 " + img,
+		}},
+		{"vmdk partition", func(m *DevMounter) {
+			m.ImageFormat = ImageVMDK
+			m.NBDPartition = 1
+		}, nbd + "p1", []string{
+			"qemu-nbd --connect=" + nbd + " -f vmdk " + img,
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := &fakeRunner{replies: map[string]fakeReply{
+				"file -sL " + img:   {0, img + ": QEMU QCOW2 Image (v3), 10737418240 bytes"},
+				"file -sL " + c.dev: {0, c.dev + ": Linux rev 1.0 ext4 filesystem data"},
+				"blkid":             {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+			}}
+			useRunner(t, f)
+
+			m := NewMounter(img, fakePath)
+			if c.setup != nil {
+				c.setup(m)
+			}
+			if err := m.Start(); err != nil {
+				t.Fatal(err)
+			}
+			want := append(c.want,
+				"file -sL "+c.dev,
+				"dumpe2fs -h "+c.dev,
+				"tune2fs -U random "+c.dev,
+				"blkid -s UUID -o value "+c.dev,
+				"mount -o noatime "+c.dev+" "+fakePath,
+			)
+			if !reflect.DeepEqual(f.cmds, want) {
+				t.Errorf("commands\n got %q\nwant %q", f.cmds, want)
+			}
+
+			f.cmds = nil
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"umount " + fakePath, "qemu-nbd -d " + nbd}; !reflect.DeepEqual(f.cmds, want) {
+				t.Errorf("closed with %q, want %q", f.cmds, want)
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "evidence.img")
+	if err := ioutil.WriteFile(img, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	snap := "/dev/mapper/newid-snap-evidence.img"
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL " + img:                {0, img + ": Linux rev 1.0 ext4 filesystem data"},
+		"losetup -f --show -P -r " + img: {0, "/dev/loop9\n"},
+		"blockdev --getsz /dev/loop9":    {0, "2048\n"},
+		"blkid -s UUID -o value " + snap: {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+		"dumpe2fs -h " + snap:            {0, "Filesystem UUID: 0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+	}}
+	useRunner(t, f)
+
+	m := NewMounter(img, fakePath, func(m *DevMounter) {
+		m.Snapshot = true
+		m.SnapshotCOW = "/dev/cow0"
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"dmsetup create newid-snap-evidence.img --table 0 2048 snapshot /dev/loop9 /dev/cow0 N 8",
+		"tune2fs -U random " + snap,
+		"mount -o noatime " + snap + " " + fakePath,
+	}
+	for _, w := range want {
+		found := false
+		for _, c := range f.cmds {
+			found = found || c == w
+		}
+		if !found {
+			t.Errorf("%q not run: %q", w, f.cmds)
+		}
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "tune2fs") && strings.HasSuffix(c, "/dev/loop9") {
+			t.Errorf("uuid changed under the snapshot: %q", c)
+		}
+	}
+
+	f.cmds = nil
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.cmds); n < 2 || f.cmds[n-2] != "dmsetup remove newid-snap-evidence.img" || f.cmds[n-1] != "losetup -d /dev/loop9" {
+		t.Errorf("closed with %q", f.cmds)
+	}
+}
+
+func TestSnapshotUnsupported(t *testing.T) {
+	for _, typ := range []string{BlkIDZFSMember, "swap", "apfs", "hfsplus", BlkIDRAIDMember} {
+		t.Run(typ, func(t *testing.T) {
+			f := &fakeRunner{replies: map[string]fakeReply{
+				"file -sL " + fakeDev:               {0, fakeDev + ": data"},
+				"blkid -s TYPE -o value " + fakeDev: {0, typ},
+			}}
+			useRunner(t, f)
+
+			m := NewMounter(fakeDev, fakePath, func(m *DevMounter) {
+				m.Snapshot = true
+				m.SwapOn = true
+			})
+			if err := m.Start(); !errors.Is(err, ErrSnapshotUnsupported) {
+				t.Fatalf("got %v, want %v", err, ErrSnapshotUnsupported)
+			}
+			if last := f.cmds[len(f.cmds)-1]; last != "blkid -s TYPE -o value "+fakeDev {
+				t.Errorf("ran %q after the type", last)
+			}
+		})
+	}
+}
+
+func TestTakeInventory(t *testing.T) {
+	f := &fakeRunner{replies: map[string]fakeReply{
+		"file -sL disk.img":                    {0, "disk.img: DOS/MBR boot sector; partition 1 : ID=0xee"},
+		"losetup -f --show -P -r disk.img":     {0, "/dev/loop7\n"},
+		"lsblk -lnp -o NAME,TYPE /dev/loop7":   {0, "/dev/loop7 loop\n/dev/loop7p1 part\n/dev/loop7p2 part\n/dev/loop7p3 part\n"},
+		"blkid -s PTTYPE -o value /dev/loop7":  {0, "gpt"},
+		"file -sL /dev/loop7p1":                {0, "/dev/loop7p1: Linux rev 1.0 ext4 filesystem data, UUID=0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+		"blkid -s UUID -o value /dev/loop7p1":  {0, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4"},
+		"blkid -s LABEL -o value /dev/loop7p1": {0, "root"},
+		"file -sL /dev/loop7p2":                {0, "/dev/loop7p2: LVM2 PV (Linux Logical Volume Manager)"},
+		"blkid -s UUID -o value /dev/loop7p2":  {0, "3Jx1kE-Ihc1-mr3H-1MZb-l6qW-WJhE-246KcT"},
+		"file -sL /dev/loop7p3":                {0, "/dev/loop7p3: data"},
+		"dumpe2fs -h /dev/loop7p1":             {0, "Block count:              262144\nBlock size:               4096\n"},
+	}}
+	useRunner(t, f)
+
+	inv, err := TakeInventory("disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.PartitionTable != "gpt" || len(inv.Partitions) != 3 {
+		t.Fatalf("got %+v", inv)
+	}
+	p := inv.Partitions
+	if p[0].Kind != DeviceFilesystem || p[0].FS != FsExt4 || p[0].Label != "root" || p[0].FSSize != 262144*4096 {
+		t.Errorf("got %+v", p[0])
+	}
+	if p[1].Kind != DeviceLVMMember || p[1].UUID == "" || p[2].Kind != DeviceEmpty || p[2].UUID != "" {
+		t.Errorf("got %+v, %+v", p[1], p[2])
+	}
+	for _, c := range f.cmds {
+		if strings.HasPrefix(c, "mount") {
+			t.Errorf("mounted: %q", c)
+		}
+	}
+	if f.cmds[1] != "losetup -f --show -P -r disk.img" || f.cmds[len(f.cmds)-1] != "losetup -d /dev/loop7" {
+		t.Errorf("got %q", f.cmds)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// AllCallers are the tools this module may run
+var AllCallers = []Caller_{
+	CMount, CUMount, CNTFs3g, CTune2FS, CBlkID, CFile, CXFSAdmin, CNTFsLabel,
+	CXFSRepair, CE2Fsck, CNTFsFix, CBtrfsTune, CBtrfs, CDumpE2FS, CXFSInfo,
+	CBlockDev, CUdevadm, CResize2FS, CXFSGrowFS, CQemuNBD, CModprobe, CZPool, CLVs, CLVChange, CLosetup, CLsblk, CCryptSetup, CXFSDB, CSwapOn, CSwapOff,
+	CMdadm, CMke2fs, CDmsetup, CQuotaCheck, CQuotaOn, CExportfs, CAPFSFuse,
+}
+
+// ProbeReport is everything found out about a device without changing it
+type ProbeReport struct {
+	Dev        string          `json:"dev"`
+	Image      string          `json:"image,omitempty"`
+	FS         FileSystemType  `json:"fs"`
+	UUID       string          `json:"uuid"`
+	Label      string          `json:"label"`
+	DevInfo    DevInfo         `json:"dev_info"`
+	DeviceSize int64           `json:"device_size"`
+	FSSize     int64           `json:"fs_size,omitempty"`
+	TotalBytes uint64          `json:"total_bytes,omitempty"`
+	FreeBytes  uint64          `json:"free_bytes,omitempty"`
+	Features   []string        `json:"features,omitempty"`
+	Mounts     []MountEntry    `json:"mounts"`
+	Tools      map[string]bool `json:"tools"`
+	Errors     []string        `json:"errors,omitempty"`
+}
+
+var (
+	extFeatures = regexp.MustCompile(`(?m)^Filesystem features:\s+(.*)$`)
+	xfsFeatures = regexp.MustCompile(`\b([a-z_]+)=1\b`)
+)
+
+// Probe reports on the device, read-only. The free space is read from a
+// read-only mount at the mount path, or a temporary directory when the path
+// is empty, unless the device is mounted already. Close releases whatever
+// Probe had to set up, e.g. an nbd device. Images are attached, and luks
+// and md devices opened, read-only whatever ReadOnly and LoopReadOnly say
+func (m *DevMounter) Probe() (report *ProbeReport, err error) {
+	ro, loopRO := m.ReadOnly, m.LoopReadOnly
+	m.ReadOnly, m.LoopReadOnly = true, true
+	defer func() { m.ReadOnly, m.LoopReadOnly = ro, loopRO }()
+
+	if m.args_.path_ == "" {
+		if m.args_.path_, err = ioutil.TempDir("", "newid-probe-"); err != nil {
+			return nil, err
+		}
+		dir := m.args_.path_
+		m.pushCleanup(func() error { return os.Remove(dir) })
+	}
+
+	report = &ProbeReport{Tools: make(map[string]bool)}
+	for _, c := range AllCallers {
+		_, err_ := LookPath(string(c))
+		report.Tools[string(c)] = err_ == nil
+	}
+	fail := func(err error) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	err = m.BindArgs()
+	report.Dev, report.Image, report.DevInfo = m.args_.dev, m.image_, m.devInfo_
+	if err != nil {
+		return report, err
+	}
+	report.FS = m.fs
+
+	if report.UUID, err = m.env().QueryDeviceUUID(m.args_.dev); err != nil {
+		fail(fmt.Errorf("uuid: %w", err))
+	}
+	report.Label, _ = m.env().QueryDeviceTag(m.args_.dev, "LABEL")
+	if report.DeviceSize, err = m.env().DeviceSize(m.args_.dev); err != nil {
+		fail(fmt.Errorf("device size: %w", err))
+	}
+	if report.FSSize, err = m.env().FSSize(m.fs, m.args_.dev); err != nil && err != ErrUnsFs {
+		fail(fmt.Errorf("file system size: %w", err))
+	}
+	report.Features = m.env().probeFeatures(m.fs, m.args_.dev)
+	if report.Mounts, err = MountsForDevice(m.args_.dev); err != nil {
+		fail(fmt.Errorf("mounts: %w", err))
+	}
+
+	if err = m.probeSpace(report); err != nil {
+		fail(fmt.Errorf("free space: %w", err))
+	}
+	return report, nil
+}
+
+func (x cmdEnv) probeFeatures(fs FileSystemType, dev string) []string {
+	switch fs {
+	case FsExt2, FsExt3, FsExt4:
+		if _, out, _ := x.ExecCmd(fmt.Sprintf("%s -h %s", CDumpE2FS, dev)); out != "" {
+			if f := extFeatures.FindStringSubmatch(out); f != nil {
+				return strings.Fields(f[1])
+			}
+		}
+	case FsXFS_:
+		if r, out, _ := x.ExecCmd(fmt.Sprintf("%s %s", CXFSInfo, dev)); r == 0 {
+			var features []string
+			for _, f := range xfsFeatures.FindAllStringSubmatch(out, -1) {
+				features = append(features, f[1])
+			}
+			return features
+		}
+	}
+	return nil
+}
+
+// probeSpace statfs an existing mount of the device, or mounts it read-only
+// for that, replaying no journal
+func (m *DevMounter) probeSpace(report *ProbeReport) (err error) {
+	dir := ""
+	if len(report.Mounts) != 0 {
+		dir = report.Mounts[0].MountPoint
+	} else {
+		if m.fs == FsZFS {
+			return nil
+		}
+		opts := append([]string{"ro"}, noRecoveryOpts(m.fs)...)
+		if err = m.env().Mount(m.mountFS(), m.args_.dev, m.args_.path_, m.mountCtx(opts...)); err != nil {
+			return err
+		}
+		defer m.env().UMount(m.args_.path_)
+		dir = m.args_.path_
+	}
+
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	report.TotalBytes = st.Blocks * uint64(st.Bsize)
+	report.FreeBytes = st.Bavail * uint64(st.Bsize)
+	return nil
+}
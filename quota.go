@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	CQuotaCheck Caller_ = "quotacheck"
+	CQuotaOn    Caller_ = "quotaon"
+
+	StepQuota OpStep = "quota"
+)
+
+var (
+	ErrQuotaUnsupported = errors.New("the file system has no user or group quotas")
+	ErrQuota            = errors.New("failed to turn the quotas on")
+)
+
+// quotaFS tells the file systems that take usrquota and grpquota, btrfs has
+// qgroups instead
+func quotaFS(fs FileSystemType) bool {
+	switch fs {
+	case FsExt2, FsExt3, FsExt4, FsXFS_:
+		return true
+	}
+	return false
+}
+
+// quotaOpts are the mount options of Quota, ErrQuotaUnsupported for a file
+// system without quotas
+func (m *DevMounter) quotaOpts() (opts []string, err error) {
+	if m.Quota == "" {
+		return nil, nil
+	}
+	if !quotaFS(m.fs) {
+		return nil, fmt.Errorf("%w: %s", ErrQuotaUnsupported, m.fs)
+	}
+	return strings.Split(m.Quota, ","), nil
+}
+
+// enableQuota creates the missing quota files of the mounted ext and turns
+// its quotas on, when asked to. xfs enforces them from the mount options on
+func (m *DevMounter) enableQuota() (err error) {
+	if !m.EnableQuota || !strings.HasPrefix(string(m.fs), "ext") {
+		return nil
+	}
+
+	// quota alone is usrquota
+	kinds := ""
+	for _, o := range strings.Split(m.Quota, ",") {
+		if strings.HasPrefix(o, "usr") || o == "quota" {
+			kinds += "u"
+		} else if strings.HasPrefix(o, "grp") {
+			kinds += "g"
+		}
+	}
+	// -m, the file system is in use by nobody yet, no need to remount it
+	if r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s -c%sm %s", CQuotaCheck, kinds, m.args_.path_)); r != 0 {
+		return fmt.Errorf("%w: %s", ErrQuota, strings.TrimSpace(out))
+	}
+	if r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s %s", CQuotaOn, m.args_.path_)); r != 0 {
+		return fmt.Errorf("%w: %s", ErrQuota, strings.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// reconcileFS checks the file system file found against the blkid TYPE, when
+// asked to. On a disagreement the kernel decides: the device is mounted
+// read-only with -t auto at a temporary directory and the type it got in
+// mountinfo wins. When that fails, or nothing is to write to the device, a
+// read-only mount or a dm-snapshot, blkid wins: the -t auto mount replays
+// the journal of an ext or xfs
+func (m *DevMounter) reconcileFS(fileFS FileSystemType) (fs FileSystemType) {
+	if !m.CrossCheckFS {
+		return fileFS
+	}
+	t, _ := m.env().QueryDeviceTag(m.args_.dev, "TYPE")
+	blkFS := FileSystemType(t)
+	if t == "" || blkFS == fileFS {
+		return fileFS
+	}
+	m.warn("file says %s is %s but blkid says %s", m.args_.dev, fileFS, t)
+
+	if !m.Snapshot && !m.ReadOnly && !m.roLoop_ {
+		if fs, err := m.env().mountedFSType(m.args_.dev); err != nil {
+			m.warn("mount -t auto of %s failed: %v", m.args_.dev, err)
+		} else if supportedFS(fs) {
+			m.warn("%s mounts as %s", m.args_.dev, fs)
+			return fs
+		}
+	}
+	if supportedFS(blkFS) {
+		return blkFS
+	}
+	return fileFS
+}
+
+// mountedFSType mounts dev read-only with -t auto and returns the type the
+// kernel mounted it as, the mount is gone again on return
+func (x cmdEnv) mountedFSType(dev string) (fs FileSystemType, err error) {
+	dir, err := ioutil.TempDir("", "newid-auto-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dir)
+
+	if r, out, _ := x.ExecCmd(fmt.Sprintf("%s -t auto -o ro %s %s", CMount, dev, dir)); r != 0 {
+		return "", mountExitError(ErrMount, CMount, r, out)
+	}
+	e, err := MountEntryAt(dir)
+	if err_ := x.UMount(dir); err == nil {
+		err = err_
+	}
+	if err != nil {
+		return "", err
+	}
+	if e == nil {
+		return "", fmt.Errorf("%w: nothing mounted at %s", ErrMount, dir)
+	}
+	return FileSystemType(e.FSType), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// DevInfo identifies the block device behind a device path, two paths with the
+// same major:minor are the same device
+type DevInfo struct {
+	Major uint32 `json:"major"`
+	Minor uint32 `json:"minor"`
+	// loop devices only
+	BackingFile string `json:"backing_file,omitempty"`
+}
+
+// MountResult describes what Start did
+type MountResult struct {
+	Dev string `json:"dev"`
+	// the image behind Dev, when an image was given
+	Image string `json:"image,omitempty"`
+	Path  string `json:"path"`
+	// where Path is bind mounted as well
+	BindPaths []string       `json:"bind_paths,omitempty"`
+	FS        FileSystemType `json:"fs"`
+	UUID      string         `json:"uuid"`
+	DevInfo
+	Warnings []string `json:"warnings,omitempty"`
+	// why the device was left unmounted, e.g. by MountAllPartitions
+	Skipped string `json:"skipped,omitempty"`
+	// the failure of a NoFail device of a batch, or of Start with -output
+	Error string `json:"error,omitempty"`
+	// what PostMountCmd gave
+	Verify *VerifyResult `json:"verify,omitempty"`
+	// the last TreeChecksum
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func (m *DevMounter) Result() MountResult {
+	return MountResult{
+		Dev:       m.args_.dev,
+		Image:     m.image_,
+		Path:      m.args_.path_,
+		BindPaths: m.BindPaths,
+		FS:        m.fs,
+		UUID:      m.uuid_,
+		DevInfo:   m.devInfo_,
+		Warnings:  m.warnings_,
+		Verify:    m.verify_,
+		Checksum:  m.checksum_,
+	}
+}
+
+// WriteResult replaces file atomically with v, a MountResult or the results
+// of a batch, as json
+func WriteResult(file string, v interface{}) (err error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(b, '\n'))
+}
+
+// warn keeps msg for the result and logs it right away
+func (m *DevMounter) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	m.warnings_ = append(m.warnings_, msg)
+	m.logger().Logf("WARNING: %s", msg)
+}
+
+// bindDevInfo leaves devInfo_ empty for image files, which are mounted
+// through a loop device by mount
+func (m *DevMounter) bindDevInfo() (err error) {
+	major, minor, err := DeviceNumber(m.args_.dev)
+	if err != nil {
+		return nil
+	}
+	m.devInfo_ = DevInfo{Major: major, Minor: minor}
+	m.devInfo_.BackingFile = LoopBackingFile(major, minor)
+	return nil
+}
+
+// LoopBackingFile is empty unless major:minor is a loop device
+func LoopBackingFile(major, minor uint32) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/dev/block/%d:%d/loop/backing_file", major, minor))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnsafeMountPath = errors.New("refusing to mount over a system directory")
+	ErrNonEmptyTarget  = errors.New("refusing to mount over a directory with files in it")
+	ErrSwappedArgs     = errors.New("the device and the mount path look swapped")
+	ErrNotDevice       = errors.New("not a block device or an image file")
+	ErrNotDir          = errors.New("the mount path is not a directory")
+)
+
+// UnsafeMountPaths must never be hidden by a mounted volume
+var UnsafeMountPaths = []string{
+	"/", "/bin", "/boot", "/boot/efi", "/dev", "/etc", "/home", "/lib", "/lib32", "/lib64",
+	"/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys", "/tmp",
+	"/usr", "/usr/bin", "/usr/lib", "/usr/lib64", "/usr/local", "/usr/sbin",
+	"/var", "/var/lib", "/var/log", "/var/tmp",
+}
+
+// warnSystemImage warns about an ext file system last mounted on /, the root
+// of another system, which is rarely what belongs at the mount path
+func (m *DevMounter) warnSystemImage() {
+	if !strings.HasPrefix(string(m.fs), "ext") {
+		return
+	}
+	if last, err := LastMountedOn(m.args_.dev); err == nil && last == "/" {
+		m.warn("%s was last mounted on /, it holds a whole system", m.sourceDev())
+	}
+}
+
+// IsUnsafeMountPath also resolves symlinks, so /lib pointing to /usr/lib is
+// caught either way
+func IsUnsafeMountPath(path_ string) bool {
+	candidates := []string{filepath.Clean(path_)}
+	if abs, err := filepath.Abs(path_); err == nil {
+		candidates = append(candidates, abs)
+	}
+	if real_, err := filepath.EvalSymlinks(path_); err == nil {
+		candidates = append(candidates, real_)
+	}
+
+	for _, c := range candidates {
+		for _, p := range UnsafeMountPaths {
+			if c == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *DevMounter) checkPath() (err error) {
+	if !m.AllowUnsafePath && IsUnsafeMountPath(m.args_.path_) {
+		return ErrUnsafeMountPath
+	}
+	return nil
+}
+
+// checkArgs tells a device that is a directory, or a mount path that is not
+// one, which is most often -dev and -path given the other way round. What
+// does not exist yet is left to fail later
+func (m *DevMounter) checkArgs() (err error) {
+	devDir, pathDev := false, false
+	if fi, err := os.Stat(m.args_.dev); err == nil {
+		devDir = fi.IsDir()
+		if !devDir && !fi.Mode().IsRegular() && fi.Mode()&os.ModeDevice == 0 {
+			return fmt.Errorf("%w: %s", ErrNotDevice, m.args_.dev)
+		}
+	}
+	if fi, err := os.Stat(m.args_.path_); err == nil && !fi.IsDir() {
+		pathDev = fi.Mode().IsRegular() || fi.Mode()&os.ModeDevice != 0
+		if !pathDev {
+			return fmt.Errorf("%w: %s", ErrNotDir, m.args_.path_)
+		}
+	}
+	switch {
+	case devDir && pathDev:
+		return fmt.Errorf("%w: -dev %s is a directory and -path %s a device", ErrSwappedArgs, m.args_.dev, m.args_.path_)
+	case devDir:
+		return fmt.Errorf("%w: %s is a directory", ErrNotDevice, m.args_.dev)
+	case pathDev:
+		return fmt.Errorf("%w: %s", ErrNotDir, m.args_.path_)
+	}
+	return nil
+}
+
+// checkEmptyTarget fails for a mount path with files in it, which the mount
+// would hide. A missing path and a mount point, e.g. of a resumed run, pass
+func (m *DevMounter) checkEmptyTarget() (err error) {
+	dir, err := os.Open(m.args_.path_)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err = dir.Readdirnames(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		// not a directory, mount will tell
+		return nil
+	}
+	if IsPathMounted(m.args_.path_) {
+		return nil
+	}
+
+	if !m.AllowNonEmptyTarget {
+		return fmt.Errorf("%w: %s", ErrNonEmptyTarget, m.args_.path_)
+	}
+	m.warn("%s is not empty, its files are hidden while mounted", m.args_.path_)
+	return nil
+}
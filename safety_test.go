@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsUnsafeMountPath(t *testing.T) {
+	for p, want := range map[string]bool{
+		"/":            true,
+		"/etc/":        true,
+		"/usr/../usr":  true,
+		"/home":        true,
+		"/home/data1":  false,
+		"/mnt/restore": false,
+	} {
+		if got := IsUnsafeMountPath(p); got != want {
+			t.Errorf("%s: got %v, want %v", p, got, want)
+		}
+	}
+
+	m := NewMounterWithArgs(fakeDev, "/etc", "")
+	if err := m.Start(); err != ErrUnsafeMountPath {
+		t.Errorf("got %v, want %v", err, ErrUnsafeMountPath)
+	}
+}
+
+func TestNonEmptyTarget(t *testing.T) {
+	useRunner(t, newFakeRunner("Linux rev 1.0 ext4 filesystem data"))
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ".keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMounterWithArgs(fakeDev, dir, "")
+	if err := m.Start(); !errors.Is(err, ErrNonEmptyTarget) {
+		t.Errorf("got %v, want %v", err, ErrNonEmptyTarget)
+	}
+
+	m.Reset(fakeDev, dir, "")
+	m.AllowNonEmptyTarget = true
+	if err := m.preparePath(); err != nil || len(m.Result().Warnings) != 1 {
+		t.Errorf("got %v, warnings %q", err, m.Result().Warnings)
+	}
+}
+
+func TestWarnSystemImage(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "root.img")
+	b := make([]byte, 4096)
+	binary.LittleEndian.PutUint16(b[extMagicOffset:], extMagic)
+	copy(b[extLastMountedOffset:], "/")
+	if err := ioutil.WriteFile(img, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := LastMountedOn(img); err != nil || last != "/" {
+		t.Fatalf("got %q, %v", last, err)
+	}
+
+	m := NewMounterWithArgs(img, fakePath, "")
+	m.fs = FsExt4
+	m.warnSystemImage()
+	if w := m.Result().Warnings; len(w) != 1 {
+		t.Errorf("warnings %q", w)
+	}
+
+	copy(b[extLastMountedOffset:], "/srv\x00")
+	if err := ioutil.WriteFile(img, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.Reset(img, fakePath, "")
+	m.fs = FsExt4
+	m.warnSystemImage()
+	if w := m.Result().Warnings; len(w) != 0 {
+		t.Errorf("warnings %q", w)
+	}
+}
+
+func TestAutoPath(t *testing.T) {
+	for label, want := range map[string]string{
+		"backup 2024": "backup_2024",
+		"../../etc":   "etc",
+		"data/1":      "data_1",
+		"...":         "",
+	} {
+		if got := autoDirName(label); got != want {
+			t.Errorf("%q: got %q, want %q", label, got, want)
+		}
+	}
+
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	useRunner(t, f)
+	base := t.TempDir()
+	m := NewMounterWithArgs(fakeDev, "", "")
+	m.AutoMountBase = base
+	// nothing is mounted there in the fake mountinfo
+	m.SkipCheck = true
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	path_ := filepath.Join(base, "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4")
+	if r := m.Result(); r.Path != path_ {
+		t.Errorf("mounted at %q, want %q", r.Path, path_)
+	}
+	if c := f.cmds[len(f.cmds)-1]; !strings.Contains(c, "X-mount.mkdir") || !strings.HasSuffix(c, path_) {
+		t.Errorf("got %q", c)
+	}
+}
+
+func TestSwappedArgs(t *testing.T) {
+	useRunner(t, newFakeRunner("Linux rev 1.0 ext4 filesystem data"))
+	dir := t.TempDir()
+	img := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		dev, path_ string
+		want       error
+	}{
+		{dir, img, ErrSwappedArgs},
+		{dir, fakePath, ErrNotDevice},
+		{img, img, ErrNotDir},
+	} {
+		m := NewMounterWithArgs(c.dev, c.path_, "")
+		if err := m.Start(); !errors.Is(err, c.want) {
+			t.Errorf("%s %s: got %v, want %v", c.dev, c.path_, err, c.want)
+		}
+	}
+
+	// mounted elsewhere, not at the path, is not mounted
+	m := NewMounterWithArgs(fakeDev, dir, "")
+	if err := m.Check(); err != ErrMount {
+		t.Errorf("got %v, want %v", err, ErrMount)
+	}
+}
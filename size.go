@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrSizeMismatch = errors.New("the file system is larger than its device, the image may be truncated")
+
+var (
+	extBlockCount = regexp.MustCompile(`(?m)^Block count:\s+(\d+)`)
+	extBlockSize  = regexp.MustCompile(`(?m)^Block size:\s+(\d+)`)
+	xfsData       = regexp.MustCompile(`data\s+=\s*bsize=(\d+)\s+blocks=(\d+)`)
+)
+
+// DeviceSize is the size in bytes of a block device or an image file
+func DeviceSize(dev string) (size int64, err error) {
+	return cmdEnv{}.DeviceSize(dev)
+}
+
+func (x cmdEnv) DeviceSize(dev string) (size int64, err error) {
+	fi, err := os.Stat(dev)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode().IsRegular() {
+		return fi.Size(), nil
+	}
+
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s --getsize64 %s", CBlockDev, dev))
+	if r != 0 {
+		return 0, fmt.Errorf("failed to read the size of %s", dev)
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// FSSize is the size in bytes the ext or xfs superblock of dev claims
+func FSSize(fs FileSystemType, dev string) (size int64, err error) {
+	return cmdEnv{}.FSSize(fs, dev)
+}
+
+func (x cmdEnv) FSSize(fs FileSystemType, dev string) (size int64, err error) {
+	var count, bsize string
+	switch fs {
+	case FsExt2, FsExt3, FsExt4:
+		r, out, _ := x.ExecCmd(fmt.Sprintf("%s -h %s", CDumpE2FS, dev))
+		if r != 0 {
+			return 0, fmt.Errorf("%s failed on %s", CDumpE2FS, dev)
+		}
+		if c, b := extBlockCount.FindStringSubmatch(out), extBlockSize.FindStringSubmatch(out); c != nil && b != nil {
+			count, bsize = c[1], b[1]
+		}
+	case FsXFS_:
+		r, out, _ := x.ExecCmd(fmt.Sprintf("%s %s", CXFSInfo, dev))
+		if r != 0 {
+			return 0, fmt.Errorf("%s failed on %s", CXFSInfo, dev)
+		}
+		if d := xfsData.FindStringSubmatch(out); d != nil {
+			bsize, count = d[1], d[2]
+		}
+	default:
+		return 0, ErrUnsFs
+	}
+	if count == "" {
+		return 0, fmt.Errorf("no block count found for %s", dev)
+	}
+
+	c, _ := strconv.ParseInt(count, 10, 64)
+	b, _ := strconv.ParseInt(bsize, 10, 64)
+	return c * b, nil
+}
+
+// checkSize warns, or fails with StrictSize, when the file system does not
+// fit on its device. File systems other than ext and xfs are not checked
+func (m *DevMounter) checkSize() (err error) {
+	if !m.CheckSize && !m.StrictSize {
+		return nil
+	}
+
+	fsSize, err := m.env().FSSize(m.fs, m.args_.dev)
+	if err == ErrUnsFs {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	devSize, err := m.env().DeviceSize(m.args_.dev)
+	if err != nil {
+		return err
+	}
+
+	if fsSize > devSize {
+		if m.StrictSize {
+			return fmt.Errorf("%w: %d > %d bytes", ErrSizeMismatch, fsSize, devSize)
+		}
+		m.warn("%s: file system of %d bytes on a device of %d bytes, the image may be truncated", m.args_.dev, fsSize, devSize)
+	}
+	return nil
+}
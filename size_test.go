@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSize(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "truncated.img")
+	if err := ioutil.WriteFile(img, make([]byte, 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeRunner("")
+	f.replies["dumpe2fs -h "+img] = fakeReply{0, "Block count:              4\nBlock size:               4096\n"}
+	f.replies["xfs_info "+img] = fakeReply{0, "data     =                       bsize=4096   blocks=3, imaxpct=25\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(img, fakePath, "")
+	m.fs = FsExt4
+	m.CheckSize = true
+	if err := m.checkSize(); err != nil || len(m.warnings_) != 1 {
+		t.Errorf("got %v, warnings %q", err, m.warnings_)
+	}
+
+	m.StrictSize = true
+	if err := m.checkSize(); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("got %v, want %v", err, ErrSizeMismatch)
+	}
+
+	m.fs = FsXFS_
+	if err := m.checkSize(); err == nil {
+		t.Error("xfs of 12288 bytes fits in 8192")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const CDmsetup Caller_ = "dmsetup"
+
+var (
+	ErrSnapshot            = errors.New("failed to set up the dm-snapshot")
+	ErrSnapshotUnsupported = errors.New("no dm-snapshot of this device")
+)
+
+// DMSnapshot creates the device-mapper snapshot name of the block device
+// origin, every write goes to the block device cow and origin is never
+// written. It returns the node of the snapshot
+func DMSnapshot(name, origin, cow string) (dev string, err error) {
+	return cmdEnv{}.DMSnapshot(name, origin, cow)
+}
+
+func (x cmdEnv) DMSnapshot(name, origin, cow string) (dev string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s --getsz %s", CBlockDev, origin))
+	if r != 0 {
+		return "", fmt.Errorf("%w: failed to read the size of %s", ErrSnapshot, origin)
+	}
+	// non-persistent, a chunk of 8 sectors
+	table := fmt.Sprintf("0 %s snapshot %s %s N 8", strings.TrimSpace(out), origin, cow)
+	if r, out, _ = x.ExecArgv(string(CDmsetup), "create", name, "--table", table); r != 0 {
+		return "", fmt.Errorf("%w: %s", ErrSnapshot, strings.TrimSpace(out))
+	}
+	return filepath.Join(DevMapperDir, name), nil
+}
+
+func DMRemove(name string) (err error) {
+	return cmdEnv{}.DMRemove(name)
+}
+
+func (x cmdEnv) DMRemove(name string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s remove %s", CDmsetup, name)); r != 0 {
+		return fmt.Errorf("failed to remove %s", name)
+	}
+	return nil
+}
+
+// isRegular tells an image file from a block device
+func isRegular(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// noSnapshot fails a Snapshot of what bindFS mounts without one: a zfs pool
+// imports all of its members, apple file systems and swap are never
+// snapshotted and assembling an md array writes to its members
+func (m *DevMounter) noSnapshot(what string) error {
+	if !m.Snapshot {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is %s", ErrSnapshotUnsupported, m.args_.dev, what)
+}
+
+// snapshot puts a dm-snapshot over the device when asked to, which replaces
+// it as the device to mount. The uuid change and a journal replay then write
+// to SnapshotCOW only. Close removes the snapshot, its loop devices and the
+// temporary copy-on-write file
+func (m *DevMounter) snapshot() (err error) {
+	if !m.Snapshot || m.snap_ != "" {
+		return nil
+	}
+
+	origin := m.args_.dev
+	if isRegular(origin) {
+		if origin, err = m.env().LoopAttach(origin, m.SectorSize, true); err != nil {
+			return err
+		}
+		loop := origin
+		m.pushCleanup(func() error { return m.env().LoopDetach(loop) })
+	}
+
+	cow := m.SnapshotCOW
+	if cow == "" {
+		size, err := m.env().DeviceSize(origin)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile("", "newid-cow-")
+		if err != nil {
+			return err
+		}
+		// sparse, it only grows by what is written
+		err = f.Truncate(size)
+		f.Close()
+		cow = f.Name()
+		m.pushCleanup(func() error { return os.Remove(cow) })
+		if err != nil {
+			return err
+		}
+	}
+	if isRegular(cow) {
+		if cow, err = m.env().LoopAttach(cow, 0, false); err != nil {
+			return err
+		}
+		loop := cow
+		m.pushCleanup(func() error { return m.env().LoopDetach(loop) })
+	}
+
+	name := "newid-snap-" + filepath.Base(m.args_.dev)
+	dev, err := m.env().DMSnapshot(name, origin, cow)
+	if err != nil {
+		return err
+	}
+	m.pushCleanup(func() error { return m.env().DMRemove(name) })
+
+	m.snap_ = m.args_.dev
+	m.args_.dev = dev
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	loopPartition = regexp.MustCompile(`^(/dev/loop\d+)p\d+$`)
+	dmDep         = regexp.MustCompile(`\(([^)]+)\)`)
+)
+
+// CleanupStale unmounts what is still mounted with tag, newest first, and
+// releases what the mounts sat on: the luks mappings and dm-snapshots Start
+// named newid-*, and the loop devices under them, found through mountinfo,
+// dmsetup deps and losetup -l. A long running owner calls it when starting,
+// for what a crashed run of it left behind. A custom LUKSName is not known
+// as one of ours and stays open. Failures do not stop the rest, they are
+// returned together
+func CleanupStale(tag string) (err error) {
+	return cmdEnv{}.CleanupStale(tag)
+}
+
+func (x cmdEnv) CleanupStale(tag string) (err error) {
+	paths, err := MountsWithTag(tag)
+	if err != nil {
+		return err
+	}
+	loops, err := x.listLoops()
+	if err != nil {
+		return err
+	}
+
+	var errs CleanupError
+	for i := len(paths) - 1; i >= 0; i-- {
+		e, err := MountEntryAt(paths[i])
+		if err != nil || e == nil {
+			continue
+		}
+		if err = x.UMount(paths[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", paths[i], err))
+			continue
+		}
+		errs = append(errs, x.releaseStale(e.Source, loops)...)
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// releaseStale releases dev when it is one of ours and whatever it sits on
+func (x cmdEnv) releaseStale(dev string, loops map[string]string) (errs []error) {
+	if p := loopPartition.FindStringSubmatch(dev); p != nil {
+		dev = p[1]
+	}
+
+	if back, ok := loops[dev]; ok {
+		if loopInUse(dev) {
+			return nil
+		}
+		if err := x.LoopDetach(dev); err != nil {
+			return []error{err}
+		}
+		delete(loops, dev)
+		// the temporary copy-on-write file of a snapshot
+		if strings.HasPrefix(filepath.Base(back), "newid-cow-") {
+			if err := os.Remove(back); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+		return errs
+	}
+
+	name := strings.TrimPrefix(dev, DevMapperDir+"/")
+	if name == dev || !strings.HasPrefix(name, "newid-") {
+		return nil
+	}
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s deps -o devname %s", CDmsetup, name))
+	if r != 0 {
+		return []error{fmt.Errorf("failed to read what %s sits on", dev)}
+	}
+	var err error
+	if strings.HasPrefix(name, "newid-snap-") {
+		err = x.DMRemove(name)
+	} else {
+		err = x.LUKSClose(name)
+	}
+	if err != nil {
+		return []error{err}
+	}
+	// 2 dependencies  : (loop4) (loop3), a dm device by its map name
+	for _, d := range dmDep.FindAllStringSubmatch(out, -1) {
+		dep := filepath.Join(DevMapperDir, d[1])
+		if strings.HasPrefix(d[1], "loop") {
+			dep = "/dev/" + d[1]
+		}
+		errs = append(errs, x.releaseStale(dep, loops)...)
+	}
+	return errs
+}
+
+// loopInUse tells whether loop or one of its partitions is still mounted,
+// e.g. by a mount of no tag
+func loopInUse(loop string) bool {
+	all, _ := ReadMountInfo()
+	for _, e := range all {
+		if p := loopPartition.FindStringSubmatch(e.Source); e.Source == loop || (p != nil && p[1] == loop) {
+			return true
+		}
+	}
+	return false
+}
+
+// listLoops maps the attached loop devices to their backing files
+func (x cmdEnv) listLoops() (loops map[string]string, err error) {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -l -n -O NAME,BACK-FILE", CLosetup))
+	if r != 0 {
+		return nil, fmt.Errorf("failed to list the loop devices")
+	}
+	loops = map[string]string{}
+	for _, l := range strings.Split(out, "\n") {
+		fs := strings.Fields(l)
+		if len(fs) == 0 {
+			continue
+		}
+		loops[fs[0]] = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(l), fs[0]))
+	}
+	return loops, nil
+}
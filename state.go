@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrStateFile = errors.New("state file belongs to another device or mount path")
+
+type OpStep string
+
+// the steps of Start, only change-uuid and mount are kept in the operation log
+const (
+	StepBind            OpStep = "bind"
+	StepUnmountExisting OpStep = "unmount-existing"
+	StepLoadState       OpStep = "load-state"
+	StepPreparePath     OpStep = "prepare-path"
+	StepCheckSize       OpStep = "check-size"
+	StepFsck            OpStep = "fsck"
+	StepChangeUUID      OpStep = "change-uuid"
+	StepMount           OpStep = "mount"
+	StepRecordUUID      OpStep = "record-uuid"
+	StepCheck           OpStep = "check"
+	StepResize          OpStep = "resize"
+	StepClearState      OpStep = "clear-state"
+	// the temporary xfs mount, part of change-uuid
+	StepXFSLogReplay OpStep = "xfs-log-replay"
+)
+
+// StepEvent tells DevMounter.OnStep about a step of Start, once with Done
+// unset when it begins and once with its duration and outcome when it ends
+type StepEvent struct {
+	Step    OpStep
+	Done    bool
+	Elapsed time.Duration
+	Err     error
+}
+
+// timeStep runs fn as step, reporting it to OnStep
+func (m *DevMounter) timeStep(step OpStep, fn func() error) (err error) {
+	if m.OnStep == nil && m.onStep_ == nil {
+		return fn()
+	}
+	m.stepEvent(StepEvent{Step: step})
+	start := time.Now()
+	err = fn()
+	m.stepEvent(StepEvent{Step: step, Done: true, Elapsed: time.Since(start), Err: err})
+	return err
+}
+
+func (m *DevMounter) stepEvent(e StepEvent) {
+	if m.onStep_ != nil {
+		m.onStep_(e)
+	}
+	if m.OnStep != nil {
+		m.OnStep(e)
+	}
+}
+
+// OpState is the operation log kept in DevMounter.StateFile. A step is written
+// as Intent before it runs and moved to Done once it succeeded, so a run killed
+// half way can be resumed without changing the uuid twice
+type OpState struct {
+	Dev     string         `json:"dev"`
+	Path    string         `json:"path"`
+	FS      FileSystemType `json:"fs"`
+	OldUUID string         `json:"old_uuid"`
+	NewUUID string         `json:"new_uuid"`
+	// the mount path was created by this operation
+	CreatedDir bool     `json:"created_dir"`
+	Intent     OpStep   `json:"intent,omitempty"`
+	Done       []OpStep `json:"done"`
+}
+
+func (s *OpState) isDone(step OpStep) bool {
+	for _, d := range s.Done {
+		if d == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *OpState) undo(step OpStep) {
+	for i, d := range s.Done {
+		if d == step {
+			s.Done = append(s.Done[:i], s.Done[i+1:]...)
+			return
+		}
+	}
+}
+
+func ReadOpState(file string) (s *OpState, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s = new(OpState)
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WriteOpState replaces file atomically
+func WriteOpState(file string, s *OpState) (err error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// writeFileAtomic writes b to a temporary file next to file and renames it
+// over file, a reader sees either the old or the new content
+func writeFileAtomic(file string, b []byte) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// loadState reads the operation log left by an interrupted run, or starts a
+// new one. Steps whose outcome was lost are settled from the device itself
+func (m *DevMounter) loadState() (err error) {
+	if m.StateFile == "" {
+		return nil
+	}
+
+	s, err := ReadOpState(m.StateFile)
+	if os.IsNotExist(err) {
+		s = &OpState{Dev: m.sourceDev(), Path: m.args_.path_, FS: m.fs}
+		s.OldUUID, _ = m.env().QueryDeviceUUID(m.args_.dev)
+		m.state_ = s
+		return m.saveState()
+	} else if err != nil {
+		return err
+	}
+
+	if !SameDevPath(s.Dev, m.sourceDev()) || s.Path != m.args_.path_ {
+		return ErrStateFile
+	}
+
+	if s.Intent == StepChangeUUID {
+		if u, err_ := m.env().QueryDeviceUUID(m.args_.dev); err_ == nil && s.OldUUID != "" && u != s.OldUUID {
+			s.NewUUID = u
+			s.Done = append(s.Done, StepChangeUUID)
+		}
+		s.Intent = ""
+	}
+	if s.Intent == StepMount {
+		if IsMount(m.args_.path_) {
+			s.Done = append(s.Done, StepMount)
+		}
+		s.Intent = ""
+	}
+	if s.isDone(StepMount) {
+		if IsMount(m.args_.path_) {
+			m.pushCleanup(m.unmountPath)
+		} else {
+			s.undo(StepMount)
+		}
+	}
+	if s.isDone(StepChangeUUID) {
+		m.uuid_ = s.NewUUID
+	}
+	m.rmdir_ = s.CreatedDir
+
+	m.state_ = s
+	return m.saveState()
+}
+
+func (m *DevMounter) saveState() (err error) {
+	if m.state_ == nil {
+		return nil
+	}
+	return WriteOpState(m.StateFile, m.state_)
+}
+
+// clearState drops the operation log after a complete run
+func (m *DevMounter) clearState() (err error) {
+	if m.state_ == nil {
+		return nil
+	}
+	m.state_ = nil
+	if err = os.Remove(m.StateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// runStep runs fn unless the operation log says it already succeeded
+func (m *DevMounter) runStep(step OpStep, fn func() error) (err error) {
+	if m.state_ == nil {
+		return fn()
+	}
+	if m.state_.isDone(step) {
+		return nil
+	}
+
+	m.state_.Intent = step
+	if err = m.saveState(); err != nil {
+		return err
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+	m.state_.Intent = ""
+	m.state_.Done = append(m.state_.Done, step)
+	m.state_.NewUUID = m.uuid_
+	return m.saveState()
+}
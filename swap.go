@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	FsSwap FileSystemType = "swap"
+
+	CSwapOn  Caller_ = "swapon"
+	CSwapOff Caller_ = "swapoff"
+
+	StepSwapOn OpStep = "swapon"
+)
+
+var ErrSwap = errors.New("the device is swap, not a mountable file system")
+
+// bindSwap turns a swap signature into ErrSwap, or into FsSwap with SwapOn
+func (m *DevMounter) bindSwap() (err error) {
+	if !m.SwapOn {
+		return ErrSwap
+	}
+	m.fs = FsSwap
+	return nil
+}
+
+// swapOn activates the swap device in place of mounting it, Close
+// deactivates it again. The uuid of swap is left alone
+func (m *DevMounter) swapOn() (err error) {
+	if r, _, _ := m.env().ExecCmd(
+		fmt.Sprintf("%s %s", CSwapOn, m.args_.dev)); r != 0 {
+		return fmt.Errorf("failed to activate the swap on %s", m.args_.dev)
+	}
+	m.pushCleanup(func() error {
+		if r, _, _ := m.env().ExecCmd(
+			fmt.Sprintf("%s %s", CSwapOff, m.args_.dev)); r != 0 {
+			return fmt.Errorf("failed to deactivate the swap on %s", m.args_.dev)
+		}
+		return nil
+	})
+	return nil
+}
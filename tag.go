@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TagOption carries DevMounter.Tag. The kernel never sees x- options, so it
+// is not in /proc/self/mountinfo, libmount keeps it in Utab for findmnt
+const TagOption = "x-newid.owner"
+
+// Utab is where libmount records the user space options of mounts
+var Utab = "/run/mount/utab"
+
+var ErrTag = errors.New("a tag must not hold commas, equal signs or white space")
+
+// MountsWithTag returns the mount points tagged with tag, oldest first
+func MountsWithTag(tag string) (paths []string, err error) {
+	f, err := os.Open(Utab)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	want := TagOption + "=" + tag
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// SRC=/dev/sdb1 TARGET=/mnt/a ROOT=/ OPTS=x-newid.owner=job-1
+		var target string
+		tagged := false
+		for _, kv := range strings.Fields(s.Text()) {
+			if strings.HasPrefix(kv, "TARGET=") {
+				target = unescapeMountInfo(strings.TrimPrefix(kv, "TARGET="))
+			} else if strings.HasPrefix(kv, "OPTS=") {
+				for _, o := range SplitMountOptions(strings.TrimPrefix(kv, "OPTS=")) {
+					tagged = tagged || o == want
+				}
+			}
+		}
+		if tagged && target != "" {
+			paths = append(paths, target)
+		}
+	}
+	return paths, s.Err()
+}
+
+// UMountTagged unmounts whatever is still mounted with tag, newest first,
+// e.g. the left overs of a crashed job
+func UMountTagged(tag string) (err error) {
+	return cmdEnv{}.UMountTagged(tag)
+}
+
+func (x cmdEnv) UMountTagged(tag string) (err error) {
+	paths, err := MountsWithTag(tag)
+	if err != nil {
+		return err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if !IsPathMounted(paths[i]) {
+			continue
+		}
+		if err = x.UMount(paths[i]); err != nil {
+			return fmt.Errorf("%s: %w", paths[i], err)
+		}
+	}
+	return nil
+}
+
+func (m *DevMounter) tagOpt() string {
+	if m.Tag == "" {
+		return ""
+	}
+	return TagOption + "=" + m.Tag
+}
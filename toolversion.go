@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrToolVersion = errors.New("the tool is too old")
+
+// toolMinimum is the oldest release of the package of tool able to change
+// the uuid of fs, of fs with feature when feature is set
+type toolMinimum struct {
+	fs      []FileSystemType
+	feature string
+	tool    Caller_
+	pkg     string
+	min     string
+	why     string
+}
+
+var toolMinimums = []toolMinimum{
+	{[]FileSystemType{FsExt2, FsExt3, FsExt4}, "metadata_csum", CTune2FS, "e2fsprogs", "1.43", "rewrites the metadata checksums"},
+	// the meta_uuid feature, the kernel needs 4.3 as well
+	{[]FileSystemType{FsXFS_}, "crc", CXFSAdmin, "xfsprogs", "4.3.0", "changes the uuid of a v5 file system"},
+	{[]FileSystemType{FsBtrfs}, "", CBtrfsTune, "btrfs-progs", "4.1", "has btrfstune -u"},
+}
+
+// versionCmds print the release of the package of a tool, tune2fs has no
+// option for it but dumpe2fs of the same e2fsprogs has
+var versionCmds = map[Caller_]string{
+	CTune2FS:   fmt.Sprintf("%s -V", CDumpE2FS),
+	CXFSAdmin:  fmt.Sprintf("%s -V", CXFSAdmin),
+	CBtrfsTune: fmt.Sprintf("%s --version", CBtrfs),
+}
+
+var toolVersion = regexp.MustCompile(`\bv?(\d+(?:\.\d+)+)`)
+
+// ToolVersion is the release of the package of tool, e.g. 1.46.5 from
+// "dumpe2fs 1.46.5 (30-Dec-2021)"
+func ToolVersion(tool Caller_) (version string, err error) {
+	return cmdEnv{}.ToolVersion(tool)
+}
+
+func (x cmdEnv) ToolVersion(tool Caller_) (version string, err error) {
+	cmd, ok := versionCmds[tool]
+	if !ok {
+		return "", fmt.Errorf("no version known of %s", tool)
+	}
+	_, out, _ := x.ExecCmd(cmd)
+	v := toolVersion.FindStringSubmatch(out)
+	if v == nil {
+		return "", fmt.Errorf("no version in %q", strings.TrimSpace(out))
+	}
+	return v[1], nil
+}
+
+// olderThan compares dotted versions, a missing part counts as 0
+func olderThan(v, min string) bool {
+	a, b := strings.Split(v, "."), strings.Split(min, ".")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if i < len(b) {
+			y, _ = strconv.Atoi(b[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// ToolVersionError is a failed uuid change by a tool older than the file
+// system needs, it is ErrToolVersion for errors.Is as well as the failure
+type ToolVersionError struct {
+	Err     error
+	Tool    Caller_
+	Package string
+	Version string
+	Min     string
+	Why     string
+}
+
+func (e *ToolVersionError) Error() string {
+	return fmt.Sprintf("%v: %s of %s %s, upgrade %s to >= %s, which %s",
+		e.Err, e.Tool, e.Package, e.Version, e.Package, e.Min, e.Why)
+}
+
+func (e *ToolVersionError) Unwrap() error { return e.Err }
+
+func (e *ToolVersionError) Is(target error) bool { return target == ErrToolVersion }
+
+// toolVersionError explains the failed uuid change err by the version of the
+// tool when it is older than the features of the file system need. It is
+// only asked once the tool failed, a change that works costs nothing
+func (m *DevMounter) toolVersionError(err error) error {
+	var features []string
+	for _, t := range toolMinimums {
+		if !t.applies(m.fs) {
+			continue
+		}
+		if t.feature != "" {
+			if features == nil {
+				features = m.env().probeFeatures(m.fs, m.args_.dev)
+			}
+			if !hasFeature(features, t.feature) {
+				continue
+			}
+		}
+		if v, err_ := m.env().ToolVersion(t.tool); err_ == nil && olderThan(v, t.min) {
+			return &ToolVersionError{Err: err, Tool: t.tool, Package: t.pkg, Version: v, Min: t.min, Why: t.why}
+		}
+	}
+	return err
+}
+
+func (t toolMinimum) applies(fs FileSystemType) bool {
+	for _, f := range t.fs {
+		if f == fs {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
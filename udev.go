@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DiskByUUID = "/dev/disk/by-uuid"
+
+var ErrUdevSettle = errors.New("udevadm settle failed")
+
+func UdevSettle() (err error) {
+	return cmdEnv{}.UdevSettle()
+}
+
+func (x cmdEnv) UdevSettle() (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s settle", CUdevadm)); r != 0 {
+		return ErrUdevSettle
+	}
+	return nil
+}
+
+// settleUdev waits for udev when UdevSettle is set, reads the uuid again and
+// warns when its by-uuid link is still missing
+func (m *DevMounter) settleUdev() (err error) {
+	if !m.UdevSettle {
+		return nil
+	}
+	if err = m.env().UdevSettle(); err != nil {
+		return err
+	}
+	if m.uuid_ == NilUUID {
+		return nil
+	}
+
+	if m.uuid_, err = m.env().QueryDeviceUUID(m.args_.dev); err != nil {
+		return ErrQueryUUID
+	}
+	// ntfs serials are linked upper case
+	for _, u := range []string{m.uuid_, strings.ToUpper(m.uuid_)} {
+		if _, err = os.Stat(filepath.Join(DiskByUUID, u)); err == nil {
+			return nil
+		}
+	}
+	m.warn("%s/%s does not exist after udevadm settle", DiskByUUID, m.uuid_)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultUMountRetries = 3
+	UMountRetryInterval  = time.Second
+)
+
+// unmountExisting clears earlier mounts of the device and of the mount path,
+// a left over of the repeated mount this module exists for
+func (m *DevMounter) unmountExisting() (err error) {
+	if !m.ForceUnmountExisting {
+		return nil
+	}
+
+	entries, err := MountsForDevice(m.args_.dev)
+	if err != nil {
+		return err
+	}
+	// nested mounts go first
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err = m.forceUMount(entries[i].MountPoint); err != nil {
+			return err
+		}
+	}
+	// one umount for each mount stacked on the path, a mount coming back
+	// would keep it busy forever
+	stacked, err := MountEntriesAt(m.args_.path_)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		e, err := MountEntryAt(m.args_.path_)
+		if err != nil || e == nil {
+			return err
+		}
+		if i == len(stacked) {
+			return fmt.Errorf("%w: %s is still mounted after %d unmounts", ErrUMount, m.args_.path_, i)
+		}
+		if err = m.forceUMount(m.args_.path_); err != nil {
+			return err
+		}
+	}
+}
+
+// UMountDevice unmounts dev wherever it is mounted, for a caller that only
+// kept the device. Nested mounts go first, a device mounted nowhere is fine
+func UMountDevice(dev string) (err error) {
+	return cmdEnv{}.UMountDevice(dev)
+}
+
+func (x cmdEnv) UMountDevice(dev string) (err error) {
+	entries, err := MountsForDevice(dev)
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err = x.UMount(entries[i].MountPoint); err != nil {
+			return fmt.Errorf("%s at %s: %w", dev, entries[i].MountPoint, err)
+		}
+	}
+	return nil
+}
+
+func (m *DevMounter) forceUMount(path_ string) (err error) {
+	retries := m.UMountRetries
+	if retries <= 0 {
+		retries = DefaultUMountRetries
+	}
+	for i := 0; i < retries; i++ {
+		if i != 0 {
+			time.Sleep(UMountRetryInterval)
+		}
+		if err = m.env().UMount(path_); err == nil {
+			return nil
+		}
+	}
+	if m.LazyUnmount {
+		return m.env().UMountLazy(path_)
+	}
+	return err
+}
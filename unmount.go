@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Unmount unmounts the mount path through umount2(2) with flags, e.g.
+// syscall.MNT_FORCE to abort a hung ntfs-3g or nfs mount or
+// syscall.MNT_DETACH to detach it lazily. It runs in this process, neither
+// the Runner nor CommandPrefix are involved. Close still releases what is
+// under the mount, which a lazily detached mount may keep busy
+func (m *DevMounter) Unmount(flags int) (err error) {
+	if err = syscall.Unmount(m.args_.path_, flags); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrUMount, m.args_.path_, err)
+	}
+	if m.SyncOnUnmount {
+		syscall.Sync()
+	}
+	return nil
+}
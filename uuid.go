@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// xfs_admin -U only takes the lowercase, hyphenated form
+var canonicalUUID = regexp.MustCompile("^[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}$")
+
+var (
+	ErrUUIDChangeUnsupported = errors.New("the uuid of this file system type cannot be changed")
+	ErrUUIDUnchanged         = errors.New("the uuid still reads the old one after the change")
+)
+
+// how often and how far apart verifyUUID queries a uuid that has not
+// changed yet
+var (
+	UUIDVerifyRetries  = 5
+	UUIDVerifyInterval = 200 * time.Millisecond
+)
+
+// verifyUUID queries the uuid of dev after a change, again while it still
+// reads old, as blkid and udev may lag behind the tool that changed it. An
+// empty old, e.g. when the tool may keep the uuid, skips the comparison
+func (x cmdEnv) verifyUUID(dev, old string) (uuid string, err error) {
+	for i := 0; ; i++ {
+		if uuid, err = x.QueryDeviceUUID(dev); err != nil {
+			return "", ErrQueryUUID
+		}
+		if old == "" || uuid != old {
+			return uuid, nil
+		}
+		if i == UUIDVerifyRetries {
+			return "", fmt.Errorf("%w: %s still has %s", ErrUUIDUnchanged, dev, old)
+		}
+		time.Sleep(UUIDVerifyInterval)
+	}
+}
+
+// UUIDChangeable reports whether Start gives fs a new uuid. The others, zfs
+// and swap, are mounted or activated with the uuid they have
+func UUIDChangeable(fs FileSystemType) bool {
+	_, err := fs.ChangeUUIDTool()
+	return err == nil || pluginFS(fs)
+}
+
+// requireUUIDChange fails with RequireUUIDChange when the uuid would be
+// left as it is
+func (m *DevMounter) requireUUIDChange() (err error) {
+	if m.RequireUUIDChange && m.roLoop_ {
+		return fmt.Errorf("%w: %s is attached read-only", ErrUUIDChangeUnsupported, m.image_)
+	}
+	if m.RequireUUIDChange && m.degradedBtrfs() {
+		return fmt.Errorf("%w: %s is a degraded btrfs", ErrUUIDChangeUnsupported, m.args_.dev)
+	}
+	if m.RequireUUIDChange && !UUIDChangeable(m.fs) {
+		return fmt.Errorf("%w: %s", ErrUUIDChangeUnsupported, m.fs)
+	}
+	return nil
+}
+
+// NewUUID returns a random, version 4, uuid
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (m *DevMounter) newUUID() (string, error) {
+	gen := m.UUIDGen
+	if gen == nil {
+		gen = NewUUID
+	}
+	return NormalizeUUID(gen())
+}
+
+// NormalizeUUID turns u into the lowercase, hyphenated form, braces and a
+// missing hyphenation are accepted. The error carries the rejected string
+func NormalizeUUID(u string) (string, error) {
+	n := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(u), "{"), "}"))
+	if len(n) == 32 && !strings.Contains(n, "-") {
+		n = n[0:8] + "-" + n[8:12] + "-" + n[12:16] + "-" + n[16:20] + "-" + n[20:32]
+	}
+	if !canonicalUUID.MatchString(n) {
+		return "", fmt.Errorf("%w: %q is not a uuid", ErrGenUUID, u)
+	}
+	return n, nil
+}
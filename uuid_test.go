@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUUID(t *testing.T) {
+	u := NewUUID()
+	if !uuidPattern.MatchString(u) || u[14] != '4' {
+		t.Errorf("not a v4 uuid: %q", u)
+	}
+	if u == NewUUID() {
+		t.Error("same uuid twice")
+	}
+}
+
+func TestUUIDGen(t *testing.T) {
+	const fixed = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	for _, c := range []struct {
+		fileOut string
+		want    string
+	}{
+		{"Linux rev 1.0 ext4 filesystem data", "tune2fs -U " + fixed + " " + fakeDev},
+		{"SGI XFS filesystem data", "xfs_admin -U " + fixed + " " + fakeDev},
+	} {
+		f := newFakeRunner(c.fileOut)
+		useRunner(t, f)
+
+		m := NewMounterWithArgs(fakeDev, fakePath, "")
+		m.UUIDGen = func() string { return fixed }
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, cmd := range f.cmds {
+			found = found || cmd == c.want
+		}
+		if !found {
+			t.Errorf("%q not run: %q", c.want, f.cmds)
+		}
+	}
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.UUIDGen = func() string { return "not-a-uuid" }
+	if _, err := m.newUUID(); !errors.Is(err, ErrGenUUID) || !strings.Contains(err.Error(), "not-a-uuid") {
+		t.Errorf("got %v, want %v", err, ErrGenUUID)
+	}
+}
+
+func TestNormalizeUUID(t *testing.T) {
+	const want = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	for _, u := range []string{
+		want,
+		"3F2504E0-4F89-41D3-9A0C-0305E82C3301",
+		"3f2504e04f8941d39a0c0305e82c3301",
+		"{3F2504E0-4F89-41D3-9A0C-0305E82C3301}",
+	} {
+		if got, err := NormalizeUUID(u); err != nil || got != want {
+			t.Errorf("NormalizeUUID(%q) = %q, %v", u, got, err)
+		}
+	}
+	for _, u := range []string{"", "3f2504e0-4f89-41d3-9a0c", "3f2504e0_4f89_41d3_9a0c_0305e82c3301", "zf2504e04f8941d39a0c0305e82c3301"} {
+		if _, err := NormalizeUUID(u); !errors.Is(err, ErrGenUUID) {
+			t.Errorf("NormalizeUUID(%q): got %v", u, err)
+		}
+	}
+}
+
+func TestCloneUUID(t *testing.T) {
+	const orig = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	src := filepath.Join(t.TempDir(), "orig.img")
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		fileOut, srcType, want string
+	}{
+		{"Linux rev 1.0 ext4 filesystem data", "ext4", "tune2fs -U " + orig + " " + fakeDev},
+		{"SGI XFS filesystem data", "xfs", "xfs_admin -U " + orig + " " + fakeDev},
+		{"BTRFS Filesystem", "btrfs", "btrfstune -f -U " + orig + " " + fakeDev},
+	} {
+		f := newFakeRunner(c.fileOut)
+		f.replies["blkid -s TYPE -o value "+src] = fakeReply{0, c.srcType}
+		f.replies["blkid -s UUID -o value "+src] = fakeReply{0, strings.ToUpper(orig)}
+		f.replies["blkid -s UUID -o value "+fakeDev] = fakeReply{0, orig}
+		useRunner(t, f)
+
+		m := NewMounterWithArgs(fakeDev, fakePath, "")
+		m.CloneUUIDFrom = src
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, cmd := range f.cmds {
+			found = found || cmd == c.want
+		}
+		if !found {
+			t.Errorf("%q not run: %q", c.want, f.cmds)
+		}
+	}
+
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["blkid -s TYPE -o value "+src] = fakeReply{0, "xfs"}
+	useRunner(t, f)
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.CloneUUIDFrom = src
+	if err := m.Start(); !errors.Is(err, ErrCloneUUID) {
+		t.Errorf("got %v, want %v", err, ErrCloneUUID)
+	}
+}
+
+func TestRecordOriginalUUID(t *testing.T) {
+	const orig = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["blkid -s UUID -o value "+fakeDev] = fakeReply{0, orig}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	m.RecordOriginalUUID = true
+	m.OriginalUUIDFile = filepath.Join(t.TempDir(), "uuid")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := OriginalUUID(m.OriginalUUIDFile); err != nil || u != orig {
+		t.Errorf("got %q, %v, want %q", u, err, orig)
+	}
+
+	m.ReadOnly, m.OriginalUUIDFile = true, ""
+	if err := m.Validate(); !errors.Is(err, ErrRecordUUID) {
+		t.Errorf("got %v, want %v", err, ErrRecordUUID)
+	}
+}
+
+func TestVerifyUUID(t *testing.T) {
+	const old, new_ = "0f7e0bd2-3d57-4c4c-9fa8-2b48e4e2c9a4", "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	retries, interval := UUIDVerifyRetries, UUIDVerifyInterval
+	UUIDVerifyRetries, UUIDVerifyInterval = 2, time.Millisecond
+	defer func() { UUIDVerifyRetries, UUIDVerifyInterval = retries, interval }()
+
+	// the superblock already has the new uuid, blkid lags one query behind
+	img := filepath.Join(t.TempDir(), "ext.img")
+	sb := make([]byte, extUUIDOffset+16)
+	sb[extMagicOffset], sb[extMagicOffset+1] = 0x53, 0xef
+	copy(sb[extUUIDOffset:], []byte{0x0f, 0x7e, 0x0b, 0xd2, 0x3d, 0x57, 0x4c, 0x4c, 0x9f, 0xa8, 0x2b, 0x48, 0xe4, 0xe2, 0xc9, 0xa4})
+	if err := ioutil.WriteFile(img, sb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries := 0
+	useRunner(t, RunnerFunc(func(cmdStr string) (int, string, error) {
+		if strings.HasPrefix(cmdStr, "blkid -s UUID") {
+			if queries++; queries > 1 {
+				return 0, new_, nil
+			}
+			return 0, old, nil
+		}
+		return 0, "", nil
+	}))
+	if u, err := (cmdEnv{}).verifyUUID(img, old); err != nil || u != new_ || queries != 2 {
+		t.Errorf("got %q, %v after %d queries", u, err, queries)
+	}
+
+	m := NewMounter(img, fakePath, WithFS(FsExt4))
+	queries = -10
+	if err := m.Start(); !errors.Is(err, ErrUUIDUnchanged) {
+		t.Errorf("got %v, want %v", err, ErrUUIDUnchanged)
+	}
+}
+
+func TestToolVersionError(t *testing.T) {
+	f := newFakeRunner("Linux rev 1.0 ext4 filesystem data")
+	f.replies["tune2fs"] = fakeReply{r: 1}
+	f.replies["dumpe2fs -h "+fakeDev] = fakeReply{0, "Filesystem features:      has_journal ext_attr extent metadata_csum\n"}
+	f.replies["dumpe2fs -V"] = fakeReply{0, "dumpe2fs 1.42.9 (28-Dec-2013)\n\tUsing EXT2FS Library version 1.42.9\n"}
+	useRunner(t, f)
+
+	m := NewMounterWithArgs(fakeDev, fakePath, "")
+	err := m.Start()
+	if !errors.Is(err, ErrToolVersion) || !errors.Is(err, ErrGenUUID) || !strings.Contains(err.Error(), "e2fsprogs to >= 1.43") {
+		t.Errorf("got %v", err)
+	}
+
+	// a recent tune2fs failed for another reason
+	f.replies["dumpe2fs -V"] = fakeReply{0, "dumpe2fs 1.47.0 (5-Feb-2023)\n"}
+	m.Reset(fakeDev, fakePath, "")
+	if err = m.Start(); err != ErrGenUUID {
+		t.Errorf("got %v, want %v", err, ErrGenUUID)
+	}
+
+	for _, c := range []struct {
+		v, min string
+		older  bool
+	}{{"4.2.9", "4.3.0", true}, {"4.3", "4.3.0", false}, {"5.16.2", "4.1", false}, {"1.42.13", "1.43", true}} {
+		if olderThan(c.v, c.min) != c.older {
+			t.Errorf("olderThan(%s, %s) is %v", c.v, c.min, !c.older)
+		}
+	}
+}
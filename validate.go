@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoDev  = errors.New("no device given")
+	ErrNoPath = errors.New("no mount path given")
+)
+
+// Validate checks the configuration before Start touches anything, most of
+// these mistakes would otherwise only fail half way, e.g. after the uuid was
+// changed. The error wraps the sentinel error Start would return
+func (m *DevMounter) Validate() (err error) {
+	if m.args_.dev == "" {
+		return ErrNoDev
+	}
+	if m.args_.path_ == "" {
+		if m.AutoMountBase == "" {
+			return ErrNoPath
+		}
+	} else if err = m.checkPath(); err != nil {
+		return fmt.Errorf("%w: %s", err, m.args_.path_)
+	}
+
+	if m.FS != "" && !supportedFS(m.FS) {
+		return fmt.Errorf("%w: %s", ErrUnsFs, m.FS)
+	}
+	if m.FS != "" && m.RequireUUIDChange && !UUIDChangeable(m.FS) {
+		return fmt.Errorf("%w: %s", ErrUUIDChangeUnsupported, m.FS)
+	}
+	switch m.XFSUUIDMode {
+	case XFSUUIDLocal, XFSUUIDGenerate, XFSUUIDNil, XFSUUIDRestore:
+	default:
+		if !uuidPattern.MatchString(string(m.XFSUUIDMode)) {
+			return fmt.Errorf("%w: %q", ErrUUIDMode, m.XFSUUIDMode)
+		}
+	}
+	if m.CloneUUIDFrom != "" && (m.XFSUUIDMode != XFSUUIDLocal || m.UUIDGen != nil) {
+		return fmt.Errorf("%w: a cloned uuid excludes an xfs uuid mode and a uuid generator", ErrCloneUUID)
+	}
+	if m.RecordOriginalUUID && m.OriginalUUIDFile == "" && (m.ReadOnly || m.BtrfsDegraded) {
+		return fmt.Errorf("%w: a read-only mount takes no xattr, give a file", ErrRecordUUID)
+	}
+	if m.EnableQuota && (m.Quota == "" || m.ReadOnly) {
+		return fmt.Errorf("%w: quotas are turned on for a writable mount with quota options", ErrQuota)
+	}
+	if m.FastRestore && m.ReadOnly {
+		return fmt.Errorf("%w: a read-only mount is restored to by nobody", ErrFastRestore)
+	}
+	if m.FastRestoreNoJournal && (!m.FastRestore || m.ExtJournalDevice != "") {
+		return fmt.Errorf("%w: the journal is removed for a fast restore with no external journal", ErrFastRestore)
+	}
+	if m.Quota != "" && m.FS != "" && !quotaFS(m.FS) {
+		return fmt.Errorf("%w: %s", ErrQuotaUnsupported, m.FS)
+	}
+	if err = checkExtraArgs(m.ExtraChangeArgs, m.args_.dev, ""); err != nil {
+		return fmt.Errorf("%w: %q", err, m.ExtraChangeArgs)
+	}
+	if m.Propagation != "" && !validPropagation(m.Propagation) {
+		return fmt.Errorf("%w: %q", ErrPropagate, m.Propagation)
+	}
+	switch m.NTFSDriver {
+	case "", NTFSAuto, NTFSKernel, NTFSLegacy, NTFSFuse:
+	default:
+		return fmt.Errorf("%w: %q", ErrNTFSDriver, m.NTFSDriver)
+	}
+	switch m.ImageFormat {
+	case "", ImageQCOW2, ImageVMDK:
+	default:
+		return fmt.Errorf("unsupported image format %q, expect qcow2 or vmdk", m.ImageFormat)
+	}
+	if m.NBDPartition < 0 {
+		return fmt.Errorf("invalid nbd partition %d", m.NBDPartition)
+	}
+
+	if m.LUKSHeader != "" && m.LUKSKeyFile == "" {
+		return ErrLUKSKey
+	}
+	switch m.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid sector size %d, expect 512, 1024, 2048 or 4096", m.SectorSize)
+	}
+	if strings.ContainsAny(m.Tag, ",= \t\n") {
+		return fmt.Errorf("%w: %q", ErrTag, m.Tag)
+	}
+	if m.BtrfsSubvol != "" && m.BtrfsSubvolID != 0 {
+		return ErrBtrfsSubvol
+	}
+	if m.ResizeToFill && (m.ReadOnly || m.BtrfsDegraded || m.OverlayScratch != "") {
+		return ErrResizeRO
+	}
+	if m.LazyUnmount && !m.ForceUnmountExisting {
+		return errors.New("lazy unmount is only used to force unmounting existing mounts")
+	}
+	if m.FsckTimeout < 0 || m.MountTimeout < 0 {
+		return errors.New("negative timeout")
+	}
+	if m.FsckParallel < 0 {
+		return errors.New("negative fsck parallel")
+	}
+	return nil
+}
+
+func supportedFS(fs FileSystemType) bool {
+	if pluginFS(fs) {
+		return true
+	}
+	for _, v := range []FileSystemType{FsExt2, FsExt3, FsExt4, FsXFS_, FsNTFs, FsBtrfs, FsZFS, FsHFSPlus, FsAPFS} {
+		if fs == v {
+			return true
+		}
+	}
+	return false
+}
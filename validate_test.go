@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		dev   string
+		path  string
+		setup func(m *DevMounter)
+		want  error
+	}{
+		{"ok", fakeDev, fakePath, nil, nil},
+		{"no device", "", fakePath, nil, ErrNoDev},
+		{"no path", fakeDev, "", nil, ErrNoPath},
+		{"unsafe path", fakeDev, "/etc", nil, ErrUnsafeMountPath},
+		{"fs", fakeDev, fakePath, func(m *DevMounter) { m.FS = "vfat" }, ErrUnsFs},
+		{"xfs uuid", fakeDev, fakePath, func(m *DevMounter) { m.XFSUUIDMode = "random" }, ErrUUIDMode},
+		{"extra args", fakeDev, fakePath, func(m *DevMounter) { m.ExtraChangeArgs = []string{fakeDev} }, ErrExtraArgs},
+		{"propagation", fakeDev, fakePath, func(m *DevMounter) { m.Propagation = "rshared" }, ErrPropagate},
+		{"ntfs driver", fakeDev, fakePath, func(m *DevMounter) { m.NTFSDriver = "fuse" }, ErrNTFSDriver},
+		{"subvol", fakeDev, fakePath, func(m *DevMounter) { m.BtrfsSubvol, m.BtrfsSubvolID = "@", 5 }, ErrBtrfsSubvol},
+		{"resize ro", fakeDev, fakePath, func(m *DevMounter) { m.ResizeToFill, m.ReadOnly = true, true }, ErrResizeRO},
+	}
+	for _, c := range cases {
+		m := NewMounterWithArgs(c.dev, c.path, "")
+		if c.setup != nil {
+			c.setup(m)
+		}
+		if err := m.Validate(); !errors.Is(err, c.want) || (c.want == nil) != (err == nil) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const StepVerify OpStep = "verify"
+
+var ErrVerify = errors.New("the post-mount command failed")
+
+// VerifyResult is what PostMountCmd gave
+type VerifyResult struct {
+	Command string `json:"command"`
+	Exit    int    `json:"exit"`
+	Output  string `json:"output,omitempty"`
+}
+
+// postMountArgv is PostMountCmd with every {} replaced by the mount path, or
+// the path appended when there is none
+func (m *DevMounter) postMountArgv() []string {
+	argv := make([]string, len(m.PostMountCmd))
+	found := false
+	for i, a := range m.PostMountCmd {
+		found = found || strings.Contains(a, "{}")
+		argv[i] = strings.Replace(a, "{}", m.args_.path_, -1)
+	}
+	if !found {
+		argv = append(argv, m.args_.path_)
+	}
+	return argv
+}
+
+// runPostMountCmd runs PostMountCmd on the mounted path and keeps its result.
+// A failure is a warning, unless StrictVerify unmounts everything again and
+// fails
+func (m *DevMounter) runPostMountCmd() (err error) {
+	if len(m.PostMountCmd) == 0 {
+		return nil
+	}
+
+	argv := m.postMountArgv()
+	r, out, err_ := m.env().ExecArgv(argv...)
+	if err_ != nil && r == 0 {
+		r = -1
+	}
+	m.verify_ = &VerifyResult{Command: strings.Join(argv, " "), Exit: r, Output: strings.TrimSpace(out)}
+	if r == 0 {
+		return nil
+	}
+	if !m.StrictVerify {
+		m.warn("%s exited with %d", argv[0], r)
+		return nil
+	}
+	if err_ = m.Close(); err_ != nil {
+		m.warn("failed to tear down after %s: %v", argv[0], err_)
+	}
+	return fmt.Errorf("%w: %s exited with %d", ErrVerify, argv[0], r)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"text/tabwriter"
+)
+
+// Version is set at build time, e.g. -ldflags "-X main.Version=v1.2.0",
+// the module version is used when empty
+var Version string
+
+// FSSupport tells what this build does with a file system
+type FSSupport struct {
+	FS         FileSystemType `json:"fs"`
+	Detect     bool           `json:"detect"`
+	Mount      bool           `json:"mount"`
+	ChangeUUID bool           `json:"change_uuid"`
+}
+
+// SupportMatrix is asked from the same functions Start uses to detect,
+// mount and change the uuid of a file system
+func SupportMatrix() (matrix []FSSupport) {
+	detected := append(append([]FileSystemType(nil), fileFSTypes...), FsZFS, FsSwap, FsHFSPlus, FsAPFS)
+	detected = append(detected, pluginFSTypes()...)
+	for _, fs := range detected {
+		matrix = append(matrix, FSSupport{
+			FS:         fs,
+			Detect:     true,
+			Mount:      supportedFS(fs),
+			ChangeUUID: UUIDChangeable(fs),
+		})
+	}
+	return matrix
+}
+
+func buildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// PrintVersion writes the version followed by the SupportMatrix
+func PrintVersion(w io.Writer) {
+	fmt.Fprintf(w, "newid-mount %s\n\n", buildVersion())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "fs\tdetect\tmount\tchange uuid")
+	yes := map[bool]string{true: "yes", false: "no"}
+	for _, s := range SupportMatrix() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.FS, yes[s.Detect], yes[s.Mount], yes[s.ChangeUUID])
+	}
+	tw.Flush()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// warmRegions are the byte ranges warmCache reads: the superblocks of ext,
+// xfs and btrfs and what follows them, and the first btrfs mirror
+var warmRegions = []struct{ off, n int64 }{
+	{0, 1 << 20},
+	{64 << 20, 4096},
+}
+
+// warmCache reads the superblock regions of the device ahead of the mount,
+// when asked to, so that mount finds them in the page cache of the device
+// on high latency storage. ext reads its metadata through that page cache,
+// xfs keeps a buffer cache of its own and gains little. A failed read is a
+// warning only
+func (m *DevMounter) warmCache() {
+	if !m.WarmCache {
+		return
+	}
+	f, err := os.Open(m.args_.dev)
+	if err != nil {
+		m.warn("failed to warm the cache of %s: %v", m.args_.dev, err)
+		return
+	}
+	defer f.Close()
+
+	for _, r := range warmRegions {
+		b := make([]byte, r.n)
+		if _, err = f.ReadAt(b, r.off); err != nil && err != io.EOF {
+			m.warn("failed to warm the cache of %s: %v", m.args_.dev, err)
+			return
+		}
+	}
+}
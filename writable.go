@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrRemountedRO = errors.New("the file system went read-only, likely after an i/o error with errors=remount-ro")
+
+// CheckWritable fails with ErrRemountedRO when a file system mounted
+// writable has turned read-only since, e.g. ext with errors=remount-ro after
+// an i/o error. The kernel flips the super block options only, the per mount
+// options still say rw, so both are looked at
+func (m *DevMounter) CheckWritable() (err error) {
+	if m.wantReadOnly() || m.roMount_ {
+		return nil
+	}
+	e, err := MountEntryAt(m.args_.path_)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return ErrNotMount
+	}
+	if e.HasOption("ro") {
+		return ErrRemountedRO
+	}
+	for _, o := range e.SuperOptions {
+		if o == "ro" {
+			return ErrRemountedRO
+		}
+	}
+	return nil
+}
+
+// WatchWritable runs CheckWritable every interval until done is closed, and
+// sends the first failure before it stops. The channel is closed either way
+func (m *DevMounter) WatchWritable(interval time.Duration, done <-chan struct{}) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := m.CheckWritable(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+	return errs
+}
+
+func (m *DevMounter) wantReadOnly() bool {
+	if m.ReadOnly || m.BtrfsDegraded || m.roLoop_ || appleFS(m.fs) {
+		return true
+	}
+	for _, o := range m.MountOptions {
+		if o == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// Remount changes the options of the mounted path in place, e.g. Remount("rw")
+// runs `mount -o remount,rw path`. Helpers such as ntfs-3g cannot remount
+func (m *DevMounter) Remount(opts ...string) (err error) {
+	if m.caller_ != CMount {
+		return fmt.Errorf("%w: %s cannot remount %s", ErrMount, m.caller_, m.args_.path_)
+	}
+	o := strings.Join(append([]string{"remount"}, opts...), ",")
+	if r, out, _ := m.env().ExecCmd(fmt.Sprintf("%s -o %s %s", CMount, o, m.args_.path_)); r != 0 {
+		return mountExitError(ErrMount, CMount, r, out)
+	}
+	return nil
+}
+
+// StepVerifyMount is the verification of StartVerified and the remount to
+// read-write, right after the mount
+const StepVerifyMount OpStep = "verify-mount"
+
+// StartVerified mounts read-only first, so that nothing writes to the file
+// system before verify passed, and then remounts it read-write. Only the
+// mount is read-only, luks and md devices are opened writable and the uuid
+// is changed as by Start. The steps writing to the mounted path, the bind
+// paths, the original uuid xattr, quota, resize, the post mount command and
+// the nfs export, follow the remount. verify may be nil. A mount wanted
+// read-only anyway stays so. When verify or the remount fails the path stays
+// mounted read-only, Close unmounts it
+func (m *DevMounter) StartVerified(verify func(mountPath string) error) (err error) {
+	m.roMount_ = !m.wantReadOnly()
+	m.verifying_, m.verifyFn_ = true, verify
+	defer func() { m.roMount_, m.verifying_, m.verifyFn_ = false, false, nil }()
+	return m.Start()
+}
+
+func (m *DevMounter) verifyMount() (err error) {
+	if m.verifyFn_ != nil {
+		if err = m.verifyFn_(m.args_.path_); err != nil {
+			return err
+		}
+	}
+	if !m.roMount_ {
+		return nil
+	}
+	if err = m.Remount("rw"); err != nil {
+		return err
+	}
+	m.roMount_ = false
+	return m.CheckWritable()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrXFSDuplicateUUID = errors.New("an xfs with the same uuid is mounted, nouuid was not enough")
+
+var ErrXFSDirtyLog = errors.New("the xfs log is unclean and cannot be replayed by mounting, " +
+	"run xfs_repair -L by hand or allow log zeroing, either loses the metadata changes in the log")
+
+// XFSLogDirty asks xfs_repair, in no modify mode, whether the log of dev
+// still holds changes to replay
+func XFSLogDirty(dev string) bool {
+	return cmdEnv{}.XFSLogDirty(dev)
+}
+
+func (x cmdEnv) XFSLogDirty(dev string) bool {
+	r, out, _ := x.ExecCmd(fmt.Sprintf("%s -n %s", CXFSRepair, dev))
+	return r == 2 || strings.Contains(out, "metadata changes in a log")
+}
+
+// ZeroXFSLog destroys the log of dev and repairs the file system
+func ZeroXFSLog(dev string) (err error) {
+	return cmdEnv{}.ZeroXFSLog(dev)
+}
+
+func (x cmdEnv) ZeroXFSLog(dev string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s -L %s", CXFSRepair, dev)); r != 0 {
+		return ErrXFSDirtyLog
+	}
+	return nil
+}
+
+// xfsMountError explains a failed nouuid mount. Some kernels refuse it while
+// the file system of the same uuid is mounted, so the error names where
+func (m *DevMounter) xfsMountError(out string) error {
+	msg := strings.TrimSpace(out)
+	uuid, err := m.env().QueryDeviceUUID(m.args_.dev)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMount, msg)
+	}
+	devs, _ := m.env().DevicesByUUID(uuid)
+	major, minor, _ := DeviceNumber(m.args_.dev)
+	for _, d := range devs {
+		if SameDevPath(d, m.args_.dev) {
+			continue
+		}
+		if ma, mi, err := DeviceNumber(d); err == nil && ma == major && mi == minor {
+			continue
+		}
+		if es, _ := MountsForDevice(d); len(es) != 0 {
+			return fmt.Errorf("%w: %s has the uuid %s too and is mounted at %s, "+
+				"unmount it until the uuid is changed: %s", ErrXFSDuplicateUUID, d, uuid, es[0].MountPoint, msg)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrMount, msg)
+}
+
+// XFSDBSetUUID does what xfs_admin -U does, for hosts with xfs_db but without
+// the xfs_admin script. uuid_ is generate, nil, restore or a uuid. The command
+// of -c must stay one argument, so DefaultRunner has to be an ArgvRunner
+func XFSDBSetUUID(uuid_, dev string) (err error) {
+	return cmdEnv{}.XFSDBSetUUID(uuid_, dev)
+}
+
+func (x cmdEnv) XFSDBSetUUID(uuid_, dev string) (err error) {
+	if _, ok := DefaultRunner.(ArgvRunner); !ok {
+		return fmt.Errorf("%w: xfs_db needs a runner taking an argv", ErrGenUUID)
+	}
+	if r, _, _ := x.ExecArgv(string(CXFSDB), "-x", "-c", "uuid "+uuid_, dev); r != 0 {
+		return ErrGenUUID
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// FsZFS is a zfs pool member. A pool has no uuid to change, it is imported
+// and one of its datasets mounted instead, then exported again by Close
+const FsZFS FileSystemType = "zfs"
+
+const CZPool Caller_ = "zpool"
+
+var ErrZFSImport = errors.New("failed to import the zfs pool")
+
+// bindZFS reads the pool name and guid, blkid reports them as LABEL and UUID
+func (m *DevMounter) bindZFS() (err error) {
+	if m.zpool_, err = m.env().QueryDeviceTag(m.args_.dev, "LABEL"); err != nil {
+		return ErrZFSImport
+	}
+	m.uuid_, _ = m.env().QueryDeviceUUID(m.args_.dev)
+	return nil
+}
+
+// mountZFS imports the pool without mounting anything, then mounts
+// ZFSDataset, or the root dataset, at the mount path
+func (m *DevMounter) mountZFS(opts ...string) (err error) {
+	if m.zpool_ == "" {
+		if err = m.bindZFS(); err != nil {
+			return err
+		}
+	}
+
+	if err = m.env().ZPoolImport(filepath.Dir(m.args_.dev), m.zpool_); err != nil {
+		return err
+	}
+	pool := m.zpool_
+	m.pushCleanup(func() error { return m.env().ZPoolExport(pool) })
+
+	ds := m.zpool_
+	if m.ZFSDataset != "" {
+		ds = m.zpool_ + "/" + m.ZFSDataset
+	}
+	// zfsutil lets mount.zfs take datasets whose mountpoint is not legacy
+	return m.env().MountWithTimeout(FsZFS, ds, m.args_.path_, m.mountCtx(append(opts, "zfsutil")...), m.MountTimeout)
+}
+
+// ZPoolImport imports pool from the devices in dir, with no dataset mounted
+func ZPoolImport(dir, pool string) (err error) {
+	return cmdEnv{}.ZPoolImport(dir, pool)
+}
+
+func (x cmdEnv) ZPoolImport(dir, pool string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s import -d %s -N %s", CZPool, dir, pool)); r != 0 {
+		return ErrZFSImport
+	}
+	return nil
+}
+
+func ZPoolExport(pool string) (err error) {
+	return cmdEnv{}.ZPoolExport(pool)
+}
+
+func (x cmdEnv) ZPoolExport(pool string) (err error) {
+	if r, _, _ := x.ExecCmd(
+		fmt.Sprintf("%s export %s", CZPool, pool)); r != 0 {
+		return fmt.Errorf("failed to export the zfs pool %s", pool)
+	}
+	return nil
+}